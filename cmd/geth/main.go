@@ -159,6 +159,47 @@ participating.
 		utils.EnableNodePermissionFlag,
 		utils.RaftModeFlag,
 		utils.RaftBlockTime,
+		utils.RaftMixHashFlag,
+		utils.RaftNonceFlag,
+		utils.RaftMinBlockTimeDeltaFlag,
+		utils.RaftAllowedContractsFlag,
+		utils.RaftAllowContractCreationFlag,
+		utils.RaftFatalHeadDivergenceFlag,
+		utils.RaftBatchFailureAbortsRoundFlag,
+		utils.RaftDropCollidingCreationsFlag,
+		utils.RaftOnDemandFlag,
+		utils.RaftMaxBlockValueFlag,
+		utils.RaftReceiptCacheFlag,
+		utils.RaftTxTimeoutFlag,
+		utils.RaftCoinbasesFlag,
+		utils.RaftMaxPrivatePayloadFlag,
+		utils.RaftDropOversizedPrivateFlag,
+		utils.RaftWatchedContractsFlag,
+		utils.RaftPrefetchPrivatePayloadsFlag,
+		utils.RaftTargetUtilizationFlag,
+		utils.RaftMaxTxDataSizeFlag,
+		utils.RaftReserveFreeGasFlag,
+		utils.RaftPendingStateIntervalFlag,
+		utils.RaftBlockSinkFlag,
+		utils.RaftExportSyncFlag,
+		utils.RaftVerifyRewardsFlag,
+		utils.RaftSeedSaltFlag,
+		utils.RaftVerifyPrivateParticipationFlag,
+		utils.RaftBlockTimeJitterFlag,
+		utils.RaftMaxTxFailuresFlag,
+		utils.RaftDropContractSendersFlag,
+		utils.RaftEmptyBlockPeriodFlag,
+		utils.RaftMaxSpeculativeBlocksFlag,
+		utils.RaftVerifyReorgRootsFlag,
+		utils.RaftAutoExtendBlockTimeFlag,
+		utils.RaftMaxTxsPerBlockFlag,
+		utils.RaftCompactPendingBlocksFlag,
+		utils.RaftBackpressureDepthFlag,
+		utils.RaftTxsPerSenderTurnFlag,
+		utils.RaftGasLimitFlag,
+		utils.RaftMaxClockDriftFlag,
+		utils.RaftRefuseClockDriftFlag,
+		utils.RaftRequireCoinbaseFlag,
 	}
 	app.Flags = append(app.Flags, debug.Flags...)
 
@@ -34,6 +34,7 @@ import (
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core"
 	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/eth"
 	"github.com/ethereum/go-ethereum/ethdb"
@@ -385,6 +386,170 @@ var (
 		Usage: "Amount of time between raft block creations in milliseconds",
 		Value: 50,
 	}
+	RaftMixHashFlag = cli.StringFlag{
+		Name:  "raftmixhash",
+		Usage: "Hex-encoded mix hash to stamp into raft block headers, for tooling compatibility",
+	}
+	RaftNonceFlag = cli.Uint64Flag{
+		Name:  "raftnonce",
+		Usage: "Nonce to stamp into raft block headers, for tooling compatibility",
+	}
+	RaftMinBlockTimeDeltaFlag = cli.IntFlag{
+		Name:  "raftminblocktimedelta",
+		Usage: "Minimum time between the timestamps of consecutive raft blocks in milliseconds",
+	}
+	RaftAllowedContractsFlag = cli.StringFlag{
+		Name:  "raftallowedcontracts",
+		Usage: "Comma separated list of contract addresses; if set, raft only mints transactions calling these",
+	}
+	RaftAllowContractCreationFlag = cli.BoolFlag{
+		Name:  "raftallowcontractcreation",
+		Usage: "Permit contract creation when --raftallowedcontracts is set",
+	}
+	RaftFatalHeadDivergenceFlag = cli.BoolFlag{
+		Name:  "raftfatalheaddivergence",
+		Usage: "Refuse to start if the chain doesn't contain the last block applied through raft",
+	}
+	RaftBatchFailureAbortsRoundFlag = cli.BoolFlag{
+		Name:  "raftbatchfailureabortsround",
+		Usage: "Abort the whole raft minting round when a submitted transaction batch fails",
+	}
+	RaftDropCollidingCreationsFlag = cli.BoolFlag{
+		Name:  "raftdropcollidingcreations",
+		Usage: "Drop contract creations targeting an address which already holds code",
+	}
+	RaftOnDemandFlag = cli.BoolFlag{
+		Name:  "raftondemand",
+		Usage: "Only mint raft blocks when explicitly requested over RPC",
+	}
+	RaftMaxBlockValueFlag = cli.StringFlag{
+		Name:  "raftmaxblockvalue",
+		Usage: "Maximum total value in wei transferred by the transactions of a raft block",
+	}
+	RaftReceiptCacheFlag = cli.IntFlag{
+		Name:  "raftreceiptcache",
+		Usage: "Number of recently minted raft blocks whose receipts are kept in memory",
+	}
+	RaftTxTimeoutFlag = cli.IntFlag{
+		Name:  "rafttxtimeout",
+		Usage: "Maximum execution time of a single transaction in a raft block in milliseconds (0 = no limit)",
+	}
+	RaftCoinbasesFlag = cli.StringFlag{
+		Name:  "raftcoinbases",
+		Usage: "Comma separated addresses credited as coinbase of raft blocks in turn, by block number",
+	}
+	RaftMaxPrivatePayloadFlag = cli.IntFlag{
+		Name:  "raftmaxprivatepayload",
+		Usage: "Maximum size in bytes of the payload of a private transaction in a raft block (0 = no limit)",
+	}
+	RaftDropOversizedPrivateFlag = cli.BoolFlag{
+		Name:  "raftdropoversizedprivate",
+		Usage: "Drop private transactions with oversized payloads rather than deferring them",
+	}
+	RaftWatchedContractsFlag = cli.StringFlag{
+		Name:  "raftwatchedcontracts",
+		Usage: "Comma separated contract addresses whose usage in raft blocks is metered separately",
+	}
+	RaftPrefetchPrivatePayloadsFlag = cli.BoolFlag{
+		Name:  "raftprefetchprivatepayloads",
+		Usage: "Fetch the payloads of pending private transactions concurrently before minting each raft block",
+	}
+	RaftTargetUtilizationFlag = cli.Float64Flag{
+		Name:  "rafttargetutilization",
+		Usage: "Fraction of the gas limit raft blocks should use on average, adjusting the limit to match (0 = default gas limit rule)",
+	}
+	RaftMaxTxDataSizeFlag = cli.IntFlag{
+		Name:  "raftmaxtxdatasize",
+		Usage: "Maximum size in bytes of the input data of a transaction in a raft block (0 = no limit)",
+	}
+	RaftReserveFreeGasFlag = cli.Uint64Flag{
+		Name:  "raftreservefreegas",
+		Usage: "Amount of gas to leave unused in every raft block",
+	}
+	RaftPendingStateIntervalFlag = cli.IntFlag{
+		Name:  "raftpendingstateinterval",
+		Usage: "Minimum time between pending state events posted by the raft minter in milliseconds (0 = after every block)",
+	}
+	RaftBlockSinkFlag = cli.StringFlag{
+		Name:  "raftblocksink",
+		Usage: "File or named pipe to which every minted raft block is appended, RLP encoded",
+	}
+	RaftExportSyncFlag = cli.BoolFlag{
+		Name:  "raftexportsync",
+		Usage: "Wait for each minted raft block to be written to the block sink before minting the next",
+	}
+	RaftVerifyRewardsFlag = cli.BoolFlag{
+		Name:  "raftverifyrewards",
+		Usage: "Check that crediting the block reward of raft blocks only modifies the coinbase account",
+	}
+	RaftSeedSaltFlag = cli.StringFlag{
+		Name:  "raftseedsalt",
+		Usage: "Salt from which a deterministic per-block seed is derived and stamped into raft block headers as the mix hash, for reproducible simulations",
+	}
+	RaftVerifyPrivateParticipationFlag = cli.BoolFlag{
+		Name:  "raftverifyprivateparticipation",
+		Usage: "Warn when minting a private transaction changes the private state inconsistently with this node being a party to it",
+	}
+	RaftBlockTimeJitterFlag = cli.Float64Flag{
+		Name:  "raftblocktimejitter",
+		Usage: "Fraction by which the raft block time is randomly varied either way, up to 0.5 (0 = no jitter)",
+	}
+	RaftMaxTxFailuresFlag = cli.IntFlag{
+		Name:  "raftmaxtxfailures",
+		Usage: "Number of consecutive raft minting rounds in which a transaction may fail before it's dropped (0 = never drop)",
+	}
+	RaftDropContractSendersFlag = cli.BoolFlag{
+		Name:  "raftdropcontractsenders",
+		Usage: "Drop transactions sent from accounts holding code rather than minting them",
+	}
+	RaftMaxSpeculativeBlocksFlag = cli.IntFlag{
+		Name:  "raftmaxspeculativeblocks",
+		Usage: "Number of minted blocks which may await raft acceptance before minting pauses (0 = default of 1000)",
+	}
+	RaftVerifyReorgRootsFlag = cli.BoolFlag{
+		Name:  "raftverifyreorgroots",
+		Usage: "Re-execute blocks minted after an invalid raft ordering and pause minting if their state roots differ",
+	}
+	RaftAutoExtendBlockTimeFlag = cli.BoolFlag{
+		Name:  "raftautoextendblocktime",
+		Usage: "Extend the raft block time to twice the state commit duration whenever committing takes longer than it",
+	}
+	RaftMaxTxsPerBlockFlag = cli.IntFlag{
+		Name:  "raftmaxtxsperblock",
+		Usage: "Maximum number of transactions per raft block (0 = unlimited)",
+	}
+	RaftCompactPendingBlocksFlag = cli.BoolFlag{
+		Name:  "raftcompactpendingblocks",
+		Usage: "Post a compacted pending block (header and transaction hashes) after each raft minting round",
+	}
+	RaftBackpressureDepthFlag = cli.IntFlag{
+		Name:  "raftbackpressuredepth",
+		Usage: "Number of raft blocks awaiting acceptance from which minting stops reading the transaction pool (0 = always read it)",
+	}
+	RaftTxsPerSenderTurnFlag = cli.IntFlag{
+		Name:  "rafttxspersenderturn",
+		Usage: "Pack pending transactions in turns between senders, taking up to this many from each in turn (0 = order by gas price)",
+	}
+	RaftGasLimitFlag = cli.Uint64Flag{
+		Name:  "raftgaslimit",
+		Usage: "Fixed gas limit which raft blocks move toward as fast as consensus allows (0 = adjust the gas limit as usual)",
+	}
+	RaftMaxClockDriftFlag = cli.IntFlag{
+		Name:  "raftmaxclockdrift",
+		Usage: "Time in milliseconds which raft block timestamps may run ahead of the system clock before a warning is logged (0 = no check)",
+	}
+	RaftRefuseClockDriftFlag = cli.BoolFlag{
+		Name:  "raftrefuseclockdrift",
+		Usage: "Stop minting raft blocks while their timestamps would run further ahead of the system clock than --raftmaxclockdrift",
+	}
+	RaftRequireCoinbaseFlag = cli.BoolFlag{
+		Name:  "raftrequirecoinbase",
+		Usage: "Refuse to mint raft blocks crediting the zero address as coinbase, rather than only warning",
+	}
+	RaftEmptyBlockPeriodFlag = cli.IntFlag{
+		Name:  "raftemptyblockperiod",
+		Usage: "Time in milliseconds after which an empty raft block is minted if no transactions arrived (0 = never mint empty blocks)",
+	}
 )
 
 // MakeDataDir retrieves the currently requested data directory, terminating
@@ -725,6 +890,7 @@ func RegisterEthService(ctx *cli.Context, stack *node.Node, extra []byte) {
 
 	if ctx.GlobalBool(RaftModeFlag.Name) {
 		blockTimeMillis := ctx.GlobalInt(RaftBlockTime.Name)
+		minterConfig := MakeRaftMinterConfig(ctx)
 		datadir := ctx.GlobalString(DataDirFlag.Name)
 
 		logger.DoLogRaft = true
@@ -748,13 +914,98 @@ func RegisterEthService(ctx *cli.Context, stack *node.Node, extra []byte) {
 				log.Panicf("failed to find local enode ID (%v) amongst peer IDs: %v", strId, peerIds)
 			}
 
-			return raft.New(ctx, chainConfig, myId, blockTimeNanos, ethereum, peers, datadir)
+			return raft.New(ctx, chainConfig, myId, blockTimeNanos, minterConfig, ethereum, peers, datadir)
 		}); err != nil {
 			Fatalf("Failed to register the Raft service: %v", err)
 		}
 	}
 }
 
+// MakeRaftMinterConfig creates the raft minter settings from the set command
+// line flags.
+func MakeRaftMinterConfig(ctx *cli.Context) *raft.MinterConfig {
+	config := &raft.MinterConfig{
+		MixDigest: common.HexToHash(ctx.GlobalString(RaftMixHashFlag.Name)),
+		Nonce:     types.EncodeNonce(ctx.GlobalUint64(RaftNonceFlag.Name)),
+
+		MinBlockTimeDelta: time.Duration(ctx.GlobalInt(RaftMinBlockTimeDeltaFlag.Name)) * time.Millisecond,
+
+		AllowContractCreation: ctx.GlobalBool(RaftAllowContractCreationFlag.Name),
+
+		FatalHeadDivergence:     ctx.GlobalBool(RaftFatalHeadDivergenceFlag.Name),
+		BatchFailureAbortsRound: ctx.GlobalBool(RaftBatchFailureAbortsRoundFlag.Name),
+		DropCollidingCreations:  ctx.GlobalBool(RaftDropCollidingCreationsFlag.Name),
+		OnDemand:                ctx.GlobalBool(RaftOnDemandFlag.Name),
+
+		ReceiptCacheSize: ctx.GlobalInt(RaftReceiptCacheFlag.Name),
+		TxTimeout:        time.Duration(ctx.GlobalInt(RaftTxTimeoutFlag.Name)) * time.Millisecond,
+
+		MaxPrivatePayloadSize: ctx.GlobalInt(RaftMaxPrivatePayloadFlag.Name),
+		DropOversizedPrivate:  ctx.GlobalBool(RaftDropOversizedPrivateFlag.Name),
+
+		PrefetchPrivatePayloads: ctx.GlobalBool(RaftPrefetchPrivatePayloadsFlag.Name),
+		TargetUtilization:       ctx.GlobalFloat64(RaftTargetUtilizationFlag.Name),
+		MaxTxDataSize:           ctx.GlobalInt(RaftMaxTxDataSizeFlag.Name),
+		ReserveFreeGas:          ctx.GlobalUint64(RaftReserveFreeGasFlag.Name),
+		PendingStateInterval:    time.Duration(ctx.GlobalInt(RaftPendingStateIntervalFlag.Name)) * time.Millisecond,
+		ExportSync:              ctx.GlobalBool(RaftExportSyncFlag.Name),
+		VerifyRewards:           ctx.GlobalBool(RaftVerifyRewardsFlag.Name),
+
+		VerifyPrivateParticipation: ctx.GlobalBool(RaftVerifyPrivateParticipationFlag.Name),
+		BlockTimeJitter:            ctx.GlobalFloat64(RaftBlockTimeJitterFlag.Name),
+		MaxTxFailures:              ctx.GlobalInt(RaftMaxTxFailuresFlag.Name),
+		DropContractSenders:        ctx.GlobalBool(RaftDropContractSendersFlag.Name),
+		EmptyBlockPeriod:           time.Duration(ctx.GlobalInt(RaftEmptyBlockPeriodFlag.Name)) * time.Millisecond,
+		MaxSpeculativeBlocks:       ctx.GlobalInt(RaftMaxSpeculativeBlocksFlag.Name),
+		VerifyReorgRoots:           ctx.GlobalBool(RaftVerifyReorgRootsFlag.Name),
+		AutoExtendBlockTime:        ctx.GlobalBool(RaftAutoExtendBlockTimeFlag.Name),
+		MaxTxsPerBlock:             ctx.GlobalInt(RaftMaxTxsPerBlockFlag.Name),
+		CompactPendingBlocks:       ctx.GlobalBool(RaftCompactPendingBlocksFlag.Name),
+		BackpressureDepth:          ctx.GlobalInt(RaftBackpressureDepthFlag.Name),
+		TxsPerSenderTurn:           ctx.GlobalInt(RaftTxsPerSenderTurnFlag.Name),
+		GasLimit:                   ctx.GlobalUint64(RaftGasLimitFlag.Name),
+		MaxClockDrift:              time.Duration(ctx.GlobalInt(RaftMaxClockDriftFlag.Name)) * time.Millisecond,
+		RefuseClockDrift:           ctx.GlobalBool(RaftRefuseClockDriftFlag.Name),
+		RequireCoinbase:            ctx.GlobalBool(RaftRequireCoinbaseFlag.Name),
+	}
+	if path := ctx.GlobalString(RaftBlockSinkFlag.Name); path != "" {
+		sink, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			Fatalf("Failed to open block sink %s: %v", path, err)
+		}
+		config.BlockSink = sink
+	}
+	if value := ctx.GlobalString(RaftMaxBlockValueFlag.Name); value != "" {
+		maxValue, ok := new(big.Int).SetString(value, 10)
+		if !ok || maxValue.Sign() < 0 {
+			Fatalf("Invalid value for --%s: %s", RaftMaxBlockValueFlag.Name, value)
+		}
+		config.MaxBlockValue = maxValue
+	}
+	if salt := ctx.GlobalString(RaftSeedSaltFlag.Name); salt != "" {
+		config.SeedSalt = []byte(salt)
+	}
+	config.AllowedContracts = makeAddressList(ctx, RaftAllowedContractsFlag)
+	config.Coinbases = makeAddressList(ctx, RaftCoinbasesFlag)
+	config.WatchedContracts = makeAddressList(ctx, RaftWatchedContractsFlag)
+	return config
+}
+
+// makeAddressList parses a comma separated list of addresses from the given
+// flag, returning nil if it's empty.
+func makeAddressList(ctx *cli.Context, flag cli.StringFlag) []common.Address {
+	var addrs []common.Address
+	for _, addr := range strings.Split(ctx.GlobalString(flag.Name), ",") {
+		if trimmed := strings.TrimSpace(addr); trimmed != "" {
+			if !common.IsHexAddress(trimmed) {
+				Fatalf("Invalid address in --%s: %s", flag.Name, trimmed)
+			}
+			addrs = append(addrs, common.HexToAddress(trimmed))
+		}
+	}
+	return addrs
+}
+
 // RegisterShhService configures whisper and adds it to the given node.
 func RegisterShhService(stack *node.Node) {
 	if err := stack.Register(func(*node.ServiceContext) (node.Service, error) { return whisper.New(), nil }); err != nil {
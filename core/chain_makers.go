@@ -202,7 +202,7 @@ func GenerateChain(config *ChainConfig, parent *types.Block, db ethdb.Database,
 		if gen != nil {
 			gen(i, b)
 		}
-		AccumulateRewards(statedb, h, b.uncles)
+		AccumulateChainRewards(config, statedb, h, b.uncles)
 		root, err := statedb.Commit()
 		if err != nil {
 			panic(fmt.Sprintf("state write error: %v", err))
@@ -40,6 +40,8 @@ type ChainConfig struct {
 	HomesteadGasRepriceBlock *big.Int    `json:"homesteadGasRepriceBlock"` // Homestead gas reprice switch block (nil = no fork)
 	HomesteadGasRepriceHash  common.Hash `json:"homesteadGasRepriceHash"`  // Homestead gas reprice switch block hash (fast sync aid)
 
+	BlockReward *big.Int `json:"blockReward,omitempty"` // Static block reward (nil = default reward, 0 = no rewards)
+
 	VmConfig vm.Config `json:"-"`
 }
 
@@ -51,6 +53,15 @@ func (c *ChainConfig) IsHomestead(num *big.Int) bool {
 	return num.Cmp(c.HomesteadBlock) >= 0
 }
 
+// Reward returns the static block reward credited to the coinbase of every
+// block, which is BlockReward unless configured otherwise.
+func (c *ChainConfig) Reward() *big.Int {
+	if c == nil || c.BlockReward == nil {
+		return BlockReward
+	}
+	return c.BlockReward
+}
+
 // GasTable returns the gas table corresponding to the current phase (homestead or homestead reprice).
 //
 // The returned GasTable's fields shouldn't, under any circumstances, be changed.
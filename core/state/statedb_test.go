@@ -384,3 +384,38 @@ func (test *snapshotTest) checkEqual(state, checkstate *StateDB) error {
 	}
 	return nil
 }
+
+// Tests that changes made to a state after copying it, including changes
+// already flushed to the trie, don't leak into the copy.
+func TestCopyIsolation(t *testing.T) {
+	db, _ := ethdb.NewMemDatabase()
+	state, _ := New(common.Hash{}, db)
+
+	addr := common.BytesToAddress([]byte{0x01})
+	slot := common.BytesToHash([]byte{0x02})
+	state.SetNonce(addr, 1)
+	state.SetState(addr, slot, common.BytesToHash([]byte{0x03}))
+	state.IntermediateRoot()
+
+	cpy := state.Copy()
+	state.SetNonce(addr, 2)
+	state.SetState(addr, slot, common.BytesToHash([]byte{0x04}))
+	state.IntermediateRoot()
+
+	if nonce := cpy.GetNonce(addr); nonce != 1 {
+		t.Errorf("copied nonce mismatch: have %d, want 1", nonce)
+	}
+	if value := cpy.GetState(addr, slot); value != common.BytesToHash([]byte{0x03}) {
+		t.Errorf("copied storage mismatch: have %x, want 03", value)
+	}
+	// Objects which aren't cached are reloaded from the copied trie.
+	fresh := cpy.Copy()
+	fresh.stateObjects = make(map[common.Address]*StateObject)
+	fresh.stateObjectsDirty = make(map[common.Address]struct{})
+	if nonce := fresh.GetNonce(addr); nonce != 1 {
+		t.Errorf("reloaded nonce mismatch: have %d, want 1", nonce)
+	}
+	if root := cpy.IntermediateRoot(); root == state.IntermediateRoot() {
+		t.Errorf("copy has the same root as the modified original")
+	}
+}
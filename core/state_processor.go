@@ -84,7 +84,7 @@ func (p *StateProcessor) Process(block *types.Block, publicState, privateState *
 			allLogs = append(allLogs, privateReceipt.Logs...)
 		}
 	}
-	AccumulateRewards(publicState, header, block.Uncles())
+	AccumulateChainRewards(p.config, publicState, header, block.Uncles())
 
 	return publicReceipts, privateReceipts, allLogs, totalUsedGas, err
 }
@@ -145,16 +145,29 @@ func ApplyTransaction(config *ChainConfig, bc *BlockChain, gp *GasPool, publicSt
 // and rewards for included uncles. The coinbase of each uncle block is
 // also rewarded.
 func AccumulateRewards(statedb *state.StateDB, header *types.Header, uncles []*types.Header) {
-	reward := new(big.Int).Set(BlockReward)
+	accumulateRewards(BlockReward, statedb, header, uncles)
+}
+
+// AccumulateChainRewards is AccumulateRewards with the static block reward
+// configured for the chain. A zero reward disables rewards altogether, leaving
+// the state untouched.
+func AccumulateChainRewards(config *ChainConfig, statedb *state.StateDB, header *types.Header, uncles []*types.Header) {
+	if reward := config.Reward(); reward.Sign() != 0 {
+		accumulateRewards(reward, statedb, header, uncles)
+	}
+}
+
+func accumulateRewards(blockReward *big.Int, statedb *state.StateDB, header *types.Header, uncles []*types.Header) {
+	reward := new(big.Int).Set(blockReward)
 	r := new(big.Int)
 	for _, uncle := range uncles {
 		r.Add(uncle.Number, big8)
 		r.Sub(r, header.Number)
-		r.Mul(r, BlockReward)
+		r.Mul(r, blockReward)
 		r.Div(r, big8)
 		statedb.AddBalance(uncle.Coinbase, r)
 
-		r.Div(BlockReward, big32)
+		r.Div(blockReward, big32)
 		reward.Add(reward, r)
 	}
 	statedb.AddBalance(header.Coinbase, reward)
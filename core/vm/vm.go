@@ -19,6 +19,7 @@ package vm
 import (
 	"fmt"
 	"math/big"
+	"sync/atomic"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
@@ -34,6 +35,9 @@ type Config struct {
 	EnableJit bool
 	ForceJit  bool
 	Tracer    Tracer
+	// Abort, if set, stops execution with AbortedError as soon as the value
+	// it points to becomes non-zero.
+	Abort *int32
 }
 
 // EVM is used to run Ethereum based contracts and will utilise the
@@ -125,6 +129,9 @@ func (evm *EVM) Run(contract *Contract, input []byte) (ret []byte, err error) {
 	}
 
 	for ; ; instrCount++ {
+		if evm.cfg.Abort != nil && atomic.LoadInt32(evm.cfg.Abort) != 0 {
+			return nil, AbortedError
+		}
 		// Get the memory location of pc
 		op = contract.GetOp(pc)
 		if evm.env.ReadOnly() && op.isMutating() {
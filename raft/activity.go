@@ -0,0 +1,72 @@
+package raft
+
+import (
+	"sync"
+	"time"
+)
+
+// Tracks whether the minter is busy or idle, reporting transitions to the
+// OnActivityChange hook. The zero value is idle.
+type activityTracker struct {
+	mu        sync.Mutex // Also orders the hook calls
+	busy      bool
+	stopped   bool
+	lastMint  time.Time
+	idleTimer *time.Timer
+	onChange  func(busy bool) // of the settings the minter last became busy with
+}
+
+// Records that a block has just been minted with the given settings.
+func (tracker *activityTracker) minted(settings *MinterConfig) {
+	if settings.OnActivityChange == nil {
+		return
+	}
+	threshold := settings.IdleThreshold
+	if threshold <= 0 {
+		threshold = defaultIdleThreshold
+	}
+
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	if tracker.stopped {
+		return
+	}
+	tracker.lastMint = time.Now()
+	if !tracker.busy {
+		tracker.busy = true
+		tracker.onChange = settings.OnActivityChange
+		tracker.onChange(true)
+	}
+
+	if tracker.idleTimer == nil {
+		tracker.idleTimer = time.AfterFunc(threshold, func() { tracker.checkIdle(threshold) })
+	} else {
+		tracker.idleTimer.Reset(threshold)
+	}
+}
+
+// Marks the minter idle if it hasn't minted for the threshold. The timer may
+// fire just as a block is minted, hence the check.
+func (tracker *activityTracker) checkIdle(threshold time.Duration) {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	if tracker.stopped || !tracker.busy || time.Since(tracker.lastMint) < threshold {
+		return
+	}
+	tracker.busy = false
+	tracker.onChange(false)
+}
+
+// Stops the idle timer for good. No transitions are reported afterwards, even
+// if the timer was already firing.
+func (tracker *activityTracker) stop() {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	tracker.stopped = true
+	if tracker.idleTimer != nil {
+		tracker.idleTimer.Stop()
+	}
+}
@@ -1,5 +1,16 @@
 package raft
 
+import (
+	"fmt"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rpc"
+	"golang.org/x/net/context"
+)
+
 type PublicRaftAPI struct {
 	raftService *RaftService
 }
@@ -16,3 +27,266 @@ func (s *PublicRaftAPI) Role() string {
 		return "verifier"
 	}
 }
+
+// SimulateNextBlock dry-runs the next round over the pending transactions,
+// reporting those the block would include, the gas it would use, whether it
+// would be full, and the transactions it would leave out, with the reason.
+// Nothing is minted, committed or posted.
+func (s *PublicRaftAPI) SimulateNextBlock() (*BlockEstimate, error) {
+	return s.raftService.minter.estimateNextBlock()
+}
+
+// EstimateNextBlock is an alias of SimulateNextBlock, kept for existing
+// clients.
+//
+// Deprecated: use SimulateNextBlock.
+func (s *PublicRaftAPI) EstimateNextBlock() (*BlockEstimate, error) {
+	return s.SimulateNextBlock()
+}
+
+// MinterStatus reports whether this node is minting, which only the raft
+// leader does, along with the state of its speculative chain.
+func (s *PublicRaftAPI) MinterStatus() *MinterStatus {
+	return s.raftService.minter.status()
+}
+
+// MintingLatency returns percentiles of the time taken to mint each of the last
+// blocks, from its timestamp.
+func (s *PublicRaftAPI) MintingLatency() *MintingLatency {
+	return s.raftService.minter.latencies.percentiles()
+}
+
+// GetCoinbase returns the address credited by the blocks this node mints.
+func (s *PublicRaftAPI) GetCoinbase() common.Address {
+	return s.raftService.minter.getCoinbase()
+}
+
+// Lifetime returns the number of blocks and transactions minted since the
+// node started, along with its uptime.
+func (s *PublicRaftAPI) Lifetime() *MinterLifetime {
+	return s.raftService.minter.lifetime()
+}
+
+// BlockTimings returns the time spent in each phase of minting the given block,
+// if it's one of the last blocks this node minted.
+func (s *PublicRaftAPI) BlockTimings(blockHash common.Hash) (*BlockTimings, error) {
+	if timings, ok := s.raftService.minter.timingsOf(blockHash); ok {
+		return timings, nil
+	}
+	return nil, fmt.Errorf("no timings of block %x", blockHash)
+}
+
+// MinterConfigDiff returns the minter settings which have been changed from
+// their defaults.
+func (s *PublicRaftAPI) MinterConfigDiff() map[string]interface{} {
+	return s.raftService.minter.currentSettings().diff()
+}
+
+// InvalidOrderings returns the most recent invalid raft orderings handled by
+// the minter, oldest first, showing how often speculative blocks are unwound.
+func (s *PublicRaftAPI) InvalidOrderings() []InvalidOrderingInfo {
+	return s.raftService.minter.recentInvalidOrderings()
+}
+
+// InvalidOrdering streams the invalid raft orderings seen from now on, as
+// they reach the minter. Subscribe with raft_subscribe("invalidOrdering").
+func (s *PublicRaftAPI) InvalidOrdering(ctx context.Context) (*rpc.Subscription, error) {
+	notifier, supported := rpc.NotifierFromContext(ctx)
+	if !supported {
+		return &rpc.Subscription{}, rpc.ErrNotificationsUnsupported
+	}
+
+	rpcSub := notifier.CreateSubscription()
+	minter := s.raftService.minter
+	events := minter.mux.Subscribe(InvalidRaftOrdering{})
+
+	go func() {
+		defer events.Unsubscribe()
+
+		for {
+			select {
+			case event, ok := <-events.Chan():
+				if !ok {
+					return
+				}
+				ev := event.Data.(InvalidRaftOrdering)
+				notifier.Notify(rpcSub.ID, minter.describeInvalidOrdering(ev.headBlock, ev.invalidBlock))
+			case <-rpcSub.Err():
+				return
+			case <-notifier.Closed():
+				return
+			}
+		}
+	}()
+
+	return rpcSub, nil
+}
+
+// BlockAccepted streams the blocks minted by this node which raft accepts from
+// now on, which are final. Subscribe with raft_subscribe("blockAccepted").
+func (s *PublicRaftAPI) BlockAccepted(ctx context.Context) (*rpc.Subscription, error) {
+	notifier, supported := rpc.NotifierFromContext(ctx)
+	if !supported {
+		return &rpc.Subscription{}, rpc.ErrNotificationsUnsupported
+	}
+
+	rpcSub := notifier.CreateSubscription()
+	events := s.raftService.minter.mux.Subscribe(BlockAcceptedEvent{})
+
+	go func() {
+		defer events.Unsubscribe()
+
+		for {
+			select {
+			case event, ok := <-events.Chan():
+				if !ok {
+					return
+				}
+				block := event.Data.(BlockAcceptedEvent).Block
+				notifier.Notify(rpcSub.ID, AcceptedBlockInfo{
+					Hash:    block.Hash(),
+					Number:  block.NumberU64(),
+					TxCount: len(block.Transactions()),
+				})
+			case <-rpcSub.Err():
+				return
+			case <-notifier.Closed():
+				return
+			}
+		}
+	}()
+
+	return rpcSub, nil
+}
+
+// FailedTransactions returns the transactions whose execution failed most
+// recently while minting, oldest first, along with the transactions of their
+// senders which were held back as a result.
+func (s *PublicRaftAPI) FailedTransactions() []FailedTxInfo {
+	return s.raftService.minter.failedTransactions()
+}
+
+// MintedReceipts returns the receipts of the given block. Those of blocks this
+// node minted recently are served from memory; otherwise only the public
+// receipts are available, from the database.
+func (s *PublicRaftAPI) MintedReceipts(blockHash common.Hash) (*MintedReceipts, error) {
+	if receipts, ok := s.raftService.minter.cachedReceipts(blockHash); ok {
+		return receipts, nil
+	}
+
+	chainDb := s.raftService.ChainDb()
+	if !s.raftService.BlockChain().HasBlock(blockHash) {
+		return nil, fmt.Errorf("unknown block %x", blockHash)
+	}
+	publicReceipts := core.GetBlockReceipts(chainDb, blockHash, core.GetBlockNumber(chainDb, blockHash))
+	return &MintedReceipts{Public: publicReceipts}, nil
+}
+
+// PrivateRaftAPI changes how this node mints. Unlike PublicRaftAPI, it's only
+// exposed over IPC, or over HTTP and WebSocket if the admin namespace is
+// enabled explicitly.
+type PrivateRaftAPI struct {
+	raftService *RaftService
+}
+
+func NewPrivateRaftAPI(raftService *RaftService) *PrivateRaftAPI {
+	return &PrivateRaftAPI{raftService}
+}
+
+// SetCoinbase changes the address credited by the blocks this node mints,
+// from the next block on. Coinbases rotated through MinterConfig take
+// precedence.
+func (s *PrivateRaftAPI) SetCoinbase(coinbase common.Address) {
+	s.raftService.minter.setCoinbase(coinbase)
+}
+
+// SetBlockTime changes the minimum time between blocks, in milliseconds, without
+// restarting the node.
+func (s *PrivateRaftAPI) SetBlockTime(blockTimeMs int64) error {
+	return s.raftService.minter.setBlockTime(time.Duration(blockTimeMs) * time.Millisecond)
+}
+
+// PauseMinting pauses minting until ResumeMinting is called, reporting whether
+// this node was minting. Unlike losing leadership, which stops minting, pausing
+// keeps the blocks minted ahead of the chain head, so that minting resumes on
+// top of them rather than minting their transactions afresh.
+func (s *PrivateRaftAPI) PauseMinting() bool {
+	return s.raftService.minter.pause()
+}
+
+// ResumeMinting resumes minting after it was paused by PauseMinting, reporting
+// whether it was. Minting halted over a divergence stays halted; see
+// ResumeAfterDivergence.
+func (s *PrivateRaftAPI) ResumeMinting() bool {
+	return s.raftService.minter.resume()
+}
+
+// ResumeAfterDivergence resumes minting after it was halted because a block
+// minted after an unwind didn't re-execute to the same state root, or because
+// a minted block was invalid. It reports whether minting was halted, which the
+// diverged field of the raft status also shows.
+func (s *PrivateRaftAPI) ResumeAfterDivergence() bool {
+	return s.raftService.minter.resumeAfterDivergence()
+}
+
+// ForceMint mints a block from the pending transactions right away, returning
+// its hash.
+func (s *PrivateRaftAPI) ForceMint() (common.Hash, error) {
+	block, err := s.raftService.minter.forceMint()
+	if err != nil {
+		return common.Hash{}, err
+	}
+	return block.Hash(), nil
+}
+
+// DrainPending mints blocks until no pending transactions remain, returning
+// their hashes.
+func (s *PrivateRaftAPI) DrainPending() ([]common.Hash, error) {
+	blocks, err := s.raftService.minter.drainPending()
+	hashes := make([]common.Hash, len(blocks))
+	for i, block := range blocks {
+		hashes[i] = block.Hash()
+	}
+	return hashes, err
+}
+
+// CancelCurrentRound cancels the minting round in progress, if any, so that it
+// doesn't produce a block. It reports whether there was a round to cancel.
+func (s *PrivateRaftAPI) CancelCurrentRound() bool {
+	return s.raftService.minter.cancelCurrentRound()
+}
+
+// SubmitBatch mints the given transactions together, in the given order, in
+// the next block, bypassing the transaction pool. It returns once the batch
+// has been minted, or with an error if it couldn't be.
+func (s *PrivateRaftAPI) SubmitBatch(txes types.Transactions) error {
+	return s.raftService.minter.submitBatch(txes)
+}
+
+// SubmitBundle queues the given transactions to be minted atomically and
+// consecutively, in the given order, ahead of the pool transactions of the
+// next block. It returns right away; a bundle which fails isn't minted at all.
+func (s *PrivateRaftAPI) SubmitBundle(txes types.Transactions) error {
+	return s.raftService.minter.submitBundle(txes)
+}
+
+// FlushState syncs the database to disk, for example ahead of a planned
+// shutdown, once the state of the latest minted block was written to it, and
+// returns its root. Minting already writes the state of each block to the
+// database; this makes sure the writes aren't only in the OS's buffers.
+func (s *PrivateRaftAPI) FlushState() (common.Hash, error) {
+	return s.raftService.minter.flushState()
+}
+
+// ReconfigureMinter changes the given minter settings, leaving the others as
+// they are, and returns the settings which differ from their defaults. The
+// changes take effect together, from the next round on; a round never mints
+// with some of them applied and others not.
+func (s *PrivateRaftAPI) ReconfigureMinter(update MinterConfigUpdate) (map[string]interface{}, error) {
+	if err := update.validate(); err != nil {
+		return nil, err
+	}
+	minter := s.raftService.minter
+	minter.reconfigure(update.apply)
+	return minter.currentSettings().diff(), nil
+}
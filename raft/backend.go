@@ -7,6 +7,8 @@ import (
 	"github.com/ethereum/go-ethereum/accounts"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/eth"
 	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/event"
@@ -40,7 +42,7 @@ type RaftNodeInfo struct {
 	Role        string      `json:"role"`
 }
 
-func New(ctx *node.ServiceContext, chainConfig *core.ChainConfig, id int, blockTime time.Duration, e *eth.Ethereum, startPeers []*discover.Node, datadir string) (*RaftService, error) {
+func New(ctx *node.ServiceContext, chainConfig *core.ChainConfig, id int, blockTime time.Duration, minterConfig *MinterConfig, e *eth.Ethereum, startPeers []*discover.Node, datadir string) (*RaftService, error) {
 	service := &RaftService{
 		eventMux:       ctx.EventMux,
 		chainDb:        e.ChainDb(),
@@ -50,9 +52,10 @@ func New(ctx *node.ServiceContext, chainConfig *core.ChainConfig, id int, blockT
 		startPeers:     startPeers,
 	}
 
-	service.minter = newMinter(chainConfig, service, blockTime)
-
 	var err error
+	if service.minter, err = newMinter(chainConfig, service, blockTime, minterConfig); err != nil {
+		return nil, err
+	}
 	if service.raftProtocolManager, err = NewProtocolManager(id, service.blockchain, service.eventMux, startPeers, datadir, service.minter); err != nil {
 		return nil, err
 	}
@@ -69,6 +72,13 @@ func (service *RaftService) DappDb() ethdb.Database            { return nil }
 func (service *RaftService) EventMux() *event.TypeMux          { return service.eventMux }
 func (service *RaftService) TxPool() *core.TxPool              { return service.txPool }
 
+// PendingState returns the latest block minted by this node, which may not be
+// in the chain yet, along with copies of its public and private state, for
+// executing calls against pending state.
+func (service *RaftService) PendingState() (*types.Block, *state.StateDB, *state.StateDB, error) {
+	return service.minter.pendingState()
+}
+
 // node.Service interface methods:
 
 func (service *RaftService) Protocols() []p2p.Protocol { return []p2p.Protocol{} }
@@ -79,6 +89,10 @@ func (service *RaftService) APIs() []rpc.API {
 			Version:   "1.0",
 			Service:   NewPublicRaftAPI(service),
 			Public:    true,
+		}, {
+			Namespace: "admin",
+			Version:   "1.0",
+			Service:   NewPrivateRaftAPI(service),
 		},
 	}
 }
@@ -0,0 +1,202 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+)
+
+var (
+	errNotMinting     = errors.New("node is not minting")
+	errMintingStopped = errors.New("minting stopped before the batch was minted")
+	errEmptyBatch     = errors.New("batch contains no transactions")
+	errBatchTimeout   = errors.New("timed out waiting for the batch to be minted")
+)
+
+// How long SubmitBatch waits for its batch to be minted
+const batchTimeout = 30 * time.Second
+
+// A pre-ordered list of transactions that must be minted together, in order,
+// in a single block. The outcome is reported on errC.
+type txBatch struct {
+	txes types.Transactions
+	errC chan error
+}
+
+func resolveBatches(batches []*txBatch, err error) {
+	for _, batch := range batches {
+		batch.errC <- err
+	}
+}
+
+// Checks that a batch is non-empty, with valid senders and no duplicates.
+func validateBatch(txes types.Transactions) error {
+	if len(txes) == 0 {
+		return errEmptyBatch
+	}
+	seen := make(map[common.Hash]bool, len(txes))
+	for i, tx := range txes {
+		if _, err := tx.From(); err != nil {
+			return fmt.Errorf("invalid sender for transaction %d (%x): %v", i, tx.Hash(), err)
+		}
+		if seen[tx.Hash()] {
+			return fmt.Errorf("duplicate transaction %d (%x)", i, tx.Hash())
+		}
+		seen[tx.Hash()] = true
+	}
+	return nil
+}
+
+// Validates a batch and queues it for the next minting round, bypassing the
+// transaction pool. Blocks until the batch has either been minted or failed.
+func (minter *minter) submitBatch(txes types.Transactions) error {
+	if err := validateBatch(txes); err != nil {
+		return err
+	}
+
+	batch := &txBatch{txes: txes, errC: make(chan error, 1)}
+
+	minter.mu.Lock()
+	if atomic.LoadInt32(&minter.minting) == 0 {
+		minter.mu.Unlock()
+		return errNotMinting
+	}
+	minter.batches = append(minter.batches, batch)
+	minter.mu.Unlock()
+
+	minter.requestMinting()
+
+	select {
+	case err := <-batch.errC:
+		return err
+	case <-time.After(batchTimeout):
+	}
+
+	// The batch may have been picked up by a round in the meantime.
+	minter.mu.Lock()
+	defer minter.mu.Unlock()
+	for i, queued := range minter.batches {
+		if queued == batch {
+			minter.batches = append(minter.batches[:i], minter.batches[i+1:]...)
+			return errBatchTimeout
+		}
+	}
+	return <-batch.errC
+}
+
+// Commits the given batches ahead of any pool transactions. Each batch is
+// committed atomically: if any of its transactions fails, the whole batch is
+// reverted. Depending on the settings, this then either fails the batch alone
+// or aborts the round, in which case an error is returned. The batches that
+// were committed are returned so their submitters can be notified once the
+// block has been minted, along with those deferred to the next round, in
+// order, once one didn't fit the transaction cap.
+func (env *work) commitBatches(batches []*txBatch, bc *core.BlockChain) ([]*txBatch, []*txBatch, types.Transactions, types.Receipts, types.Receipts, vm.Logs, error) {
+	var (
+		committed       []*txBatch
+		committedTxes   types.Transactions
+		publicReceipts  types.Receipts
+		privateReceipts types.Receipts
+		logs            vm.Logs
+	)
+
+	defer env.holdReserve()()
+	for i, batch := range batches {
+		if max := env.settings.MaxTxsPerBlock; max > 0 && len(batch.txes) > max {
+			// It could never fit.
+			batch.errC <- fmt.Errorf("batch of %d transactions exceeds the cap of %d per block", len(batch.txes), max)
+			continue
+		}
+		if env.exceedsTxCap(len(batch.txes)) {
+			env.capped = true
+			return committed, batches[i:], committedTxes, publicReceipts, privateReceipts, logs, nil
+		}
+
+		batchPublicReceipts, batchPrivateReceipts, batchLogs, err := env.commitBatch(batch.txes, bc)
+		if err != nil {
+			batch.errC <- err
+
+			if env.settings.BatchFailureAbortsRound {
+				err = fmt.Errorf("aborted minting round: %v", err)
+				resolveBatches(committed, err)
+				resolveBatches(batches[i+1:], err)
+				return nil, nil, nil, nil, nil, nil, err
+			}
+			continue
+		}
+
+		committed = append(committed, batch)
+		committedTxes = append(committedTxes, batch.txes...)
+		publicReceipts = append(publicReceipts, batchPublicReceipts...)
+		privateReceipts = append(privateReceipts, batchPrivateReceipts...)
+		logs = append(logs, batchLogs...)
+	}
+
+	return committed, nil, committedTxes, publicReceipts, privateReceipts, logs, nil
+}
+
+func (env *work) commitBatch(txes types.Transactions, bc *core.BlockChain) (types.Receipts, types.Receipts, vm.Logs, error) {
+	var (
+		publicReceipts  types.Receipts
+		privateReceipts types.Receipts
+		logs            vm.Logs
+	)
+
+	// State snapshots can't be reverted across transactions, so checkpoint
+	// the batch with copies instead.
+	publicState := env.publicState.Copy()
+	privateState := env.privateState.Copy()
+	gasAvailable := new(big.Int).Set((*big.Int)(env.gasPool))
+	gasUsed := new(big.Int).Set(env.header.GasUsed)
+	gasPrices := env.gasPrices
+	transferred := new(big.Int).Set(env.transferred)
+	txCount := env.txCount
+	contractUsage := copyContractUsage(env.contractUsage)
+
+	rollback := func(err error) (types.Receipts, types.Receipts, vm.Logs, error) {
+		env.publicState = publicState
+		env.privateState = privateState
+		env.gasPool = (*core.GasPool)(gasAvailable)
+		env.header.GasUsed = gasUsed
+		env.gasPrices = gasPrices
+		env.transferred = transferred
+		env.txCount = txCount
+		env.contractUsage = contractUsage
+
+		return nil, nil, nil, err
+	}
+
+	if env.exceedsTxCap(len(txes)) {
+		return nil, nil, nil, errTxCapReached
+	}
+	for i, tx := range txes {
+		if _, err := env.checkTransaction(tx); err != nil {
+			return rollback(fmt.Errorf("transaction %d (%x) of batch is rejected: %v", i, tx.Hash(), err))
+		}
+
+		env.publicState.StartRecord(tx.Hash(), common.Hash{}, 0)
+
+		publicReceipt, privateReceipt, err := env.commitTransaction(tx, bc, env.gasPool)
+		if err != nil {
+			return rollback(fmt.Errorf("transaction %d (%x) of batch failed: %v", i, tx.Hash(), err))
+		}
+
+		env.account(tx, publicReceipt)
+		logs = append(logs, publicReceipt.Logs...)
+		publicReceipts = append(publicReceipts, publicReceipt)
+
+		if privateReceipt != nil {
+			logs = append(logs, privateReceipt.Logs...)
+			privateReceipts = append(privateReceipts, privateReceipt)
+		}
+	}
+
+	return publicReceipts, privateReceipts, logs, nil
+}
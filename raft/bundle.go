@@ -0,0 +1,82 @@
+package raft
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+)
+
+// Queues a bundle of transactions to be minted atomically, consecutively and
+// in order, ahead of the pool transactions of the next round. Unlike batches,
+// bundles don't block their submitter: a bundle that fails is discarded, and
+// reported in the round summary.
+func (minter *minter) submitBundle(txes types.Transactions) error {
+	if err := validateBatch(txes); err != nil {
+		return err
+	}
+
+	minter.mu.Lock()
+	if atomic.LoadInt32(&minter.minting) == 0 {
+		minter.mu.Unlock()
+		return errNotMinting
+	}
+	minter.bundles = append(minter.bundles, txes)
+	minter.mu.Unlock()
+
+	minter.requestMinting()
+	return nil
+}
+
+// Commits the bundles of the round, each atomically as for batches, so their
+// transactions get the same checks as pool ones. They're committed while the
+// reserved gas is held back for the pool. The transactions of failed bundles
+// are recorded as skipped. Once a bundle
+// doesn't fit the transaction cap, it's left in env.bundles for the next
+// round along with those after it.
+func (env *work) commitBundles(bc *core.BlockChain) (types.Transactions, types.Receipts, types.Receipts, vm.Logs) {
+	var (
+		committedTxes   types.Transactions
+		publicReceipts  types.Receipts
+		privateReceipts types.Receipts
+		logs            vm.Logs
+	)
+
+	bundles := env.bundles
+	env.bundles = nil
+	for i, bundle := range bundles {
+		if env.round.isCancelled() {
+			break
+		}
+		if max := env.settings.MaxTxsPerBlock; max > 0 && len(bundle) > max {
+			err := fmt.Errorf("bundle of %d transactions exceeds the cap of %d per block", len(bundle), max)
+			for _, tx := range bundle {
+				env.skip(tx, err, false)
+			}
+			continue
+		}
+		if env.exceedsTxCap(len(bundle)) {
+			env.capped = true
+			env.bundles = bundles[i:]
+			break
+		}
+
+		bundlePublicReceipts, bundlePrivateReceipts, bundleLogs, err := env.commitBatch(bundle, bc)
+		if err != nil {
+			err = fmt.Errorf("bundle failed: %v", err)
+			for _, tx := range bundle {
+				env.skip(tx, err, false)
+			}
+			continue
+		}
+
+		committedTxes = append(committedTxes, bundle...)
+		publicReceipts = append(publicReceipts, bundlePublicReceipts...)
+		privateReceipts = append(privateReceipts, bundlePrivateReceipts...)
+		logs = append(logs, bundleLogs...)
+	}
+
+	return committedTxes, publicReceipts, privateReceipts, logs
+}
@@ -0,0 +1,492 @@
+package raft
+
+import (
+	"io"
+	"math/big"
+	"reflect"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/params"
+	gometrics "github.com/rcrowley/go-metrics"
+)
+
+// MinterConfig holds the optional settings of the raft minter. The zero value
+// reproduces the default minting behaviour.
+type MinterConfig struct {
+	// Raft blocks carry no proof of work, so these are zero by default. Some
+	// tooling expects them to be populated, in which case they're stamped
+	// verbatim into every minted header.
+	MixDigest common.Hash
+	Nonce     types.BlockNonce
+
+	// When set, the mix digest of each block is instead a seed derived from
+	// its number and this salt, so that simulations deriving randomness from
+	// block data are reproducible.
+	SeedSalt []byte
+
+	// Source of block timestamps, which is the system clock by default. A fake
+	// clock makes minted blocks reproducible. Timestamps still increase
+	// strictly from block to block, whatever the clock says.
+	Clock Clock
+
+	// Minimum difference between the timestamps of a block and its parent,
+	// regardless of wall-clock time.
+	MinBlockTimeDelta time.Duration
+
+	// While the clock is behind the parent block, e.g. after a bad NTP step,
+	// timestamps run ahead of it by barely advancing from block to block. A
+	// warning is logged when a timestamp is more than MaxClockDrift ahead of
+	// the clock; if RefuseClockDrift is also set, nothing is minted until the
+	// clock catches up instead. Zero disables the check.
+	MaxClockDrift    time.Duration
+	RefuseClockDrift bool
+
+	// Optional external health check. While it returns an error minting is
+	// paused; it is polled every HealthCheckInterval so that minting resumes
+	// on its own once the check passes again.
+	HealthCheck         func() error
+	HealthCheckInterval time.Duration
+
+	// When non-empty, only transactions calling one of these addresses are
+	// minted. Contract creations have no target, so they're only minted if
+	// AllowContractCreation is also set.
+	AllowedContracts      []common.Address
+	AllowContractCreation bool
+
+	// On startup, the chain should contain the last block applied from the
+	// raft log. If it doesn't the divergence is logged as an error; if this is
+	// set, the node refuses to start instead.
+	FatalHeadDivergence bool
+
+	// Batches submitted through SubmitBatch are always minted atomically. By
+	// default a failing batch is dropped and the round carries on without it;
+	// if this is set, the whole round is aborted instead.
+	BatchFailureAbortsRound bool
+
+	// Drop contract creations whose target address already holds code, since
+	// they can never succeed, rather than re-executing them every round.
+	DropCollidingCreations bool
+
+	// In on-demand mode new transactions and chain heads don't trigger
+	// minting; blocks are only minted when explicitly requested through
+	// ForceMint or DrainPending (or by submitted batches).
+	OnDemand bool
+
+	// Caps the total value transferred by the transactions of a block. Once
+	// the cap would be exceeded, further value transfers are deferred to later
+	// blocks. Nil means no cap.
+	MaxBlockValue *big.Int
+
+	// Optional congestion pricing hook. Before each round it's passed the
+	// average fullness (gas used over gas limit, from 0 to 1) of the last
+	// FullnessWindow rounds, where rounds minting nothing count as empty, and
+	// returns the minimum gas price of the transactions to include.
+	GasPriceFloor  func(fullness float64) *big.Int
+	FullnessWindow int
+
+	// Number of recently minted blocks whose receipts are kept in memory, so
+	// they can be queried before reaching the database. Zero disables this.
+	ReceiptCacheSize int
+
+	// Maximum wall-clock time spent executing a single transaction. One that
+	// takes longer is skipped, without its effects. Zero means no limit.
+	TxTimeout time.Duration
+
+	// When non-empty, minted blocks take turns crediting these addresses as
+	// their coinbase, by block number, instead of the minter's own.
+	Coinbases []common.Address
+
+	// Refuse to start minting while blocks would credit the zero address,
+	// burning their rewards, rather than only warning about it.
+	RequireCoinbase bool
+
+	// Private transactions whose payload is larger than this many bytes are
+	// deferred, or dropped if DropOversizedPrivate is set, without being
+	// executed. Zero means no limit.
+	MaxPrivatePayloadSize int
+	DropOversizedPrivate  bool
+
+	// Contracts whose usage (gas used and number of calls) in minted blocks
+	// is metered separately.
+	WatchedContracts []common.Address
+
+	// Registry which the minting metrics and the meters of watched contracts
+	// are registered in, instead of the global one. It's only read when the
+	// minter is created.
+	MetricsRegistry gometrics.Registry
+
+	// Fetch the payloads of all pending private transactions concurrently at
+	// the start of each round, instead of one by one during execution.
+	PrefetchPrivatePayloads bool
+
+	// When set, the gas limit of each block is moved toward this fixed value,
+	// as fast as consensus allows, instead of following the default rule. It
+	// mustn't be below the protocol minimum, and takes precedence over
+	// TargetUtilization.
+	GasLimit uint64
+
+	// When set (between 0 and 1), the gas limit of each block is moved toward
+	// the limit at which the average fullness of the last FullnessWindow
+	// rounds would meet this target, instead of following the default rule.
+	// The limit still changes by no more than consensus allows per block, and
+	// never drops below the minimum.
+	TargetUtilization float64
+
+	// Transactions with more than this many bytes of input data are dropped
+	// without being executed. Zero means no limit.
+	MaxTxDataSize int
+
+	// Maximum number of transactions per block, beyond which the remaining
+	// transactions are left for the next block, which is then minted right
+	// away. Bundles aren't split to honour it. Zero means no limit.
+	MaxTxsPerBlock int
+
+	// If set, pending transactions are packed in turns rather than by price:
+	// each sender in turn contributes up to this many, in nonce order, so that
+	// a single busy sender can't crowd the others out of a block.
+	TxsPerSenderTurn int
+
+	// Optional policy ordering the pending transactions of each round, such
+	// as a FIFOSelector. It takes precedence over TxsPerSenderTurn; by default
+	// transactions are ordered by price and nonce.
+	TxSelector TxSelector
+
+	// Amount of gas left unused in every block. Transactions are packed only
+	// as long as this much gas remains available.
+	ReserveFreeGas uint64
+
+	// Minimum time between PendingStateEvents. Rounds minted in between are
+	// collapsed into a single event, posted once the interval has elapsed.
+	// Zero posts an event after every round.
+	PendingStateInterval time.Duration
+
+	// Whether to post a CompactPendingBlockEvent along with the pending events
+	// of each round, for subscribers that only need to know what's pending.
+	CompactPendingBlocks bool
+
+	// Number of rounds whose pending events (PendingLogsEvent and
+	// PendingStateEvent) may await posting, one round at a time, in the
+	// background. Beyond this, as when subscribers are slow, the events of
+	// further rounds are left out. Zero means the default of 64. Only the
+	// setting at startup is taken into account.
+	MaxPendingEventPosts int
+
+	// Optional sink to which every minted block is written, RLP encoded, for
+	// external archival. Writes happen in the background unless ExportSync is
+	// set, in which case minting waits for each. Failed writes are logged and
+	// otherwise ignored.
+	BlockSink  io.Writer
+	ExportSync bool
+
+	// Check that crediting the block reward only modifies the coinbase account,
+	// at the cost of hashing the public state an extra time per block. Any
+	// other modification is logged as an error.
+	VerifyRewards bool
+
+	// Warn about private transactions which didn't update the private state
+	// although this node is a party to them, or did although it isn't, which
+	// points to misconfigured participant lists in the transaction manager.
+	VerifyPrivateParticipation bool
+
+	// Fraction by which the time between blocks is randomly varied either way
+	// (at most 0.5), so that chains sharing infrastructure don't all mint at
+	// once. The block time remains the average.
+	BlockTimeJitter float64
+
+	// Drop transactions from the pool once their execution has failed in this
+	// many consecutive rounds, while their sender's state stayed the same.
+	// Zero means failing transactions are retried indefinitely.
+	MaxTxFailures int
+
+	// Drop transactions whose sender holds code, which only an externally
+	// owned account should be able to sign. If ContractSenderHandler is set,
+	// it decides instead: transactions for which it returns an error are
+	// dropped with that error, and the others are minted.
+	DropContractSenders   bool
+	ContractSenderHandler func(*types.Transaction) error
+
+	// Optional inclusion policy over the public state. It's passed each
+	// transaction along with the public state it would be applied to, which it
+	// must not modify, and transactions for which it returns false are left
+	// out of the block, along with the later transactions of their sender.
+	TxStatePredicate func(tx *types.Transaction, publicState *state.StateDB) bool
+
+	// Optional hook transforming the pending transactions of each round, given
+	// in the default order, into those to pack, in order. It may reorder,
+	// filter or add transactions, but the transactions of each sender must
+	// remain in nonce order, without gaps: once one of them can't be minted,
+	// the rest of that sender's transactions are skipped.
+	TxTransform func(types.Transactions) types.Transactions
+
+	// Optional hook called at the start of each minting round, before any
+	// transaction is committed, to add system transactions to the block, e.g.
+	// a TimestampBeacon, or to decorate its header. These go ahead of batches,
+	// bundles and pool transactions.
+	WorkDecorator func(*PendingWork)
+
+	// After an invalid ordering unwinds minted blocks, re-execute each block
+	// minted in their place on its parent state before proposing it. If the
+	// state roots differ, execution isn't deterministic and peers would reject
+	// the block, so minting halts until resumed through ResumeAfterDivergence.
+	VerifyReorgRoots bool
+
+	// When committing the state of a block takes longer than the block time,
+	// minting can't keep up, which is always logged. If this is set, the block
+	// time is also extended to twice the commit duration.
+	AutoExtendBlockTime bool
+
+	// Number of minted blocks which may await acceptance by raft. Once the
+	// speculative chain is this long, minting pauses until raft catches up.
+	// Zero means the default of 1000.
+	MaxSpeculativeBlocks int
+
+	// Length of the speculative chain from which rounds leave the pool be,
+	// since reading its pending transactions is costly when it's large, until
+	// raft catches up. Submitted batches and bundles are still minted. Zero
+	// means rounds always read the pool.
+	BackpressureDepth int
+
+	// When set, an empty block is minted whenever this long has passed since
+	// the last block, so that the chain keeps advancing while idle. By default
+	// blocks are only minted for transactions.
+	EmptyBlockPeriod time.Duration
+
+	// When set, blocks are minted in lockstep with this channel instead of on
+	// demand: each value received triggers one round, which mints at most one
+	// block. Only the setting at startup is taken into account.
+	Trigger <-chan struct{}
+
+	// Optional hook called when the minter becomes busy, on minting a block
+	// after having been idle, and idle, once no block has been minted for
+	// IdleThreshold (ten seconds by default). Transitions are reported in
+	// order, and the hook must return quickly.
+	OnActivityChange func(busy bool)
+	IdleThreshold    time.Duration
+
+	// Optional hook called when a round runs out of gas, with the number of
+	// transactions deferred because they didn't fit (counting one per
+	// account, as for skipped transactions). It's called while minting, so
+	// it must return quickly.
+	OnBlockFull func(deferred int)
+
+	// Optional tracer recording a span for each phase of minting a block:
+	// "createWork", "getTransactions", "commitTransactions" and "commitState".
+	Tracer Tracer
+
+	// Credits the block reward, core.AccumulateChainRewards unless replaced
+	// in tests.
+	accumulateRewards func(*core.ChainConfig, *state.StateDB, *types.Header, []*types.Header)
+}
+
+// Clock is a source of the current time.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// Tracer records spans, which measure their duration from StartSpan until
+// Finish is called.
+type Tracer interface {
+	StartSpan(name string) Span
+}
+
+// Span is a phase of minting traced by a Tracer.
+type Span interface {
+	SetAttribute(key string, value interface{})
+	Finish()
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(string, interface{}) {}
+func (noopSpan) Finish()                          {}
+
+// Starts a span with the configured tracer, if any.
+func (config *MinterConfig) startSpan(name string) Span {
+	if config.Tracer == nil {
+		return noopSpan{}
+	}
+	return config.Tracer.StartSpan(name)
+}
+
+// Returns the configured clock, or the system clock.
+func (config *MinterConfig) clock() Clock {
+	if config.Clock == nil {
+		return systemClock{}
+	}
+	return config.Clock
+}
+
+// Returns the configured metrics registry, or the global one.
+func (config *MinterConfig) metricsRegistry() gometrics.Registry {
+	if config.MetricsRegistry == nil {
+		return gometrics.DefaultRegistry
+	}
+	return config.MetricsRegistry
+}
+
+// Returns the function crediting block rewards.
+func (config *MinterConfig) rewardAccumulator() func(*core.ChainConfig, *state.StateDB, *types.Header, []*types.Header) {
+	if config.accumulateRewards == nil {
+		return core.AccumulateChainRewards
+	}
+	return config.accumulateRewards
+}
+
+// Returns the configured transaction selection policy, or the default one.
+func (config *MinterConfig) txSelector() TxSelector {
+	switch {
+	case config.TxSelector != nil:
+		return config.TxSelector
+	case config.TxsPerSenderTurn > 0:
+		return senderTurnsSelector(config.TxsPerSenderTurn)
+	default:
+		return PriceAndNonceSelector{}
+	}
+}
+
+// Returns the coinbase of the block with the given number, or the fallback if
+// no rotation is configured.
+func (config *MinterConfig) coinbaseAt(number *big.Int, fallback common.Address) common.Address {
+	if len(config.Coinbases) == 0 {
+		return fallback
+	}
+	i := new(big.Int).Mod(number, big.NewInt(int64(len(config.Coinbases))))
+	return config.Coinbases[i.Int64()]
+}
+
+// Reports whether some block would credit the zero address, given the
+// minter's own coinbase.
+func (config *MinterConfig) creditsZeroAddress(coinbase common.Address) bool {
+	if len(config.Coinbases) == 0 {
+		return coinbase == (common.Address{})
+	}
+	for _, coinbase := range config.Coinbases {
+		if coinbase == (common.Address{}) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the maximum length of the speculative chain.
+func (config *MinterConfig) maxSpeculativeBlocks() int {
+	if config.MaxSpeculativeBlocks <= 0 {
+		return defaultMaxSpeculativeBlocks
+	}
+	return config.MaxSpeculativeBlocks
+}
+
+// Returns the mix digest of the block with the given number.
+func (config *MinterConfig) mixDigestAt(number *big.Int) common.Hash {
+	if len(config.SeedSalt) == 0 {
+		return config.MixDigest
+	}
+	return crypto.Keccak256Hash(config.SeedSalt, common.LeftPadBytes(number.Bytes(), 32))
+}
+
+// Reports whether the contract allowlist permits a transaction to the given
+// target, with nil denoting contract creation.
+func (config *MinterConfig) allowsTarget(to *common.Address) bool {
+	if len(config.AllowedContracts) == 0 {
+		return true
+	}
+	if to == nil {
+		return config.AllowContractCreation
+	}
+	for _, addr := range config.AllowedContracts {
+		if addr == *to {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether the given transaction target is a watched contract.
+func (config *MinterConfig) watches(to *common.Address) bool {
+	if to == nil {
+		return false
+	}
+	for _, addr := range config.WatchedContracts {
+		if addr == *to {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the settings which differ from their defaults, by field name. Hooks,
+// sinks and channels can't be serialised, so those which are set are reported
+// as true.
+func (config *MinterConfig) diff() map[string]interface{} {
+	diff := make(map[string]interface{})
+
+	value := reflect.ValueOf(config).Elem()
+	defaults := reflect.ValueOf(MinterConfig{})
+	for i := 0; i < value.NumField(); i++ {
+		if value.Type().Field(i).PkgPath != "" {
+			continue // unexported, hence not a setting
+		}
+		field := value.Field(i)
+		switch field.Kind() {
+		case reflect.Func, reflect.Interface, reflect.Chan:
+			if !field.IsNil() {
+				diff[value.Type().Field(i).Name] = true
+			}
+			continue
+		}
+		if !reflect.DeepEqual(field.Interface(), defaults.Field(i).Interface()) {
+			diff[value.Type().Field(i).Name] = field.Interface()
+		}
+	}
+	return diff
+}
+
+// MinterConfigUpdate holds the settings to change when reconfiguring a running
+// minter over RPC. Those left nil keep their current values.
+type MinterConfigUpdate struct {
+	GasLimit              *uint64           `json:"gasLimit"`
+	MaxTxsPerBlock        *int              `json:"maxTxsPerBlock"`
+	MaxTxDataSize         *int              `json:"maxTxDataSize"`
+	MaxBlockValue         *big.Int          `json:"maxBlockValue"`
+	AllowedContracts      *[]common.Address `json:"allowedContracts"`
+	AllowContractCreation *bool             `json:"allowContractCreation"`
+}
+
+// Checks the update against the same rules as a new minter's settings.
+func (update *MinterConfigUpdate) validate() error {
+	if gasLimit := update.GasLimit; gasLimit != nil && *gasLimit != 0 && new(big.Int).SetUint64(*gasLimit).Cmp(params.MinGasLimit) < 0 {
+		return errGasLimitTooLow
+	}
+	return nil
+}
+
+// Applies the update to the given settings.
+func (update *MinterConfigUpdate) apply(config *MinterConfig) {
+	if update.GasLimit != nil {
+		config.GasLimit = *update.GasLimit
+	}
+	if update.MaxTxsPerBlock != nil {
+		config.MaxTxsPerBlock = *update.MaxTxsPerBlock
+	}
+	if update.MaxTxDataSize != nil {
+		config.MaxTxDataSize = *update.MaxTxDataSize
+	}
+	if update.MaxBlockValue != nil {
+		config.MaxBlockValue = update.MaxBlockValue
+	}
+	if update.AllowedContracts != nil {
+		config.AllowedContracts = *update.AllowedContracts
+	}
+	if update.AllowContractCreation != nil {
+		config.AllowContractCreation = *update.AllowContractCreation
+	}
+}
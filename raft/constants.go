@@ -1,6 +1,8 @@
 package raft
 
 import (
+	"time"
+
 	etcdRaft "github.com/coreos/etcd/raft"
 )
 
@@ -26,8 +28,56 @@ const (
 	snapshotPeriod = 250
 
 	peerUrlKeyPrefix = "peerUrl-"
+
+	// How often the minter polls its health check, unless configured otherwise
+	defaultHealthCheckInterval = time.Second
+
+	// Number of recent rounds whose fullness is averaged for the gas price
+	// floor, unless configured otherwise
+	defaultFullnessWindow = 10
+
+	// Maximum number of private payloads fetched at once when prefetching
+	maxPayloadPrefetches = 16
+
+	// Number of recent invalid orderings the minter remembers
+	invalidOrderingHistorySize = 64
+
+	// Number of recent transaction failures the minter remembers
+	failedTxHistorySize = 128
+
+	// Number of minted blocks which may await asynchronous export
+	maxPendingExports = 256
+
+	// Number of rounds whose pending events may await posting, unless
+	// configured otherwise
+	defaultMaxPendingEventPosts = 64
+
+	// Largest fraction by which the block time may be jittered, so that it
+	// never drops below half the configured value
+	maxBlockTimeJitter = 0.5
+
+	// Number of recently minted blocks whose phase timings are kept
+	blockTimingsCacheSize = 256
+
+	// Number of recently minted blocks over which minting latency percentiles
+	// are reported
+	latencyWindowSize = 1000
+
+	// How long the minter may go without minting before it's considered
+	// idle, unless configured otherwise
+	defaultIdleThreshold = 10 * time.Second
+
+	// Number of minted blocks which may await acceptance by raft before
+	// minting pauses, unless configured otherwise
+	defaultMaxSpeculativeBlocks = 1000
 )
 
 var (
 	appliedDbKey = []byte("applied")
+
+	// Records the state root of the head at the last FlushState
+	flushedStateDbKey = []byte("raft-flushed-state")
+
+	// Records this node's minting contribution, so that it survives restarts
+	mintRecordDbKey = []byte("raft-mint-record")
 )
@@ -0,0 +1,84 @@
+package raft
+
+import (
+	"crypto/ecdsa"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/logger"
+	"github.com/ethereum/go-ethereum/logger/glog"
+)
+
+// PendingWork is the block of a minting round as it's being built, as seen by
+// a WorkDecorator before any other transaction is committed.
+type PendingWork struct {
+	env *work
+	bc  *core.BlockChain
+
+	txes            types.Transactions
+	publicReceipts  types.Receipts
+	privateReceipts types.Receipts
+	logs            vm.Logs
+}
+
+// Header returns the header of the block. Fields which don't affect execution,
+// such as Extra, may be changed; the number, parent, timestamp and gas fields
+// mustn't be.
+func (pw *PendingWork) Header() *types.Header {
+	return pw.env.header
+}
+
+// Nonce returns the nonce of the given account in the state the block builds
+// on, which is the nonce of the next transaction it sends.
+func (pw *PendingWork) Nonce(addr common.Address) uint64 {
+	return pw.env.publicState.GetNonce(addr)
+}
+
+// AddTransaction commits the given transaction to the block, ahead of the rest.
+// It's subject to the same checks and gas limit as a batch of one, and leaves
+// the block untouched if it fails.
+func (pw *PendingWork) AddTransaction(tx *types.Transaction) error {
+	publicReceipts, privateReceipts, logs, err := pw.env.commitBatch(types.Transactions{tx}, pw.bc)
+	if err != nil {
+		return err
+	}
+	pw.txes = append(pw.txes, tx)
+	pw.publicReceipts = append(pw.publicReceipts, publicReceipts...)
+	pw.privateReceipts = append(pw.privateReceipts, privateReceipts...)
+	pw.logs = append(pw.logs, logs...)
+	return nil
+}
+
+// Runs the configured WorkDecorator, if any, on the work of a round, returning
+// what it added. Assumes mu is held.
+func (env *work) decorate(bc *core.BlockChain) *PendingWork {
+	pw := &PendingWork{env: env, bc: bc}
+	if env.settings.WorkDecorator != nil {
+		defer env.holdReserve()()
+		env.settings.WorkDecorator(pw)
+	}
+	return pw
+}
+
+// TimestampBeacon returns a WorkDecorator which records the timestamp of every
+// block on chain: it has each block start with a call from the given key to the
+// given contract, passing the timestamp as 32 bytes of input.
+func TimestampBeacon(key *ecdsa.PrivateKey, contract common.Address, gas *big.Int) func(*PendingWork) {
+	return func(pw *PendingWork) {
+		header := pw.Header()
+		from := crypto.PubkeyToAddress(key.PublicKey)
+		input := common.LeftPadBytes(header.Time.Bytes(), 32)
+
+		tx, err := types.NewTransaction(pw.Nonce(from), contract, new(big.Int), gas, new(big.Int), input).SignECDSA(key)
+		if err == nil {
+			err = pw.AddTransaction(tx)
+		}
+		if err != nil {
+			glog.V(logger.Warn).Infof("Failed to add the timestamp beacon to block #%v: %v\n", header.Number, err)
+		}
+	}
+}
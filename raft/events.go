@@ -1,6 +1,7 @@
 package raft
 
 import (
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
 )
 
@@ -11,3 +12,49 @@ type InvalidRaftOrdering struct {
 	// New block that should point to the head, but doesn't
 	invalidBlock *types.Block
 }
+
+// Posted when the minter drops a transaction which can never be minted.
+type TxDroppedEvent struct {
+	Tx     *types.Transaction
+	Reason error
+}
+
+// A transaction left out of a minting round. Only the first transaction
+// skipped from each account is reported, since its successors can't be
+// minted before it.
+type SkippedTx struct {
+	Tx     *types.Transaction
+	Reason error
+
+	// Whether the transaction was removed from the pool, rather than deferred
+	// to a later round.
+	Dropped bool
+}
+
+// Posted along with the pending events of each round if CompactPendingBlocks
+// is set. It carries the new speculative head without transaction bodies.
+type CompactPendingBlockEvent struct {
+	Header   *types.Header
+	TxHashes []common.Hash
+}
+
+// Posted when an invalid ordering unwinds the speculative chain, from the head
+// From back to the head To, discarding the given number of speculative blocks.
+type SpeculativeUnwindEvent struct {
+	From      common.Hash
+	To        common.Hash
+	Discarded int
+}
+
+// Posted after each minting round. BlockHash is zero if no block was minted.
+type RoundSummaryEvent struct {
+	BlockHash common.Hash
+	Committed types.Transactions
+	Skipped   []SkippedTx
+}
+
+// Posted when raft accepts a block this node minted. Raft never reverts
+// accepted blocks, so this confirms the block is final.
+type BlockAcceptedEvent struct {
+	Block *types.Block
+}
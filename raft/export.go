@@ -0,0 +1,71 @@
+package raft
+
+import (
+	"errors"
+	"io"
+	"sync/atomic"
+
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/logger"
+	"github.com/ethereum/go-ethereum/logger/glog"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+var errExportBacklog = errors.New("too many blocks awaiting export")
+
+// A minted block on its way to the sink configured when it was minted.
+type blockExport struct {
+	sink  io.Writer
+	block *types.Block
+}
+
+// Writes a minted block to the configured sink, if any. Unless ExportSync is
+// set this happens in the background, and a block is left out of the export
+// when too many are already waiting. Failures are only logged, so exporting
+// never stops minting.
+func (minter *minter) exportBlock(settings *MinterConfig, block *types.Block) {
+	if settings.BlockSink == nil {
+		return
+	}
+	export := blockExport{sink: settings.BlockSink, block: block}
+
+	if settings.ExportSync {
+		minter.writeExport(export)
+		return
+	}
+	select {
+	case minter.exports <- export:
+	default:
+		minter.exportFailed(block, errExportBacklog)
+	}
+}
+
+func (minter *minter) exportLoop() {
+	for {
+		select {
+		case export := <-minter.exports:
+			minter.writeExport(export)
+		case <-minter.quit:
+			// Write out the blocks still awaiting export.
+			for {
+				select {
+				case export := <-minter.exports:
+					minter.writeExport(export)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (minter *minter) writeExport(export blockExport) {
+	if err := rlp.Encode(export.sink, export.block); err != nil {
+		minter.exportFailed(export.block, err)
+	}
+}
+
+func (minter *minter) exportFailed(block *types.Block, err error) {
+	failures := atomic.AddUint64(&minter.exportFailures, 1)
+	glog.V(logger.Warn).Infof("Failed to export block %x (%d failures so far): %v\n", block.Hash(), failures, err)
+}
@@ -170,7 +170,7 @@ func (pm *ProtocolManager) Stop() {
 
 	pm.quorumRaftDb.Close()
 
-	pm.minter.stop()
+	pm.minter.close()
 
 	glog.V(logger.Info).Infoln("raft protocol handler stopped")
 }
@@ -351,7 +351,9 @@ func (pm *ProtocolManager) handleRoleChange(roleC <-chan interface{}) {
 
 			if intRole == minterRole {
 				logger.LogRaftCheckpoint(logger.BecameMinter)
-				pm.minter.start()
+				if err := pm.minter.start(); err != nil {
+					glog.V(logger.Error).Infof("Not minting: %v\n", err)
+				}
 			} else { // verifier
 				logger.LogRaftCheckpoint(logger.BecameVerifier)
 				pm.minter.stop()
@@ -0,0 +1,131 @@
+// Contains the metrics collected by the minter.
+
+package raft
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/metrics"
+	gometrics "github.com/rcrowley/go-metrics"
+)
+
+const gasPriceBuckets = 5
+
+// Inclusive upper bounds of the gas price histogram buckets, in wei. Prices
+// above the last bound are counted in the final overflow bucket.
+var gasPriceBucketBounds = [gasPriceBuckets - 1]*big.Int{
+	big.NewInt(0),
+	big.NewInt(1e9),
+	big.NewInt(1e10),
+	big.NewInt(1e11),
+}
+
+var gasPriceBucketNames = [gasPriceBuckets]string{"zero", "le1gwei", "le10gwei", "le100gwei", "gt100gwei"}
+
+// Throughput of the minter. They're only updated by minting rounds, so they
+// stay at zero on followers.
+type mintingMetrics struct {
+	registry gometrics.Registry // of these, and of the meters of watched contracts
+
+	blocks      gometrics.Meter // minted
+	txes        gometrics.Meter // committed to minted blocks
+	privateTxes gometrics.Meter // of those, private ones
+	publicTxes  gometrics.Meter // of those, public ones
+	failed      gometrics.Meter // whose execution failed
+	dropped     gometrics.Meter // removed from the pool
+	emptySkips  gometrics.Meter // rounds which minted nothing for lack of transactions
+	poolReads   gometrics.Meter // rounds which read the pending transactions of the pool
+	backoffs    gometrics.Meter // rounds which left the pool be for the depth of the speculative chain
+	full        gometrics.Meter // rounds skipped because the speculative chain is full
+	elapsed     gometrics.Timer // from the timestamp of each minted block until it was minted
+
+	gasPrices [gasPriceBuckets]gometrics.Meter // transactions committed to minted blocks, by gas price bucket
+}
+
+// Registers the minting metrics in the given registry. Unless metrics are
+// enabled these are stubs, so they must be created after metrics have been
+// enabled.
+func newMintingMetrics(registry gometrics.Registry) *mintingMetrics {
+	m := &mintingMetrics{
+		registry:    registry,
+		blocks:      newMeter(registry, "raft/minter/blocks"),
+		txes:        newMeter(registry, "raft/minter/txs"),
+		privateTxes: newMeter(registry, "raft/minter/txs/private"),
+		publicTxes:  newMeter(registry, "raft/minter/txs/public"),
+		failed:      newMeter(registry, "raft/minter/failed"),
+		dropped:     newMeter(registry, "raft/minter/dropped"),
+		emptySkips:  newMeter(registry, "raft/minter/emptyskips"),
+		poolReads:   newMeter(registry, "raft/minter/poolreads"),
+		backoffs:    newMeter(registry, "raft/minter/backoffs"),
+		full:        newMeter(registry, "raft/minter/speculative/full"),
+		elapsed:     newTimer(registry, "raft/minter/elapsed"),
+	}
+	for i, name := range gasPriceBucketNames {
+		m.gasPrices[i] = newMeter(registry, "raft/minter/gasprice/"+name)
+	}
+	return m
+}
+
+// Like metrics.NewMeter, but registers the meter in the given registry.
+func newMeter(registry gometrics.Registry, name string) gometrics.Meter {
+	if !metrics.Enabled {
+		return new(gometrics.NilMeter)
+	}
+	return gometrics.GetOrRegisterMeter(name, registry)
+}
+
+// Like metrics.NewTimer, but registers the timer in the given registry.
+func newTimer(registry gometrics.Registry, name string) gometrics.Timer {
+	if !metrics.Enabled {
+		return new(gometrics.NilTimer)
+	}
+	return gometrics.GetOrRegisterTimer(name, registry)
+}
+
+// Counts of transactions by gas price bucket.
+type gasPriceHistogram [gasPriceBuckets]uint64
+
+func (h *gasPriceHistogram) add(price *big.Int) {
+	for i, bound := range gasPriceBucketBounds {
+		if price.Cmp(bound) <= 0 {
+			h[i]++
+			return
+		}
+	}
+	h[gasPriceBuckets-1]++
+}
+
+// Marks the gas price meters with the counts of this histogram.
+func (m *mintingMetrics) markGasPrices(h *gasPriceHistogram) {
+	for i, count := range h {
+		if count > 0 {
+			m.gasPrices[i].Mark(int64(count))
+		}
+	}
+}
+
+func (h *gasPriceHistogram) toMap() map[string]uint64 {
+	m := make(map[string]uint64, gasPriceBuckets)
+	for i, count := range h {
+		m[gasPriceBucketNames[i]] = count
+	}
+	return m
+}
+
+// Usage of a watched contract by the transactions of a block.
+type contractUsage struct {
+	gas  uint64
+	txes uint64
+}
+
+// Marks the meters of each watched contract with its usage. Meters are only
+// registered for watched contracts, keeping their number bounded.
+func (m *mintingMetrics) markContractUsage(usage map[common.Address]*contractUsage) {
+	for addr, u := range usage {
+		prefix := fmt.Sprintf("raft/minter/contract/%x/", addr)
+		newMeter(m.registry, prefix+"gas").Mark(int64(u.gas))
+		newMeter(m.registry, prefix+"txs").Mark(int64(u.txes))
+	}
+}
@@ -17,8 +17,10 @@
 package raft
 
 import (
+	"errors"
 	"fmt"
 	"math/big"
+	"math/rand"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -29,19 +31,65 @@ import (
 	"github.com/ethereum/go-ethereum/core/state"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/event"
 	"github.com/ethereum/go-ethereum/logger"
 	"github.com/ethereum/go-ethereum/logger/glog"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/private"
+	"github.com/ethereum/go-ethereum/trie"
+	"github.com/hashicorp/golang-lru"
+)
+
+var (
+	errCreationCollision    = errors.New("contract creation collides with existing code")
+	errNothingToMint        = errors.New("no pending transactions to mint")
+	errUnhealthy            = errors.New("minting is paused by the health check")
+	errNoEventMux           = errors.New("minter requires an event mux")
+	errBadSubscription      = errors.New("event mux returned a subscription without a channel")
+	errNotAllowlisted       = errors.New("transaction target is not allowlisted")
+	errBelowPriceFloor      = errors.New("gas price is below the floor")
+	errExceedsValueCap      = errors.New("transaction would exceed the block value cap")
+	errTxTimeout            = errors.New("transaction execution timed out")
+	errPayloadTooLarge      = errors.New("private payload exceeds the size limit")
+	errTxDataTooLarge       = errors.New("transaction data exceeds the size limit")
+	errBlockFull            = errors.New("block gas limit reached")
+	errKnownBlock           = errors.New("minted block is already known")
+	errContractSender       = errors.New("transaction sender is a contract")
+	errInvalidBlockTime     = errors.New("block time must be positive")
+	errTxCapReached         = errors.New("block transaction cap reached")
+	errRejectedByState      = errors.New("transaction rejected by the state predicate")
+	errExceedsGasLimit      = errors.New("transaction gas exceeds the block gas limit")
+	errZeroCoinbase         = errors.New("refusing to mint with the zero address as coinbase, which would burn block rewards: set one through admin_setCoinbase or --raftcoinbases")
+	errClockDrift           = errors.New("block timestamp is too far ahead of the clock")
+	errDiverged             = errors.New("minting is paused after a state root mismatch or an invalid block")
+	errSpeculativeChainFull = errors.New("too many minted blocks await acceptance")
+	errGasLimitTooLow       = fmt.Errorf("gas limit must be at least %v", params.MinGasLimit)
 )
 
 // Current state information for building the next block
 type work struct {
 	config       *core.ChainConfig
+	settings     *MinterConfig
 	publicState  *state.StateDB
 	privateState *state.StateDB
 	Block        *types.Block
 	header       *types.Header
+	parent       *types.Header // of the block being built
+	gasPool      *core.GasPool
+	gasPrices    gasPriceHistogram    // of the transactions included so far
+	dropped      []*TxDroppedEvent    // transactions which can never be minted
+	skipped      []SkippedTx          // transactions left out of the round
+	failed       []SkippedTx          // transactions whose execution failed
+	bundles      []types.Transactions // to commit atomically, ahead of the pool; then those left out for the transaction cap
+	txCount      int                  // transactions committed so far
+	capped       bool                 // whether transactions were left out for the transaction cap
+	transferred  *big.Int             // total value of the transactions included so far
+	minGasPrice  *big.Int             // floor below which transactions are deferred
+	round        *roundControl
+
+	contractUsage map[common.Address]*contractUsage // of watched contracts
 }
 
 type minter struct {
@@ -51,14 +99,82 @@ type minter struct {
 	eth              core.Backend
 	chain            *core.BlockChain
 	chainDb          ethdb.Database
-	coinbase         common.Address
-	minting          int32 // Atomic status counter
+	coinbase         common.Address // Guarded by mu
+	minting          int32          // Atomic status counter
+	epoch            uint64         // Atomic count of stops, changed with mu held
+	chainUpdatesMu   sync.Mutex
+	chainUpdates     int        // Guarded by chainUpdatesMu; count of chain events waiting for mu, which minting yields to
+	chainUpdatesDone *sync.Cond // Signalled once no chain events are waiting for mu
+	blocksMinted     uint64     // Atomic count of blocks minted since startup
+	record           mintRecord // Guarded by mu; persisted after each minted block
+	txesCommitted    uint64     // Atomic count of transactions in those blocks
+	unexpectedEvents uint64     // Atomic count of events of types the event loop doesn't handle
+	startTime        time.Time
+	pendingRequests  uint32 // Atomic count of minting requests since the last round
+	coalesced        uint32 // Atomic count of requests served by the last round
+	eventRequested   int32  // Atomic flag set while a request made by the event loop awaits a round
+	unhealthy        int32  // Atomic flag set while the health check fails
+	diverged         int32  // Atomic flag set while minting is paused over a state root mismatch or an invalid block
+	paused           int32  // Atomic flag set while minting is paused by pause(), changed with mu held
+	reminting        int    // Number of unwound blocks whose replacements are yet to be verified
+	commitTooSlow    bool   // Whether the last commit took longer than the block time
+	backpressured    bool   // Whether the last round left the pool be for the depth of the speculative chain
 	shouldMine       *channels.RingChannel
-	blockTime        time.Duration
+	blockTime        int64         // Atomic time.Duration, adjustable at runtime
+	blockTimeChanged chan struct{} // Signalled when blockTime changes
 	speculativeChain *speculativeChain
+	settings         atomic.Value         // *MinterConfig, replaced as a whole on reconfiguration
+	batches          []*txBatch           // Submitted batches awaiting the next round
+	bundles          []types.Transactions // Submitted bundles awaiting the next round
+	lastGasPrices    gasPriceHistogram
+	recentFullness   []float64  // of the last rounds, oldest first
+	receiptCache     *lru.Cache // *MintedReceipts of recently minted blocks, by hash
+	blockTimings     *lru.Cache // *BlockTimings of recently minted blocks, by hash
+	latencies        *latencySampler
+	activity         activityTracker
+	metrics          *mintingMetrics
+	roundMu          sync.Mutex
+	round            *roundControl               // of the in-progress round, if any
+	invalidOrderings []InvalidOrderingInfo       // most recent last, bounded
+	recentFailures   []FailedTxInfo              // most recent last, bounded
+	txFailures       map[common.Hash]*txFailures // of the transactions which failed in the last round
+
+	exports        chan blockExport // awaiting asynchronous export
+	exportFailures uint64           // Atomic count of blocks which failed to export
+
+	pendingEvents     chan []interface{} // of each round, awaiting posting
+	pendingStateMu    sync.Mutex
+	lastPendingState  time.Time   // when the last PendingStateEvent was posted
+	pendingStateTimer *time.Timer // of the coalesced PendingStateEvent which is due, if any
+
+	events    event.Subscription // of the event loop
+	quit      chan struct{}      // closed on shutdown
+	loops     sync.WaitGroup     // of the goroutines which run until shutdown
+	closeOnce sync.Once
+	closeMu   sync.RWMutex
+	closed    bool // Guarded by closeMu; minting can't be requested once set
+}
+
+// MintedReceipts holds the receipts of a block minted by this node.
+type MintedReceipts struct {
+	Public  types.Receipts `json:"public"`
+	Private types.Receipts `json:"private"`
 }
 
-func newMinter(config *core.ChainConfig, eth core.Backend, blockTime time.Duration) *minter {
+func newMinter(config *core.ChainConfig, eth core.Backend, blockTime time.Duration, settings *MinterConfig) (*minter, error) {
+	if settings == nil {
+		settings = &MinterConfig{}
+	}
+	if eth.EventMux() == nil {
+		return nil, errNoEventMux
+	}
+	if settings.GasLimit != 0 && new(big.Int).SetUint64(settings.GasLimit).Cmp(params.MinGasLimit) < 0 {
+		return nil, errGasLimitTooLow
+	}
+	var receiptCache *lru.Cache
+	if settings.ReceiptCacheSize > 0 {
+		receiptCache, _ = lru.New(settings.ReceiptCacheSize)
+	}
 	minter := &minter{
 		config:           config,
 		eth:              eth,
@@ -66,50 +182,473 @@ func newMinter(config *core.ChainConfig, eth core.Backend, blockTime time.Durati
 		chainDb:          eth.ChainDb(),
 		chain:            eth.BlockChain(),
 		shouldMine:       channels.NewRingChannel(1),
-		blockTime:        blockTime,
+		blockTime:        int64(blockTime),
+		blockTimeChanged: make(chan struct{}, 1),
 		speculativeChain: newSpeculativeChain(),
+		receiptCache:     receiptCache,
+		exports:          make(chan blockExport, maxPendingExports),
+		startTime:        time.Now(),
+		metrics:          newMintingMetrics(settings.metricsRegistry()),
+		latencies:        newLatencySampler(latencyWindowSize),
+		quit:             make(chan struct{}),
 	}
-	events := minter.mux.Subscribe(
+	minter.chainUpdatesDone = sync.NewCond(&minter.chainUpdatesMu)
+	minter.blockTimings, _ = lru.New(blockTimingsCacheSize)
+	minter.record = loadMintRecord(minter.chainDb)
+	maxPendingEventPosts := settings.MaxPendingEventPosts
+	if maxPendingEventPosts <= 0 {
+		maxPendingEventPosts = defaultMaxPendingEventPosts
+	}
+	minter.pendingEvents = make(chan []interface{}, maxPendingEventPosts)
+	snapshot := *settings
+	minter.settings.Store(&snapshot)
+	minter.events = minter.mux.Subscribe(
 		core.ChainHeadEvent{},
 		core.TxPreEvent{},
 		InvalidRaftOrdering{},
 	)
+	// Ranging over a nil channel would block the event loop forever.
+	if minter.events == nil || minter.events.Chan() == nil {
+		return nil, errBadSubscription
+	}
 
 	minter.speculativeChain.clear(minter.chain.CurrentBlock())
 
-	go minter.eventLoop(events)
-	go minter.mintingLoop()
+	minter.runLoop(func() { minter.eventLoop(minter.events) })
+	minter.runLoop(minter.mintingLoop)
+	minter.runLoop(minter.exportLoop)
+	minter.runLoop(minter.pendingEventLoop)
+
+	if settings.HealthCheck != nil {
+		minter.runLoop(minter.healthLoop)
+	}
+	if settings.EmptyBlockPeriod > 0 {
+		minter.runLoop(func() { minter.emptyBlockLoop(settings.EmptyBlockPeriod) })
+	}
+
+	return minter, nil
+}
 
-	return minter
+// Runs a goroutine which close waits for.
+func (minter *minter) runLoop(loop func()) {
+	minter.loops.Add(1)
+	go func() {
+		defer minter.loops.Done()
+		loop()
+	}()
 }
 
-func (minter *minter) start() {
+// Starts minting. This fails if RequireCoinbase is set but blocks would credit
+// the zero address.
+func (minter *minter) start() error {
+	minter.mu.Lock()
+	if settings := minter.currentSettings(); settings.creditsZeroAddress(minter.coinbase) {
+		if settings.RequireCoinbase {
+			minter.mu.Unlock()
+			return errZeroCoinbase
+		}
+		glog.V(logger.Warn).Infoln("Minting with the zero address as coinbase, which burns block rewards")
+	}
+	if atomic.LoadInt32(&minter.minting) == 0 && atomic.LoadInt32(&minter.paused) == 0 {
+		// Chain events may have been missed while stopped, so the first round
+		// builds on the current block rather than whatever head we last saw.
+		minter.speculativeChain.clear(minter.chain.CurrentBlock())
+	}
+	atomic.StoreInt32(&minter.paused, 0)
 	atomic.StoreInt32(&minter.minting, 1)
-	minter.requestMinting()
+	minter.mu.Unlock()
+
+	if !minter.currentSettings().OnDemand {
+		minter.requestMinting()
+	}
+	return nil
+}
+
+// Returns the speculative head with fresh copies of its public and private
+// state, so that calls can be executed against pending state. Minting never
+// mutates the returned states, nor do changes to them affect minting.
+func (minter *minter) pendingState() (*types.Block, *state.StateDB, *state.StateDB, error) {
+	minter.mu.Lock()
+	head := minter.speculativeChain.head
+	minter.mu.Unlock()
+
+	publicState, privateState, err := minter.chain.StateAt(head.Root())
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to get state of pending block %x: %v", head.Hash(), err)
+	}
+	return head, publicState, privateState, nil
+}
+
+// Syncs the database to disk after the state of the speculative head was
+// written, waiting for any in-progress round to finish first, and returns its
+// root. Each round already commits its state to the database, without keeping
+// trie nodes in memory, so all that's left is for the database's pending writes
+// to be synced: a synced write of the root, recorded as the last one flushed,
+// syncs them along with it. Only the presence of the roots of the public and
+// private tries is checked, not that of every node below them.
+func (minter *minter) flushState() (common.Hash, error) {
+	minter.mu.Lock()
+	defer minter.mu.Unlock()
+
+	root := minter.speculativeChain.head.Root()
+	if _, err := state.New(root, minter.chainDb); err != nil {
+		return common.Hash{}, fmt.Errorf("public state %x is missing: %v", root, err)
+	}
+	privateRoot := core.GetPrivateStateRoot(minter.chainDb, root)
+	if _, err := state.New(privateRoot, minter.chainDb); err != nil {
+		return common.Hash{}, fmt.Errorf("private state %x is missing: %v", privateRoot, err)
+	}
+
+	// A synced write also syncs everything written before it.
+	var err error
+	if ldb, ok := minter.chainDb.(*ethdb.LDBDatabase); ok {
+		err = ldb.LDB().Put(flushedStateDbKey, root[:], mustFsync)
+	} else {
+		err = minter.chainDb.Put(flushedStateDbKey, root[:])
+	}
+	if err != nil {
+		return common.Hash{}, err
+	}
+
+	glog.V(logger.Info).Infof("Flushed state of block #%v (root %x)\n", minter.speculativeChain.head.Number(), root)
+	return root, nil
+}
+
+// Returns the current settings snapshot, which must not be modified.
+func (minter *minter) currentSettings() *MinterConfig {
+	return minter.settings.Load().(*MinterConfig)
+}
+
+// Applies update to a copy of the current settings, and installs the result.
+// This waits for any in-progress round to finish, and each round works with
+// the snapshot taken when it started, so a round never sees a partial update.
+//
+// Settings consumed at construction (HealthCheck, HealthCheckInterval and
+// ReceiptCacheSize) aren't affected.
+func (minter *minter) reconfigure(update func(*MinterConfig)) {
+	minter.mu.Lock()
+	defer minter.mu.Unlock()
+
+	snapshot := *minter.currentSettings()
+	update(&snapshot)
+	minter.settings.Store(&snapshot)
+}
+
+// Returns the coinbase credited by minted blocks, unless Coinbases rotate.
+func (minter *minter) getCoinbase() common.Address {
+	minter.mu.Lock()
+	defer minter.mu.Unlock()
+
+	return minter.coinbase
+}
+
+// Changes the coinbase, taking effect from the next round. Speculative blocks
+// already minted keep the coinbase in their headers, which is what their
+// rewards are checked against when they're inserted.
+func (minter *minter) setCoinbase(coinbase common.Address) {
+	minter.mu.Lock()
+	defer minter.mu.Unlock()
+
+	minter.coinbase = coinbase
 }
 
 func (minter *minter) stop() {
+	// Don't wait for the round in progress to finish: it won't mint anyway.
+	minter.cancelCurrentRound()
+
 	minter.mu.Lock()
 	defer minter.mu.Unlock()
 
 	minter.speculativeChain.clear(minter.chain.CurrentBlock())
 	atomic.StoreInt32(&minter.minting, 0)
+	atomic.StoreInt32(&minter.paused, 0)
+	atomic.AddUint64(&minter.epoch, 1)
+
+	resolveBatches(minter.batches, errMintingStopped)
+	minter.batches = nil
+	minter.bundles = nil
+	minter.reminting = 0
+}
+
+// Pauses minting, reporting whether it was minting. Unlike stop(), this keeps
+// the speculative chain, along with submitted batches and bundles, so that
+// resume() carries on from the blocks already minted rather than minting them
+// afresh. Blocks still awaiting raft acceptance are accepted meanwhile as
+// usual. A round already underway may still mint.
+func (minter *minter) pause() bool {
+	minter.mu.Lock()
+	defer minter.mu.Unlock()
+
+	if atomic.LoadInt32(&minter.minting) == 0 {
+		return false
+	}
+	glog.V(logger.Info).Infoln("Pausing minting")
+	atomic.StoreInt32(&minter.minting, 0)
+	atomic.StoreInt32(&minter.paused, 1)
+	return true
+}
+
+// Resumes minting after pause(), on top of the speculative chain, reporting
+// whether it was paused. Minting stopped by stop() isn't resumed.
+func (minter *minter) resume() bool {
+	minter.mu.Lock()
+	if atomic.LoadInt32(&minter.paused) == 0 {
+		minter.mu.Unlock()
+		return false
+	}
+	glog.V(logger.Info).Infoln("Resuming paused minting")
+	atomic.StoreInt32(&minter.paused, 0)
+	atomic.StoreInt32(&minter.minting, 1)
+	minter.mu.Unlock()
+
+	if !minter.currentSettings().OnDemand {
+		minter.requestMinting()
+	}
+	return true
+}
+
+// Stops minting for good, and tears down the minter's goroutines. This waits
+// for any round in progress to finish, which doesn't mint anything once
+// stopped, and for blocks awaiting export to be written.
+func (minter *minter) close() {
+	minter.closeOnce.Do(func() {
+		minter.stop()
+
+		minter.closeMu.Lock()
+		minter.closed = true
+		minter.closeMu.Unlock()
+
+		close(minter.quit)
+		minter.cancelPendingState()
+		minter.activity.stop()
+		minter.events.Unsubscribe()
+		minter.shouldMine.Close()
+		minter.loops.Wait()
+	})
 }
 
 // Notify the minting loop that minting should occur, if it's not already been
 // requested. Due to the use of a RingChannel, this function is idempotent if
 // called multiple times before the minting occurs.
 func (minter *minter) requestMinting() {
+	minter.closeMu.RLock()
+	defer minter.closeMu.RUnlock()
+	if minter.closed {
+		return
+	}
+
+	atomic.AddUint32(&minter.pendingRequests, 1)
 	minter.shouldMine.In() <- struct{}{}
 }
 
-type AddressTxes map[common.Address]types.Transactions
+// Requests minting on behalf of the event loop, unless its last request is yet
+// to be served: the round serving that one mints whatever arrived since, so a
+// burst of events makes a single request.
+func (minter *minter) requestMintingOnce() {
+	if atomic.CompareAndSwapInt32(&minter.eventRequested, 0, 1) {
+		minter.requestMinting()
+	}
+}
 
-func (minter *minter) updateSpeculativeChainPerNewHead(newHeadBlock *types.Block) {
+// Checks that the chain we mint upon contains, as a canonical ancestor of its
+// head, the block that raft last recorded as committed. If it doesn't, the
+// chain database has diverged from the raft log.
+func (minter *minter) checkCommittedHead(committedHash common.Hash) error {
+	head := minter.chain.CurrentBlock()
+
+	committed := minter.chain.GetBlockByHash(committedHash)
+	if committed == nil {
+		return fmt.Errorf("last committed block %x is missing from the chain (head is #%v %x)", committedHash, head.Number(), head.Hash())
+	}
+	if canonical := minter.chain.GetBlockByNumber(committed.NumberU64()); canonical == nil || canonical.Hash() != committedHash || head.NumberU64() < committed.NumberU64() {
+		return fmt.Errorf("last committed block #%v %x is not an ancestor of head #%v %x", committed.Number(), committedHash, head.Number(), head.Hash())
+	}
+	return nil
+}
+
+// Mints a block right away, rather than waiting for the minting loop. Returns
+// an error if no block was minted, such as errNothingToMint.
+func (minter *minter) forceMint() (*types.Block, error) {
+	epoch := atomic.LoadUint64(&minter.epoch)
+	if atomic.LoadInt32(&minter.minting) == 0 {
+		return nil, errNotMinting
+	}
+	if !minter.checkHealth() {
+		return nil, errUnhealthy
+	}
+	return minter.mintNewBlockIn(epoch)
+}
+
+// Mints blocks until no pending transactions remain.
+func (minter *minter) drainPending() ([]*types.Block, error) {
+	var blocks []*types.Block
+	for {
+		block, err := minter.forceMint()
+		if err == errNothingToMint || err == errSpeculativeChainFull {
+			return blocks, nil
+		} else if err != nil {
+			return blocks, err
+		}
+		blocks = append(blocks, block)
+	}
+}
+
+// Returns the receipts of a recently minted block from memory, if present.
+func (minter *minter) cachedReceipts(blockHash common.Hash) (*MintedReceipts, bool) {
+	if minter.receiptCache == nil {
+		return nil, false
+	}
+	if receipts, ok := minter.receiptCache.Get(blockHash); ok {
+		return receipts.(*MintedReceipts), true
+	}
+	return nil, false
+}
+
+// BlockTimings holds the time spent in each phase of minting a block.
+type BlockTimings struct {
+	StateFetch time.Duration `json:"stateFetch"` // setting up the round on the parent state
+	Packing    time.Duration `json:"packing"`    // executing transactions
+	Reward     time.Duration `json:"reward"`     // crediting the reward and sealing the header
+	Commit     time.Duration `json:"commit"`     // writing the state to the database
+	Total      time.Duration `json:"total"`      // of the whole round, including the above
+}
+
+// Returns the phase timings of a recently minted block, if known.
+func (minter *minter) timingsOf(blockHash common.Hash) (*BlockTimings, bool) {
+	if timings, ok := minter.blockTimings.Get(blockHash); ok {
+		return timings.(*BlockTimings), true
+	}
+	return nil, false
+}
+
+// InvalidOrderingInfo describes an InvalidRaftOrdering handled by the minter.
+type InvalidOrderingInfo struct {
+	InvalidBlock common.Hash `json:"invalidBlock"`
+	Head         common.Hash `json:"head"`
+	InLocalDb    bool        `json:"inLocalDb"` // if not, the block was minted elsewhere and ignored
+	Time         time.Time   `json:"time"`
+}
+
+// AcceptedBlockInfo describes a block this node minted which raft accepted.
+type AcceptedBlockInfo struct {
+	Hash    common.Hash `json:"hash"`
+	Number  uint64      `json:"number"`
+	TxCount int         `json:"txCount"`
+}
+
+// FailedTxInfo describes a transaction whose execution failed while minting.
+// The later transactions of its sender were held back with it.
+type FailedTxInfo struct {
+	Tx       common.Hash    `json:"tx"`
+	From     common.Address `json:"from"`
+	Nonce    uint64         `json:"nonce"`
+	Reason   string         `json:"reason"`
+	HeldBack []common.Hash  `json:"heldBack"`
+	Block    uint64         `json:"block"` // number of the block being minted
+	Time     time.Time      `json:"time"`
+}
+
+// Records the transactions which failed in the given round, along with the
+// pending transactions of their senders held back with them. Assumes mu is
+// held.
+func (minter *minter) recordFailures(work *work, pending AddressTxes) {
+	for _, failed := range work.failed {
+		from, _ := failed.Tx.From()
+		info := FailedTxInfo{
+			Tx:     failed.Tx.Hash(),
+			From:   from,
+			Nonce:  failed.Tx.Nonce(),
+			Reason: failed.Reason.Error(),
+			Block:  work.header.Number.Uint64(),
+			Time:   time.Now(),
+		}
+		for _, tx := range pending[from] {
+			if tx.Nonce() > failed.Tx.Nonce() {
+				info.HeldBack = append(info.HeldBack, tx.Hash())
+			}
+		}
+
+		if len(minter.recentFailures) == failedTxHistorySize {
+			minter.recentFailures = minter.recentFailures[1:]
+		}
+		minter.recentFailures = append(minter.recentFailures, info)
+	}
+}
+
+// Returns the most recent transaction failures, oldest first.
+func (minter *minter) failedTransactions() []FailedTxInfo {
+	minter.mu.Lock()
+	defer minter.mu.Unlock()
+
+	return append([]FailedTxInfo(nil), minter.recentFailures...)
+}
+
+// Returns the invalid orderings handled most recently, oldest first.
+func (minter *minter) recentInvalidOrderings() []InvalidOrderingInfo {
 	minter.mu.Lock()
 	defer minter.mu.Unlock()
 
-	minter.speculativeChain.accept(newHeadBlock)
+	return append([]InvalidOrderingInfo(nil), minter.invalidOrderings...)
+}
+
+type AddressTxes map[common.Address]types.Transactions
+
+func (addrTxes AddressTxes) count() int {
+	n := 0
+	for _, txes := range addrTxes {
+		n += len(txes)
+	}
+	return n
+}
+
+// Takes mu for handling a chain event. Minting rounds wait for these to be
+// handled before starting, so that a busy minter can't starve them.
+func (minter *minter) lockForChainUpdate() {
+	minter.chainUpdatesMu.Lock()
+	minter.chainUpdates++
+	minter.chainUpdatesMu.Unlock()
+
+	minter.mu.Lock()
+
+	minter.chainUpdatesMu.Lock()
+	minter.chainUpdates--
+	if minter.chainUpdates == 0 {
+		minter.chainUpdatesDone.Broadcast()
+	}
+	minter.chainUpdatesMu.Unlock()
+}
+
+// Waits for pending chain events to be handled.
+func (minter *minter) yieldToChainUpdates() {
+	minter.chainUpdatesMu.Lock()
+	defer minter.chainUpdatesMu.Unlock()
+
+	for minter.chainUpdates > 0 {
+		minter.chainUpdatesDone.Wait()
+	}
+}
+
+func (minter *minter) updateSpeculativeChainPerNewHead(newHeadBlock *types.Block) {
+	minter.lockForChainUpdate()
+	accepted := minter.speculativeChain.accept(newHeadBlock)
+	minter.mu.Unlock()
+
+	if accepted {
+		// Consumers rely on it for finality, so unlike pending events it's
+		// never dropped.
+		minter.queueEventsWait(BlockAcceptedEvent{Block: newHeadBlock})
+	}
+}
+
+// Describes an invalid raft ordering as of now. The invalid block is in our
+// database if we minted it.
+func (minter *minter) describeInvalidOrdering(headBlock, invalidBlock *types.Block) InvalidOrderingInfo {
+	return InvalidOrderingInfo{
+		InvalidBlock: invalidBlock.Hash(),
+		Head:         headBlock.Hash(),
+		InLocalDb:    minter.chain.HasBlock(invalidBlock.Hash()),
+		Time:         time.Now(),
+	}
 }
 
 func (minter *minter) updateSpeculativeChainPerInvalidOrdering(headBlock *types.Block, invalidBlock *types.Block) {
@@ -117,17 +656,111 @@ func (minter *minter) updateSpeculativeChainPerInvalidOrdering(headBlock *types.
 
 	glog.V(logger.Warn).Infof("Handling InvalidRaftOrdering for invalid block %x; current head is %x\n", invalidHash, headBlock.Hash())
 
-	minter.mu.Lock()
-	defer minter.mu.Unlock()
+	minter.lockForChainUpdate()
+	unwind := minter.unwindPerInvalidOrdering(headBlock, invalidBlock)
+	minter.mu.Unlock()
+
+	if unwind != nil {
+		minter.queueEventsWait(*unwind)
+	}
+}
+
+// Unwinds the speculative chain from an invalid block we minted, returning the
+// event describing what was discarded, if anything. Assumes mu is held.
+func (minter *minter) unwindPerInvalidOrdering(headBlock *types.Block, invalidBlock *types.Block) *SpeculativeUnwindEvent {
+	invalidHash := invalidBlock.Hash()
+
+	info := minter.describeInvalidOrdering(headBlock, invalidBlock)
+	if len(minter.invalidOrderings) == invalidOrderingHistorySize {
+		minter.invalidOrderings = minter.invalidOrderings[1:]
+	}
+	minter.invalidOrderings = append(minter.invalidOrderings, info)
 
 	// 1. if the block is not in our db, exit. someone else mined this.
-	if !minter.chain.HasBlock(invalidHash) {
+	if !info.InLocalDb {
 		glog.V(logger.Warn).Infof("Someone else mined invalid block %x; ignoring\n", invalidHash)
 
-		return
+		return nil
 	}
 
+	from := minter.speculativeChain.head.Hash()
+	unminted := minter.speculativeChain.unappliedBlocks.Size()
 	minter.speculativeChain.unwindFrom(invalidHash, headBlock)
+	unminted -= minter.speculativeChain.unappliedBlocks.Size()
+
+	if minter.currentSettings().VerifyReorgRoots {
+		minter.reminting += unminted
+	}
+	if unminted == 0 {
+		return nil
+	}
+	return &SpeculativeUnwindEvent{
+		From:      from,
+		To:        minter.speculativeChain.head.Hash(),
+		Discarded: unminted,
+	}
+}
+
+// Re-executes the transactions of a block minted on the given parent, and
+// checks that they produce the same state root. Assumes mu is held.
+func (minter *minter) verifyStateRoot(settings *MinterConfig, parent, block *types.Block) error {
+	work, err := minter.createWorkAt(settings, parent, block.Time().Int64())
+	if err != nil {
+		return fmt.Errorf("failed to get parent state: %v", err)
+	}
+	work.header.Coinbase = block.Coinbase()
+
+	gp := new(core.GasPool).AddGas(block.GasLimit())
+	for _, tx := range block.Transactions() {
+		work.publicState.StartRecord(tx.Hash(), common.Hash{}, 0)
+		if _, _, err := work.applyTransaction(tx, minter.chain, gp); err != nil {
+			return fmt.Errorf("transaction %x failed on re-execution: %v", tx.Hash(), err)
+		}
+	}
+	if err := work.accumulateRewards(); err != nil {
+		return err
+	}
+
+	if root := work.publicState.IntermediateRoot(); root != block.Root() {
+		return fmt.Errorf("re-executed state root %x differs from %x", root, block.Root())
+	}
+	return nil
+}
+
+// Warns when committing a block took longer than the block time, extending the
+// block time if configured to. Assumes mu is held.
+func (minter *minter) checkCommitDuration(settings *MinterConfig, commit time.Duration) {
+	blockTime := minter.currentBlockTime()
+	if commit < blockTime {
+		if minter.commitTooSlow {
+			glog.V(logger.Info).Infof("Committing blocks takes less than the block time of %v again\n", blockTime)
+			minter.commitTooSlow = false
+		}
+		return
+	}
+
+	if !minter.commitTooSlow {
+		glog.V(logger.Warn).Infof("Committing block state took %v, longer than the block time of %v: minting can't keep up\n", commit, blockTime)
+		minter.commitTooSlow = true
+	}
+	if settings.AutoExtendBlockTime {
+		minter.setBlockTime(2 * commit)
+		minter.commitTooSlow = false
+	}
+}
+
+// Resumes minting after it was paused over a state root mismatch or an invalid
+// block, reporting whether it was paused.
+func (minter *minter) resumeAfterDivergence() bool {
+	if !atomic.CompareAndSwapInt32(&minter.diverged, 1, 0) {
+		return false
+	}
+	glog.V(logger.Info).Infoln("Resuming minting after a state root mismatch or an invalid block")
+
+	if atomic.LoadInt32(&minter.minting) == 1 && !minter.currentSettings().OnDemand {
+		minter.requestMinting()
+	}
+	return true
 }
 
 func (minter *minter) eventLoop(events event.Subscription) {
@@ -135,26 +768,27 @@ func (minter *minter) eventLoop(events event.Subscription) {
 		switch ev := event.Data.(type) {
 		case core.ChainHeadEvent:
 			newHeadBlock := ev.Block
+			minter.cancelStaleRound(newHeadBlock)
 
 			if atomic.LoadInt32(&minter.minting) == 1 {
 				minter.updateSpeculativeChainPerNewHead(newHeadBlock)
 
-				//
-				// TODO(bts): not sure if this is the place, but we're going to
-				// want to put an upper limit on our speculative mining chain
-				// length.
-				//
-
-				minter.requestMinting()
+				if !minter.currentSettings().OnDemand {
+					minter.requestMintingOnce()
+				}
 			} else {
-				minter.mu.Lock()
+				minter.lockForChainUpdate()
 				minter.speculativeChain.setHead(newHeadBlock)
 				minter.mu.Unlock()
 			}
 
 		case core.TxPreEvent:
-			if atomic.LoadInt32(&minter.minting) == 1 {
-				minter.requestMinting()
+			// Checked first, as this is the common case under a burst.
+			if atomic.LoadInt32(&minter.eventRequested) == 1 {
+				continue
+			}
+			if atomic.LoadInt32(&minter.minting) == 1 && !minter.currentSettings().OnDemand {
+				minter.requestMintingOnce()
 			}
 
 		case InvalidRaftOrdering:
@@ -162,34 +796,146 @@ func (minter *minter) eventLoop(events event.Subscription) {
 			invalidBlock := ev.invalidBlock
 
 			minter.updateSpeculativeChainPerInvalidOrdering(headBlock, invalidBlock)
+
+		default:
+			// Only reachable if the subscription above changes without this
+			// switch following suit.
+			atomic.AddUint64(&minter.unexpectedEvents, 1)
+			glog.V(logger.Debug).Infof("Ignoring unexpected event of type %T", event.Data)
 		}
 	}
 }
 
 // Returns a wrapper around no-arg func `f` which can be called without limit
 // and returns immediately: this will call the underlying func `f` at most once
-// every `rate`. If this function is called more than once before the underlying
-// `f` is invoked (per this rate limiting), `f` will only be called *once*.
+// every period, as returned by `period` for each in turn. If this function is
+// called more than once before the underlying `f` is invoked (per this rate
+// limiting), `f` will only be called *once*.
+//
+// If `f` wasn't requested for a whole period, the next request is served
+// immediately and the period restarts from then; `wake`, if non-nil, is called
+// first. A value on `reset` signals that the period changed, in which case the
+// current period is cut short or extended accordingly.
 //
-// TODO(joel): this has a small bug in that you can't call it *immediately* when
-// first allocated.
-func throttle(rate time.Duration, f func()) func() {
+// The second func returned ends the throttling, waiting for any call of `f` in
+// progress. The wrapper mustn't be called afterwards.
+//
+// Throttling starts out idle, so the first request is served immediately.
+func throttle(period func() time.Duration, reset <-chan struct{}, wake func(), f func()) (func(), func()) {
 	request := channels.NewRingChannel(1)
+	quit := make(chan struct{})
+	done := make(chan struct{})
 
-	// every tick, block waiting for another request. then serve it immediately
+	// every period, block waiting for another request. then serve it immediately
 	go func() {
-		ticker := time.NewTicker(rate)
-		defer ticker.Stop()
+		var calls sync.WaitGroup
+		started := time.Now().Add(-period())
+		timer := time.NewTimer(0)
+		defer func() {
+			timer.Stop()
+			calls.Wait()
+			request.Close()
+			close(done)
+		}()
+
+		for {
+			select {
+			case <-timer.C:
+			case <-reset:
+				timer.Stop()
+				timer = time.NewTimer(period() - time.Since(started))
+				continue
+			case <-quit:
+				return
+			}
 
-		for range ticker.C {
-			<-request.Out()
-			go f()
+			select {
+			case <-request.Out():
+			case <-quit:
+				return
+			default:
+				// We're idle. The next period starts once we're woken up.
+				select {
+				case <-request.Out():
+				case <-quit:
+					return
+				}
+
+				if wake != nil {
+					wake()
+				}
+			}
+			started = time.Now()
+			timer.Reset(period())
+			calls.Add(1)
+			go func() {
+				defer calls.Done()
+				f()
+			}()
 		}
 	}()
 
-	return func() {
+	call := func() {
 		request.In() <- struct{}{}
 	}
+	stop := func() {
+		close(quit)
+		<-done
+	}
+	return call, stop
+}
+
+// Mints a block, if there's anything to mint, every time the trigger fires.
+func (minter *minter) triggeredMintingLoop(trigger <-chan struct{}) {
+	for {
+		select {
+		case _, ok := <-trigger:
+			if !ok {
+				return
+			}
+		case <-minter.quit:
+			return
+		}
+
+		epoch := atomic.LoadUint64(&minter.epoch)
+		if atomic.LoadInt32(&minter.minting) == 1 && minter.checkHealth() {
+			minter.mintNewBlockIn(epoch)
+		}
+	}
+}
+
+// Returns the time to wait before the next block may be minted: the block
+// time, varied at random by up to BlockTimeJitter either way.
+func (minter *minter) nextBlockTime() time.Duration {
+	blockTime := minter.currentBlockTime()
+	jitter := minter.currentSettings().BlockTimeJitter
+	if jitter <= 0 {
+		return blockTime
+	}
+	if jitter > maxBlockTimeJitter {
+		jitter = maxBlockTimeJitter
+	}
+	return time.Duration(float64(blockTime) * (1 + jitter*(2*rand.Float64()-1)))
+}
+
+func (minter *minter) currentBlockTime() time.Duration {
+	return time.Duration(atomic.LoadInt64(&minter.blockTime))
+}
+
+// Changes the block time, taking effect from the current period.
+func (minter *minter) setBlockTime(blockTime time.Duration) error {
+	if blockTime <= 0 {
+		return errInvalidBlockTime
+	}
+	atomic.StoreInt64(&minter.blockTime, int64(blockTime))
+	glog.V(logger.Info).Infof("Block time set to %v\n", blockTime)
+
+	select {
+	case minter.blockTimeChanged <- struct{}{}:
+	default:
+		// A change is already pending, which will pick this one up.
+	}
+	return nil
 }
 
 // This function spins continuously, blocking until a block should be created
@@ -198,67 +944,357 @@ func throttle(rate time.Duration, f func()) func() {
 //   1. A block is guaranteed to be minted within `blockTime` of being
 //      requested.
 //   2. We never mint a block more frequently than `blockTime`.
+//
+// If a Trigger is configured, it drives minting instead.
 func (minter *minter) mintingLoop() {
-	throttledMintNewBlock := throttle(minter.blockTime, func() {
-		if atomic.LoadInt32(&minter.minting) == 1 {
-			minter.mintNewBlock()
+	if trigger := minter.currentSettings().Trigger; trigger != nil {
+		minter.triggeredMintingLoop(trigger)
+		return
+	}
+
+	throttledMintNewBlock, stopThrottling := throttle(minter.nextBlockTime, minter.blockTimeChanged, minter.warmState, func() {
+		// Cleared before the round reads the pool, so that anything arriving
+		// from here on makes another request.
+		atomic.StoreInt32(&minter.eventRequested, 0)
+		epoch := atomic.LoadUint64(&minter.epoch)
+		if atomic.LoadInt32(&minter.minting) == 1 && minter.checkHealth() {
+			minter.mintNewBlockIn(epoch)
 		}
 	})
 
+	// Ends once close closes shouldMine.
 	for range minter.shouldMine.Out() {
 		throttledMintNewBlock()
 	}
+	stopThrottling()
 }
 
-func generateNanoTimestamp(parent *types.Block) (tstamp int64) {
-	parentTime := parent.Time().Int64()
-	tstamp = time.Now().UnixNano()
+// Reads the accounts of pending transactions from the state the next round
+// builds on, after a period without minting. This loads their trie nodes into
+// the database's caches outside of mu, so that a cold state doesn't hold up
+// the event loop's updates to the speculative chain.
+func (minter *minter) warmState() {
+	minter.mu.Lock()
+	head := minter.speculativeChain.head
+	minter.mu.Unlock()
 
-	if parentTime >= tstamp {
-		// Each successive block needs to be after its predecessor.
-		tstamp = parentTime + 1
+	publicState, _, err := minter.chain.StateAt(head.Root())
+	if err != nil {
+		glog.V(logger.Warn).Infof("Failed to warm state of block #%v: %v\n", head.Number(), err)
+		return
+	}
+	for addr := range minter.eth.TxPool().Pending() {
+		publicState.GetNonce(addr)
 	}
-
-	return
 }
 
-// Assumes mu is held.
-func (minter *minter) createWork() *work {
-	parent := minter.speculativeChain.head
-	parentNumber := parent.Number()
-	tstamp := generateNanoTimestamp(parent)
-
-	header := &types.Header{
-		ParentHash: parent.Hash(),
-		Number:     parentNumber.Add(parentNumber, common.Big1),
-		Difficulty: core.CalcDifficulty(minter.config, uint64(tstamp), parent.Time().Uint64(), parent.Number(), parent.Difficulty()),
-		GasLimit:   core.CalcGasLimit(parent),
-		GasUsed:    new(big.Int),
-		Coinbase:   minter.coinbase,
-		Time:       big.NewInt(tstamp),
+// Consults the configured health check, if any. Minting is paused while the
+// check fails, and a new round is requested as soon as it passes again.
+func (minter *minter) checkHealth() bool {
+	settings := minter.currentSettings()
+	if settings.HealthCheck == nil {
+		return true
 	}
 
-	publicState, privateState, err := minter.chain.StateAt(parent.Root())
-	if err != nil {
-		panic(fmt.Sprint("failed to get parent state: ", err))
+	if err := settings.HealthCheck(); err != nil {
+		if atomic.CompareAndSwapInt32(&minter.unhealthy, 0, 1) {
+			glog.V(logger.Warn).Infof("Health check failed, pausing minting: %v\n", err)
+		}
+		return false
 	}
 
-	return &work{
-		config:       minter.config,
-		publicState:  publicState,
-		privateState: privateState,
-		header:       header,
+	if atomic.CompareAndSwapInt32(&minter.unhealthy, 1, 0) {
+		glog.V(logger.Info).Infoln("Health check passed, resuming minting")
+
+		if atomic.LoadInt32(&minter.minting) == 1 && !minter.currentSettings().OnDemand {
+			minter.requestMinting()
+		}
 	}
+	return true
 }
 
-func (minter *minter) getTransactions() *types.TransactionsByPriceAndNonce {
-	allAddrTxes := minter.eth.TxPool().Pending()
-	addrTxes := minter.speculativeChain.withoutProposedTxes(allAddrTxes)
-	return types.NewTransactionsByPriceAndNonce(addrTxes)
+func (minter *minter) healthLoop() {
+	interval := minter.currentSettings().HealthCheckInterval
+	if interval <= 0 {
+		interval = defaultHealthCheckInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			minter.checkHealth()
+		case <-minter.quit:
+			return
+		}
+	}
+}
+
+// Requests minting every period, so that empty blocks are minted when due even
+// if nothing else requests minting.
+func (minter *minter) emptyBlockLoop(period time.Duration) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if atomic.LoadInt32(&minter.minting) == 1 && !minter.currentSettings().OnDemand {
+				minter.requestMinting()
+			}
+		case <-minter.quit:
+			return
+		}
+	}
+}
+
+// Reports whether the work should produce a block even without transactions,
+// because the empty block period has passed since its parent. Assumes mu is
+// held.
+func (minter *minter) emptyBlockDue(work *work) bool {
+	period := work.settings.EmptyBlockPeriod
+	if period <= 0 {
+		return false
+	}
+	parentTime := minter.speculativeChain.head.Time().Int64()
+	return work.header.Time.Int64()-parentTime >= int64(period)
+}
+
+func generateNanoTimestamp(clock Clock, parent *types.Block, minDelta time.Duration) (tstamp int64) {
+	parentTime := parent.Time().Int64()
+	tstamp = clock.Now().UnixNano()
+
+	if parentTime >= tstamp {
+		// Each successive block needs to be after its predecessor.
+		tstamp = parentTime + 1
+	}
+	if floor := parentTime + int64(minDelta); tstamp < floor {
+		// Some contracts assume a minimum amount of time between blocks.
+		tstamp = floor
+	}
+
+	return
+}
+
+// Warns if the given timestamp is further ahead of the clock than allowed,
+// returning errClockDrift if minting should wait for the clock to catch up.
+func checkClockDrift(settings *MinterConfig, tstamp int64) error {
+	if settings.MaxClockDrift <= 0 {
+		return nil
+	}
+	drift := time.Duration(tstamp - settings.clock().Now().UnixNano())
+	if drift <= settings.MaxClockDrift {
+		return nil
+	}
+	glog.V(logger.Warn).Infof("Block timestamp is %v ahead of the clock, more than the allowed %v: check the system clock\n", drift, settings.MaxClockDrift)
+	if settings.RefuseClockDrift {
+		return errClockDrift
+	}
+	return nil
+}
+
+// Creates the work of a round on the speculative head, or on the chain head if
+// the state of the former is missing. Assumes mu is held.
+func (minter *minter) createWork() (*work, error) {
+	settings := minter.currentSettings()
+	parent := minter.speculativeChain.head
+
+	tstamp := generateNanoTimestamp(settings.clock(), parent, settings.MinBlockTimeDelta)
+	if err := checkClockDrift(settings, tstamp); err != nil {
+		return nil, err
+	}
+	work, err := minter.createWorkAt(settings, parent, tstamp)
+	if _, missing := err.(*trie.MissingNodeError); missing {
+		// With state pruning, the state of a speculative head may be gone.
+		// That of the chain head should exist, so we fall back on it.
+		if current := minter.chain.CurrentBlock(); current.Hash() != parent.Hash() {
+			glog.V(logger.Warn).Infof("State of speculative head #%v %x is missing, probably pruned: resetting the speculative chain to head #%v %x\n", parent.Number(), parent.Hash(), current.Number(), current.Hash())
+			minter.speculativeChain.clear(current)
+			return minter.createWork()
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get parent state: %v", err)
+	}
+	return work, nil
+}
+
+// Assumes mu is held.
+func (minter *minter) createWorkAt(settings *MinterConfig, parent *types.Block, tstamp int64) (*work, error) {
+	header := minter.newHeader(settings, parent, tstamp)
+
+	publicState, privateState, err := minter.chain.StateAt(parent.Root())
+	if err != nil {
+		return nil, err
+	}
+
+	return &work{
+		config:       minter.config,
+		settings:     settings,
+		publicState:  publicState,
+		privateState: privateState,
+		header:       header,
+		parent:       parent.Header(),
+		gasPool:      new(core.GasPool).AddGas(header.GasLimit),
+		transferred:  new(big.Int),
+		minGasPrice:  minter.gasPriceFloor(settings),
+		round:        newRoundControl(),
+	}, nil
+}
+
+// Returns the header of a block on the given parent, before any transactions.
+func (minter *minter) newHeader(settings *MinterConfig, parent *types.Block, tstamp int64) *types.Header {
+	parentNumber := parent.Number()
+	number := parentNumber.Add(parentNumber, common.Big1)
+
+	return &types.Header{
+		ParentHash: parent.Hash(),
+		Number:     number,
+		Difficulty: core.CalcDifficulty(minter.config, uint64(tstamp), parent.Time().Uint64(), parent.Number(), parent.Difficulty()),
+		GasLimit:   minter.nextGasLimit(settings, parent),
+		GasUsed:    new(big.Int),
+		Coinbase:   settings.coinbaseAt(number, minter.coinbase),
+		Time:       big.NewInt(tstamp),
+		MixDigest:  settings.mixDigestAt(number),
+		Nonce:      settings.Nonce,
+	}
+}
+
+// Builds an empty block on the given parent without setting up a round: the
+// block reward is the only state change, so only the public state is needed.
+// The block is identical to that of a round without transactions.
+func (minter *minter) emptyBlock(settings *MinterConfig, parent *types.Block, tstamp int64) (*types.Block, error) {
+	publicState, err := state.New(parent.Root(), minter.chainDb)
+	if err != nil {
+		return nil, err
+	}
+	env := &work{
+		config:      minter.config,
+		settings:    settings,
+		publicState: publicState,
+		header:      minter.newHeader(settings, parent, tstamp),
+		parent:      parent.Header(),
+	}
+	return env.assembleBlock(nil, nil, nil, nil)
+}
+
+// Assumes mu is held.
+func (minter *minter) gasPriceFloor(settings *MinterConfig) *big.Int {
+	if settings.GasPriceFloor == nil {
+		return new(big.Int)
+	}
+
+	if floor := settings.GasPriceFloor(minter.averageFullness()); floor != nil {
+		return floor
+	}
+	return new(big.Int)
+}
+
+// Assumes mu is held.
+func (minter *minter) nextGasLimit(settings *MinterConfig, parent *types.Block) *big.Int {
+	if settings.GasLimit != 0 {
+		return boundGasLimit(parent.GasLimit(), new(big.Int).SetUint64(settings.GasLimit))
+	}
+	if settings.TargetUtilization <= 0 || settings.TargetUtilization > 1 || len(minter.recentFullness) == 0 {
+		return core.CalcGasLimit(parent)
+	}
+
+	return targetGasLimit(parent.GasLimit(), minter.averageFullness(), settings.TargetUtilization)
+}
+
+// Returns the average fullness of the recent rounds, or zero if none have been
+// recorded. Assumes mu is held.
+func (minter *minter) averageFullness() float64 {
+	if len(minter.recentFullness) == 0 {
+		return 0
+	}
+	var fullness float64
+	for _, f := range minter.recentFullness {
+		fullness += f
+	}
+	return fullness / float64(len(minter.recentFullness))
+}
+
+// Returns the gas limit following the given one which moves toward meeting the
+// target utilization, given the current fullness, as far as consensus allows.
+func targetGasLimit(parentLimit *big.Int, fullness, target float64) *big.Int {
+	desired, _ := new(big.Float).Mul(new(big.Float).SetInt(parentLimit), big.NewFloat(fullness/target)).Int(nil)
+	return boundGasLimit(parentLimit, desired)
+}
+
+// Returns the gas limit closest to the desired one which consensus allows
+// after the given one.
+func boundGasLimit(parentLimit, desired *big.Int) *big.Int {
+	// The limit may change by less than 1/GasLimitBoundDivisor of the parent's.
+	bound := new(big.Int).Div(parentLimit, params.GasLimitBoundDivisor)
+	bound.Sub(bound, common.Big1)
+
+	limit := common.BigMin(desired, new(big.Int).Add(parentLimit, bound))
+	limit = common.BigMax(limit, new(big.Int).Sub(parentLimit, bound))
+	return common.BigMax(limit, params.MinGasLimit)
+}
+
+// Records the fullness of a minting round for the gas price floor and the gas
+// limit target. Assumes mu is held.
+func (minter *minter) recordFullness(settings *MinterConfig, gasUsed, gasLimit *big.Int) {
+	if settings.GasPriceFloor == nil && settings.TargetUtilization <= 0 {
+		return
+	}
+
+	window := settings.FullnessWindow
+	if window <= 0 {
+		window = defaultFullnessWindow
+	}
+
+	fullness, _ := new(big.Rat).SetFrac(gasUsed, gasLimit).Float64()
+	minter.recentFullness = append(minter.recentFullness, fullness)
+	if len(minter.recentFullness) > window {
+		minter.recentFullness = minter.recentFullness[len(minter.recentFullness)-window:]
+	}
+}
+
+func (minter *minter) getTransactions() TxSource {
+	return orderTransactions(minter.currentSettings(), minter.pendingTransactions())
+}
+
+// Orders the given transactions per the configured TxSelector, applying
+// TxTransform to the result if it's set.
+func orderTransactions(settings *MinterConfig, addrTxes AddressTxes) TxSource {
+	txes := settings.txSelector().Select(addrTxes)
+	if settings.TxTransform == nil {
+		return txes
+	}
+	return newTxList(settings.TxTransform(drainTxSource(txes)))
+}
+
+// Reports whether the speculative chain is deep enough that the round should
+// leave the pool be. Each accepted block triggers another round, so the pool
+// is read again once raft catches up. Assumes mu is held.
+func (minter *minter) applyBackpressure(settings *MinterConfig) bool {
+	depth := minter.speculativeChain.unappliedBlocks.Size()
+	backpressured := settings.BackpressureDepth > 0 && depth >= settings.BackpressureDepth
+
+	if backpressured && !minter.backpressured {
+		glog.V(logger.Info).Infof("Not reading pending transactions while %d minted blocks await acceptance\n", depth)
+	} else if !backpressured && minter.backpressured {
+		glog.V(logger.Info).Infoln("Reading pending transactions again as raft caught up")
+	}
+	minter.backpressured = backpressured
+	return backpressured
+}
+
+// Returns the pending transactions of the pool which aren't in the speculative
+// chain yet. Reading the pool can't fail, so neither can this: a round never
+// aborts for want of transactions to consider.
+func (minter *minter) pendingTransactions() AddressTxes {
+	allAddrTxes := minter.eth.TxPool().Pending()
+	return minter.speculativeChain.withoutProposedTxes(allAddrTxes)
 }
 
 // Sends-off events asynchronously.
-func (minter *minter) firePendingBlockEvents(logs vm.Logs) {
+func (minter *minter) firePendingBlockEvents(settings *MinterConfig, block *types.Block, logs vm.Logs) {
 	// Copy logs before we mutate them, adding a block hash.
 	copiedLogs := make(vm.Logs, len(logs))
 	for i, l := range logs {
@@ -266,34 +1302,203 @@ func (minter *minter) firePendingBlockEvents(logs vm.Logs) {
 		*copiedLogs[i] = *l
 	}
 
-	go func() {
-		minter.mux.Post(core.PendingLogsEvent{Logs: copiedLogs})
-		minter.mux.Post(core.PendingStateEvent{})
-	}()
+	events := []interface{}{core.PendingLogsEvent{Logs: copiedLogs}}
+	if minter.schedulePendingState(settings.PendingStateInterval) {
+		events = append(events, core.PendingStateEvent{})
+	}
+	if settings.CompactPendingBlocks {
+		events = append(events, compactPendingBlock(block))
+	}
+
+	if !minter.queueEvents(events...) {
+		glog.V(logger.Warn).Infoln("Not posting pending events since too many rounds await posting")
+	}
 }
 
-func (minter *minter) mintNewBlock() {
-	minter.mu.Lock()
-	defer minter.mu.Unlock()
+// Queues events for the pending event worker, which posts them in the order
+// they were queued: posting blocks on subscribers, so it's left to a single
+// goroutine. The events are dropped if too many are queued already, which is
+// reported.
+func (minter *minter) queueEvents(events ...interface{}) bool {
+	select {
+	case minter.pendingEvents <- events:
+		return true
+	default:
+		return false
+	}
+}
 
-	work := minter.createWork()
-	transactions := minter.getTransactions()
+// Queues events which mustn't be dropped for the pending event worker, waiting
+// for room if need be, unless the minter is closed.
+func (minter *minter) queueEventsWait(events ...interface{}) {
+	select {
+	case minter.pendingEvents <- events:
+	case <-minter.quit:
+	}
+}
 
-	committedTxes, publicReceipts, privateReceipts, logs := work.commitTransactions(transactions, minter.chain)
-	txCount := len(committedTxes)
+func compactPendingBlock(block *types.Block) CompactPendingBlockEvent {
+	txHashes := make([]common.Hash, len(block.Transactions()))
+	for i, tx := range block.Transactions() {
+		txHashes[i] = tx.Hash()
+	}
+	return CompactPendingBlockEvent{Header: block.Header(), TxHashes: txHashes}
+}
 
-	if txCount == 0 {
-		glog.V(logger.Info).Infoln("Not minting a new block since there are no pending transactions")
+func (minter *minter) pendingEventLoop() {
+	for {
+		select {
+		case events := <-minter.pendingEvents:
+			for _, ev := range events {
+				minter.mux.Post(ev)
+			}
+		case <-minter.quit:
+			return
+		}
+	}
+}
+
+// Reports whether a PendingStateEvent may be posted right away. If not, one
+// is posted as soon as the interval since the last has elapsed, unless that's
+// already scheduled.
+func (minter *minter) schedulePendingState(interval time.Duration) bool {
+	minter.pendingStateMu.Lock()
+	defer minter.pendingStateMu.Unlock()
+
+	elapsed := time.Since(minter.lastPendingState)
+	if elapsed >= interval && minter.pendingStateTimer == nil {
+		minter.lastPendingState = time.Now()
+		return true
+	}
+	if minter.pendingStateTimer == nil {
+		minter.pendingStateTimer = time.AfterFunc(interval-elapsed, func() {
+			minter.pendingStateMu.Lock()
+			minter.pendingStateTimer = nil
+			minter.lastPendingState = time.Now()
+			minter.pendingStateMu.Unlock()
+
+			if !minter.queueEvents(core.PendingStateEvent{}) {
+				glog.V(logger.Warn).Infoln("Not posting the pending state since too many rounds await posting")
+			}
+		})
+	}
+	return false
+}
+
+// Cancels the coalesced PendingStateEvent which is due, if any.
+func (minter *minter) cancelPendingState() {
+	minter.pendingStateMu.Lock()
+	defer minter.pendingStateMu.Unlock()
+
+	if minter.pendingStateTimer != nil {
+		minter.pendingStateTimer.Stop()
+		minter.pendingStateTimer = nil
+	}
+}
+
+// Execution failures of a transaction in consecutive rounds, along with the
+// state of its sender after the last.
+type txFailures struct {
+	count   int
+	nonce   uint64
+	balance *big.Int
+}
+
+// Counts the consecutive failures of the transactions which failed in the
+// round, returning those to drop for having failed too many times. A
+// transaction's count restarts whenever its sender's state changes, since it
+// might then succeed. Assumes mu is held.
+func (minter *minter) countFailures(work *work) []*TxDroppedEvent {
+	var dropped []*TxDroppedEvent
+
+	failures := make(map[common.Hash]*txFailures, len(work.failed))
+	for _, failed := range work.failed {
+		from, err := failed.Tx.From()
+		if err != nil {
+			continue
+		}
+		current := &txFailures{
+			count:   1,
+			nonce:   work.publicState.GetNonce(from),
+			balance: work.publicState.GetBalance(from),
+		}
+		if last, ok := minter.txFailures[failed.Tx.Hash()]; ok && last.nonce == current.nonce && last.balance.Cmp(current.balance) == 0 {
+			current.count = last.count + 1
+		}
+
+		if max := work.settings.MaxTxFailures; max > 0 && current.count >= max {
+			reason := fmt.Errorf("failed in %d consecutive rounds, last with: %v", current.count, failed.Reason)
+			dropped = append(dropped, &TxDroppedEvent{Tx: failed.Tx, Reason: reason})
+			for i := range work.skipped {
+				if work.skipped[i].Tx == failed.Tx {
+					work.skipped[i].Dropped = true
+				}
+			}
+			continue
+		}
+		failures[failed.Tx.Hash()] = current
+	}
+	minter.txFailures = failures
+
+	return dropped
+}
+
+// Removes transactions which can never be minted from the pool, so that we
+// don't retry them every round. Events are sent-off asynchronously, by the
+// pending event worker.
+func (minter *minter) dropTransactions(dropped []*TxDroppedEvent) {
+	if len(dropped) == 0 {
 		return
 	}
+	events := make([]interface{}, len(dropped))
+	for i, ev := range dropped {
+		glog.V(logger.Warn).Infof("Dropping TX (%x): %v\n", ev.Tx.Hash().Bytes()[:4], ev.Reason)
 
-	minter.firePendingBlockEvents(logs)
+		minter.eth.TxPool().Remove(ev.Tx.Hash())
+		events[i] = *ev
+	}
 
-	header := work.header
+	if !minter.queueEvents(events...) {
+		glog.V(logger.Warn).Infoln("Not posting dropped transactions since too many rounds await posting")
+	}
+}
+
+// Credits the block reward configured for the chain to the coinbase; none at
+// all if it's zero. If VerifyRewards is set, this
+// returns an error if any other account was modified, which would mean the
+// rewards logic changed upstream.
+func (env *work) accumulateRewards() error {
+	accumulateRewards := env.settings.rewardAccumulator()
+	if !env.settings.VerifyRewards {
+		accumulateRewards(env.config, env.publicState, env.header, nil)
+		return nil
+	}
+
+	expected := env.publicState.Copy()
+	accumulateRewards(env.config, env.publicState, env.header, nil)
+
+	// Apply whatever happened to the coinbase to the copy, so that the roots
+	// only differ if some other account was modified.
+	coinbase := env.header.Coinbase
+	expected.SetBalance(coinbase, env.publicState.GetBalance(coinbase))
+	expected.SetNonce(coinbase, env.publicState.GetNonce(coinbase))
+	if expected.IntermediateRoot() != env.publicState.IntermediateRoot() {
+		return fmt.Errorf("block rewards modified accounts other than the coinbase %x", coinbase)
+	}
+	return nil
+}
+
+// Seals the header of the work and assembles the block, once all of its
+// transactions have been committed. Returns an error if the block isn't one
+// raft would accept.
+func (env *work) assembleBlock(txes types.Transactions, publicReceipts, privateReceipts types.Receipts, logs vm.Logs) (*types.Block, error) {
+	header := env.header
 
 	// commit state root after all state transitions.
-	core.AccumulateRewards(work.publicState, header, nil)
-	header.Root = work.publicState.IntermediateRoot()
+	if err := env.accumulateRewards(); err != nil {
+		glog.Errorf("Unexpected state change in block #%v: %v\n", header.Number, err)
+	}
+	header.Root = env.publicState.IntermediateRoot()
 
 	// NOTE: < QuorumChain creates a signature here and puts it in header.Extra. >
 
@@ -307,52 +1512,508 @@ func (minter *minter) mintNewBlock() {
 		l.BlockHash = headerHash
 	}
 
-	block := types.NewBlock(header, committedTxes, nil, publicReceipts)
+	block := types.NewBlock(header, txes, nil, publicReceipts)
+	if err := ensureNoUncles(block); err != nil {
+		return nil, err
+	}
+	if err := ensureDifficulty(env.config, env.parent, block); err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+// Raft has no forks, so uncles are meaningless in its blocks. Minting one with
+// uncles is a bug, which we refuse to propagate.
+func ensureNoUncles(block *types.Block) error {
+	if len(block.Uncles()) != 0 || block.UncleHash() != types.EmptyUncleHash {
+		return fmt.Errorf("raft block %x has %d uncles", block.Hash(), len(block.Uncles()))
+	}
+	return nil
+}
+
+// Nothing is mined under raft, but verifiers still check that the difficulty
+// of a block follows from its timestamp and parent. Minting one with another
+// difficulty is a bug, which we refuse to propagate.
+func ensureDifficulty(config *core.ChainConfig, parent *types.Header, block *types.Block) error {
+	expected := core.CalcDifficulty(config, block.Time().Uint64(), parent.Time.Uint64(), parent.Number, parent.Difficulty)
+	if block.Difficulty().Cmp(expected) != 0 {
+		return fmt.Errorf("raft block %x has difficulty %v, expected %v", block.Hash(), block.Difficulty(), expected)
+	}
+	return nil
+}
+
+// Builds a block on the given parent from exactly the given transactions,
+// leaving the pool, the speculative chain and the database untouched, and
+// posting no events. The timestamp is derived from the parent's rather than
+// the clock, so the same inputs always give the same block. This is meant for
+// testing block assembly. Empty blocks, such as heartbeats, skip setting up a
+// round.
+func (minter *minter) mintExplicit(parent *types.Block, txes types.Transactions) (*types.Block, types.Receipts, types.Receipts, error) {
+	minter.mu.Lock()
+	defer minter.mu.Unlock()
+
+	settings := minter.currentSettings()
+	tstamp := parent.Time().Int64() + 1
+	if minDelta := int64(settings.MinBlockTimeDelta); minDelta > 1 {
+		tstamp = parent.Time().Int64() + minDelta
+	}
+
+	if len(txes) == 0 {
+		block, err := minter.emptyBlock(settings, parent, tstamp)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to get parent state: %v", err)
+		}
+		return block, nil, nil, nil
+	}
+
+	work, err := minter.createWorkAt(settings, parent, tstamp)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to get parent state: %v", err)
+	}
+
+	var (
+		publicReceipts  types.Receipts
+		privateReceipts types.Receipts
+		logs            vm.Logs
+	)
+	for i, tx := range txes {
+		work.publicState.StartRecord(tx.Hash(), common.Hash{}, 0)
+
+		publicReceipt, privateReceipt, err := work.commitTransaction(tx, minter.chain, work.gasPool)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("transaction %d (%x) failed: %v", i, tx.Hash(), err)
+		}
+
+		logs = append(logs, publicReceipt.Logs...)
+		publicReceipts = append(publicReceipts, publicReceipt)
+		if privateReceipt != nil {
+			logs = append(logs, privateReceipt.Logs...)
+			privateReceipts = append(privateReceipts, privateReceipt)
+		}
+	}
+
+	block, err := work.assembleBlock(txes, publicReceipts, privateReceipts, logs)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return block, publicReceipts, privateReceipts, nil
+}
+
+// BlockEstimate describes the block the minter would mint next.
+type BlockEstimate struct {
+	Transactions []common.Hash `json:"transactions"`
+	GasUsed      *big.Int      `json:"gasUsed"`
+	Full         bool          `json:"full"`     // whether transactions were deferred for lack of gas
+	Rejected     []RejectedTx  `json:"rejected"` // pending transactions which would be left out
+}
+
+// RejectedTx describes a pending transaction which a round would leave out.
+type RejectedTx struct {
+	Hash    common.Hash `json:"hash"`
+	Reason  string      `json:"reason"`
+	Dropped bool        `json:"dropped"` // whether it would be removed from the pool
+}
+
+// Dry-runs a round over the pending transactions, on top of the speculative
+// chain, without committing anything or posting events. Submitted batches
+// and bundles aren't taken into account.
+func (minter *minter) estimateNextBlock() (*BlockEstimate, error) {
+	minter.mu.Lock()
+	defer minter.mu.Unlock()
+
+	// Hooks shouldn't observe rounds which aren't minted.
+	settings := *minter.currentSettings()
+	settings.OnBlockFull = nil
+	settings.WorkDecorator = nil
+
+	parent := minter.speculativeChain.head
+	work, err := minter.createWorkAt(&settings, parent, generateNanoTimestamp(settings.clock(), parent, settings.MinBlockTimeDelta))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get parent state: %v", err)
+	}
+	committedTxes, _, _, _ := work.commitTransactions(minter.getTransactions(), minter.chain)
+
+	estimate := &BlockEstimate{
+		Transactions: make([]common.Hash, len(committedTxes)),
+		GasUsed:      work.header.GasUsed,
+	}
+	for i, tx := range committedTxes {
+		estimate.Transactions[i] = tx.Hash()
+	}
+	for _, skipped := range work.skipped {
+		if skipped.Reason == errBlockFull {
+			estimate.Full = true
+		}
+		estimate.Rejected = append(estimate.Rejected, RejectedTx{
+			Hash:    skipped.Tx.Hash(),
+			Reason:  skipped.Reason.Error(),
+			Dropped: skipped.Dropped,
+		})
+	}
+	return estimate, nil
+}
+
+// Sends-off the summary of a round asynchronously, after its pending events.
+func (minter *minter) fireRoundSummary(blockHash common.Hash, committed types.Transactions, skipped []SkippedTx) {
+	summary := RoundSummaryEvent{
+		BlockHash: blockHash,
+		Committed: committed,
+		Skipped:   skipped,
+	}
+	if !minter.queueEvents(summary) {
+		glog.V(logger.Warn).Infoln("Not posting the round summary since too many rounds await posting")
+	}
+}
+
+// Returns the minted block, or nil if no block was minted. Database errors
+// abort the round without extending the speculative chain, so that the next
+// minting request retries.
+func (minter *minter) mintNewBlock() *types.Block {
+	block, _ := minter.mintNewBlockSync()
+	return block
+}
+
+// Mints a block right away, bypassing the minting loop and its throttle as well
+// as the checks of forceMint, and returns it or why none was minted. Otherwise
+// the round is exactly that of the minting loop, which makes this the entry
+// point for testing what minting does.
+func (minter *minter) mintNewBlockSync() (*types.Block, error) {
+	return minter.mintNewBlockIn(atomic.LoadUint64(&minter.epoch))
+}
 
-	glog.V(logger.Info).Infof("Generated next block #%v with [%d txns]", block.Number(), txCount)
+// Mints a block in the given epoch, read before deciding to mint, returning
+// why none was minted otherwise. If the minter has been stopped since, nothing
+// is minted: stop() has reset the speculative chain, which the round must not
+// extend afterwards.
+func (minter *minter) mintNewBlockIn(epoch uint64) (*types.Block, error) {
+	minter.yieldToChainUpdates()
+	minter.mu.Lock()
+	defer minter.mu.Unlock()
 
-	if _, err := work.publicState.Commit(); err != nil {
-		panic(fmt.Sprint("error committing public state: ", err))
+	if atomic.LoadUint64(&minter.epoch) != epoch {
+		glog.V(logger.Info).Infoln("Not minting a new block since minting was stopped")
+		return nil, errNotMinting
 	}
-	if _, privStateErr := work.privateState.Commit(); privStateErr != nil {
-		panic(fmt.Sprint("error committing private state: ", privStateErr))
+
+	if atomic.LoadInt32(&minter.diverged) == 1 {
+		glog.V(logger.Warn).Infoln("Not minting a new block since minting is paused after a state root mismatch or an invalid block")
+		return nil, errDiverged
 	}
 
+	// Each accepted block triggers another round, so minting resumes once
+	// raft catches up.
+	if pending, max := minter.speculativeChain.unappliedBlocks.Size(), minter.currentSettings().maxSpeculativeBlocks(); pending >= max {
+		glog.V(logger.Warn).Infof("Not minting a new block since %d minted blocks await acceptance (limit %d)\n", pending, max)
+		minter.metrics.full.Mark(1)
+		return nil, errSpeculativeChainFull
+	}
+
+	atomic.StoreUint32(&minter.coalesced, atomic.SwapUint32(&minter.pendingRequests, 0))
+
+	var timings BlockTimings
+	start := time.Now()
+
+	span := minter.currentSettings().startSpan("createWork")
+	work, err := minter.createWork()
+	if err != nil {
+		span.SetAttribute("error", err.Error())
+		span.Finish()
+		glog.V(logger.Error).Infof("Not minting a new block: %v\n", err)
+		return nil, err
+	}
+	span.SetAttribute("number", work.header.Number.Uint64())
+	span.Finish()
+	work.bundles = minter.bundles
+	if next := minter.speculativeChain.unappliedBlocks.First(); next != nil {
+		work.round.expectHead(next.(*types.Block).Hash())
+	}
+	minter.setCurrentRound(work.round)
+	defer minter.setCurrentRound(nil)
+	timings.StateFetch = time.Since(start)
+
+	packingStart := time.Now()
+	decorated := work.decorate(minter.chain)
+
+	// Submitted batches go next, in submission order, ahead of the pool.
+	batches, deferredBatches, batchTxes, batchPublicReceipts, batchPrivateReceipts, batchLogs, err := work.commitBatches(minter.batches, minter.chain)
+	minter.batches = deferredBatches
+	if err != nil {
+		glog.V(logger.Warn).Infof("Not minting a new block: %v\n", err)
+		return nil, err
+	}
+	committedTxes := append(decorated.txes, batchTxes...)
+	publicReceipts := append(decorated.publicReceipts, batchPublicReceipts...)
+	privateReceipts := append(decorated.privateReceipts, batchPrivateReceipts...)
+	logs := append(decorated.logs, batchLogs...)
+
+	span = work.settings.startSpan("getTransactions")
+	var addrTxes AddressTxes
+	if minter.applyBackpressure(work.settings) {
+		minter.metrics.backoffs.Mark(1)
+	} else {
+		addrTxes = minter.pendingTransactions()
+		minter.metrics.poolReads.Mark(1)
+	}
+	if work.settings.PrefetchPrivatePayloads && private.P != nil {
+		prefetchPrivatePayloads(private.P, addrTxes)
+	}
+	span.SetAttribute("txs", addrTxes.count())
+	transactions := orderTransactions(work.settings, addrTxes)
+	span.Finish()
+
+	span = work.settings.startSpan("commitTransactions")
+	poolTxes, poolPublicReceipts, poolPrivateReceipts, poolLogs := work.commitTransactions(transactions, minter.chain)
+	span.SetAttribute("txs", len(poolTxes))
+	span.SetAttribute("skipped", len(work.skipped))
+	span.Finish()
+	timings.Packing = time.Since(packingStart)
+
+	if work.round.isCancelled() {
+		glog.V(logger.Warn).Infoln("Not minting a new block since the round was cancelled")
+		resolveBatches(batches, errRoundCancelled)
+		return nil, errRoundCancelled
+	}
+
+	minter.recordFailures(work, addrTxes)
+	work.dropped = append(work.dropped, minter.countFailures(work)...)
+	minter.dropTransactions(work.dropped)
+	minter.metrics.failed.Mark(int64(len(work.failed)))
+	minter.metrics.dropped.Mark(int64(len(work.dropped)))
+
+	committedTxes = append(committedTxes, poolTxes...)
+	publicReceipts = append(publicReceipts, poolPublicReceipts...)
+	privateReceipts = append(privateReceipts, poolPrivateReceipts...)
+	logs = append(logs, poolLogs...)
+	txCount := len(committedTxes)
+
+	// Every bundle was either committed, failed or left out for the
+	// transaction cap. If the round is aborted from here on, the committed
+	// ones can't be minted anymore either.
+	minter.bundles = work.bundles
+
+	if txCount == 0 && !minter.emptyBlockDue(work) {
+		glog.V(logger.Info).Infoln("Not minting a new block since there are no pending transactions")
+		minter.metrics.emptySkips.Mark(1)
+		minter.recordFullness(work.settings, work.header.GasUsed, work.header.GasLimit)
+		minter.fireRoundSummary(common.Hash{}, nil, work.skipped)
+		return nil, errNothingToMint
+	}
+
+	header := work.header
+	rewardStart := time.Now()
+	block, err := work.assembleBlock(committedTxes, publicReceipts, privateReceipts, logs)
+	timings.Reward = time.Since(rewardStart)
+	if err != nil {
+		// Every block after this one would be invalid for the same reason,
+		// so minting stops until an operator looks into it.
+		glog.V(logger.Error).Infof("Pausing minting: block #%v is invalid: %v\n", header.Number, err)
+		atomic.StoreInt32(&minter.diverged, 1)
+		resolveBatches(batches, err)
+		minter.fireRoundSummary(common.Hash{}, nil, work.skipped)
+		return nil, err
+	}
+
+	if minter.reminting > 0 && work.settings.VerifyReorgRoots {
+		if err := minter.verifyStateRoot(work.settings, minter.speculativeChain.head, block); err != nil {
+			glog.V(logger.Error).Infof("Pausing minting: block #%v minted after an unwind doesn't re-execute consistently: %v\n", block.Number(), err)
+			atomic.StoreInt32(&minter.diverged, 1)
+			resolveBatches(batches, err)
+			minter.fireRoundSummary(common.Hash{}, nil, work.skipped)
+			return nil, err
+		}
+		minter.reminting--
+	}
+
+	if minter.chain.HasBlock(block.Hash()) {
+		// Identical inputs reproduced a block the chain already has, so
+		// proposing it would only post a duplicate.
+		glog.V(logger.Warn).Infof("Not proposing block %x, which is already known\n", block.Hash())
+		resolveBatches(batches, errKnownBlock)
+		minter.fireRoundSummary(common.Hash{}, nil, work.skipped)
+		return nil, errKnownBlock
+	}
+
+	commitStart := time.Now()
+	span = work.settings.startSpan("commitState")
+	span.SetAttribute("txs", txCount)
+	err = work.commit()
+	span.Finish()
+	if err != nil {
+		glog.V(logger.Error).Infof("Not minting block #%v: %v\n", block.Number(), err)
+		resolveBatches(batches, err)
+		minter.fireRoundSummary(common.Hash{}, nil, work.skipped)
+		return nil, err
+	}
+	timings.Commit = time.Since(commitStart)
+	minter.checkCommitDuration(work.settings, timings.Commit)
+
+	minter.firePendingBlockEvents(work.settings, block, logs)
+
+	// Private transactions also have a public receipt, so only they have one
+	// of each.
+	privateTxCount := len(privateReceipts)
+	glog.V(logger.Info).Infof("Generated next block #%v with [%d txns, %d private]", block.Number(), txCount, privateTxCount)
+
 	minter.speculativeChain.extend(block)
+	atomic.AddUint64(&minter.blocksMinted, 1)
+	atomic.AddUint64(&minter.txesCommitted, uint64(txCount))
+	minter.recordMint(block)
+
+	if minter.receiptCache != nil {
+		minter.receiptCache.Add(block.Hash(), &MintedReceipts{Public: publicReceipts, Private: privateReceipts})
+	}
 
 	minter.mux.Post(core.NewMinedBlockEvent{Block: block})
+	minter.exportBlock(work.settings, block)
+
+	minter.metrics.markGasPrices(&work.gasPrices)
+	minter.metrics.markContractUsage(work.contractUsage)
+	minter.lastGasPrices = work.gasPrices
+	minter.recordFullness(work.settings, header.GasUsed, header.GasLimit)
+
+	resolveBatches(batches, nil)
+	minter.fireRoundSummary(block.Hash(), committedTxes, work.skipped)
+
+	timings.Total = time.Since(start)
+	minter.blockTimings.Add(block.Hash(), &timings)
+	minter.activity.minted(work.settings)
+
+	if work.capped && !work.settings.OnDemand {
+		// Mint the transactions left out right away, rather than waiting for
+		// the next chain event.
+		minter.requestMinting()
+	}
 
+	// The timestamp may be ahead of the clock, which makes no sense as latency.
 	elapsed := time.Since(time.Unix(0, header.Time.Int64()))
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	minter.latencies.add(elapsed)
+	minter.metrics.blocks.Mark(1)
+	minter.metrics.txes.Mark(int64(txCount))
+	minter.metrics.privateTxes.Mark(int64(privateTxCount))
+	minter.metrics.publicTxes.Mark(int64(txCount - privateTxCount))
+	minter.metrics.elapsed.Update(elapsed)
 	glog.V(logger.Info).Infof("🔨  Mined block (#%v / %x) in %v", block.Number(), block.Hash().Bytes()[:4], elapsed)
+
+	return block, nil
+}
+
+// Writes the public and private states of the block to the database. They're
+// independent tries, so they're committed concurrently, and the work is
+// committed only if both are.
+func (env *work) commit() error {
+	var privateErr error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, privateErr = env.privateState.Commit()
+	}()
+	_, publicErr := env.publicState.Commit()
+	<-done
+
+	if publicErr != nil {
+		return fmt.Errorf("error committing public state: %v", publicErr)
+	}
+	if privateErr != nil {
+		return fmt.Errorf("error committing private state: %v", privateErr)
+	}
+	return nil
 }
 
-func (env *work) commitTransactions(txes *types.TransactionsByPriceAndNonce, bc *core.BlockChain) (types.Transactions, types.Receipts, types.Receipts, vm.Logs) {
+func (env *work) commitTransactions(txes TxSource, bc *core.BlockChain) (types.Transactions, types.Receipts, types.Receipts, vm.Logs) {
 	var logs vm.Logs
 	var committedTxes types.Transactions
 	var publicReceipts types.Receipts
 	var privateReceipts types.Receipts
 
-	gp := new(core.GasPool).AddGas(env.header.GasLimit)
-	txCount := 0
+	gasDeferred := 0
+
+	defer env.holdReserve()()
+
+	// Bundles go first, each committed atomically.
+	committedTxes, publicReceipts, privateReceipts, logs = env.commitBundles(bc)
+
+	gp := env.gasPool
 
 	for {
 		tx := txes.Peek()
-		if tx == nil {
+		if tx == nil || env.round.isCancelled() {
+			break
+		}
+
+		if env.exceedsTxCap(1) {
+			if glog.V(logger.Detail) {
+				glog.Infof("Block transaction cap reached, deferring the remaining txes\n")
+			}
+			for ; tx != nil; tx = txes.Peek() {
+				env.skip(tx, errTxCapReached, false)
+				txes.Pop() // skip rest of txes from this account
+			}
+			env.capped = true
+			break
+		}
+
+		if (*big.Int)(gp).Cmp(params.TxGas) < 0 {
+			// Not even a plain transfer fits anymore.
+			if glog.V(logger.Detail) {
+				glog.Infof("Block gas limit reached, deferring the remaining txes\n")
+			}
+			for ; tx != nil; tx = txes.Peek() {
+				env.skip(tx, errBlockFull, false)
+				gasDeferred++
+				txes.Pop() // skip rest of txes from this account
+			}
 			break
 		}
 
+		if drop, err := env.checkTransaction(tx); err != nil {
+			if glog.V(logger.Detail) {
+				if drop {
+					glog.Infof("TX (%x) can never be committed, dropping: %v\n", tx.Hash().Bytes()[:4], err)
+				} else {
+					glog.Infof("TX (%x) can't be committed, skipping: %v\n", tx.Hash().Bytes()[:4], err)
+				}
+			}
+			env.skip(tx, err, drop)
+			txes.Pop() // skip rest of txes from this account
+			continue
+		}
+
 		env.publicState.StartRecord(tx.Hash(), common.Hash{}, 0)
 
 		publicReceipt, privateReceipt, err := env.commitTransaction(tx, bc, gp)
 		switch {
+		case core.IsGasLimitErr(err):
+			if glog.V(logger.Detail) {
+				glog.Infof("TX (%x) doesn't fit in the remaining gas, deferring\n", tx.Hash().Bytes()[:4])
+			}
+			env.skip(tx, errBlockFull, false)
+			gasDeferred++
+			txes.Pop() // skip rest of txes from this account
+		case isNonceGapErr(err):
+			if glog.V(logger.Detail) {
+				glog.Infof("TX (%x) is ahead of its sender's nonce, deferring\n", tx.Hash().Bytes()[:4])
+			}
+			env.skip(tx, err, false)
+			txes.Pop() // skip rest of txes from this account
+		case isTerminalTxErr(err):
+			if glog.V(logger.Detail) {
+				glog.Infof("TX (%x) can never be minted, dropping: %v\n", tx.Hash().Bytes()[:4], err)
+			}
+			env.skip(tx, err, true)
+			txes.Pop() // skip rest of txes from this account
 		case err != nil:
 			if glog.V(logger.Detail) {
 				glog.Infof("TX (%x) failed, will be removed: %v\n", tx.Hash().Bytes()[:4], err)
 			}
+			env.skip(tx, err, false)
+			env.failed = append(env.failed, SkippedTx{Tx: tx, Reason: err})
 			txes.Pop() // skip rest of txes from this account
 		default:
-			txCount++
 			committedTxes = append(committedTxes, tx)
+			env.account(tx, publicReceipt)
 
 			logs = append(logs, publicReceipt.Logs...)
 			publicReceipts = append(publicReceipts, publicReceipt)
@@ -366,14 +2027,271 @@ func (env *work) commitTransactions(txes *types.TransactionsByPriceAndNonce, bc
 		}
 	}
 
+	if gasDeferred > 0 && env.settings.OnBlockFull != nil {
+		env.settings.OnBlockFull(gasDeferred)
+	}
+
 	return committedTxes, publicReceipts, privateReceipts, logs
 }
 
+// Reports whether a transaction failed for being ahead of its sender's nonce,
+// in which case it may be minted once the transactions before it arrive.
+func isNonceGapErr(err error) bool {
+	nonceErr, ok := err.(*core.NonceErr)
+	return ok && nonceErr.Is > nonceErr.Exp
+}
+
+// Reports whether a transaction failed in a way no later round can fix: its
+// nonce has been used already, or its gas doesn't even cover the intrinsic gas.
+func isTerminalTxErr(err error) bool {
+	switch err := err.(type) {
+	case *core.NonceErr:
+		return err.Is < err.Exp
+	case *core.InvalidTxErr:
+		return err.Message == vm.OutOfGasError.Error()
+	}
+	return false
+}
+
+func (env *work) recordContractUsage(addr common.Address, gasUsed *big.Int) {
+	if env.contractUsage == nil {
+		env.contractUsage = make(map[common.Address]*contractUsage)
+	}
+	usage, ok := env.contractUsage[addr]
+	if !ok {
+		usage = new(contractUsage)
+		env.contractUsage[addr] = usage
+	}
+	usage.gas += gasUsed.Uint64()
+	usage.txes++
+}
+
+// Copies recorded contract usage, so that it can be restored when a batch is
+// reverted.
+func copyContractUsage(usage map[common.Address]*contractUsage) map[common.Address]*contractUsage {
+	if usage == nil {
+		return nil
+	}
+	cpy := make(map[common.Address]*contractUsage, len(usage))
+	for addr, u := range usage {
+		u := *u
+		cpy[addr] = &u
+	}
+	return cpy
+}
+
+// Records a transaction left out of the round. Dropped transactions are also
+// removed from the pool once the round is over.
+func (env *work) skip(tx *types.Transaction, reason error, dropped bool) {
+	env.skipped = append(env.skipped, SkippedTx{Tx: tx, Reason: reason, Dropped: dropped})
+	if dropped {
+		env.dropped = append(env.dropped, &TxDroppedEvent{Tx: tx, Reason: reason})
+	}
+}
+
+// Checks a transaction against the settings and the state of the round before
+// it's executed, returning why it can't be committed, if so, and whether it
+// never can, in which case it's to be dropped. Pool transactions, batches and
+// bundles are all subject to these.
+func (env *work) checkTransaction(tx *types.Transaction) (bool, error) {
+	switch {
+	case !env.settings.allowsTarget(tx.To()):
+		return false, errNotAllowlisted
+	case env.exceedsDataLimit(tx):
+		return true, errTxDataTooLarge
+	case tx.Gas().Cmp(env.header.GasLimit) > 0:
+		// It could never fit, and would otherwise fail every round.
+		return true, errExceedsGasLimit
+	}
+	if err := env.checkContractSender(tx); err != nil {
+		return true, err
+	}
+	switch {
+	case env.settings.DropCollidingCreations && env.createsOverExistingCode(tx):
+		return true, errCreationCollision
+	case tx.GasPrice().Cmp(env.minGasPrice) < 0:
+		return false, errBelowPriceFloor
+	case env.exceedsValueCap(tx):
+		return false, errExceedsValueCap
+	case env.exceedsPayloadLimit(tx):
+		return env.settings.DropOversizedPrivate, errPayloadTooLarge
+	case !env.satisfiesStatePredicate(tx):
+		return false, errRejectedByState
+	}
+	return false, nil
+}
+
+// Accounts for a committed transaction in the totals of the round.
+func (env *work) account(tx *types.Transaction, publicReceipt *types.Receipt) {
+	env.txCount++
+	env.gasPrices.add(tx.GasPrice())
+	env.transferred.Add(env.transferred, tx.Value())
+	if env.settings.watches(tx.To()) {
+		env.recordContractUsage(*tx.To(), publicReceipt.GasUsed)
+	}
+}
+
+// Holds back the reserved gas, so that no transaction can use it, until the
+// returned function is called. Reverted batches replace the gas pool, so it's
+// returned to whichever is current by then.
+func (env *work) holdReserve() func() {
+	reserve := new(big.Int).SetUint64(env.settings.ReserveFreeGas)
+	if (*big.Int)(env.gasPool).Cmp(reserve) < 0 {
+		reserve.Set((*big.Int)(env.gasPool))
+	}
+	env.gasPool.SubGas(reserve)
+	return func() { env.gasPool.AddGas(reserve) }
+}
+
+// Reports whether committing n more transactions would exceed the configured
+// transaction cap, counting those committed so far by any means.
+func (env *work) exceedsTxCap(n int) bool {
+	max := env.settings.MaxTxsPerBlock
+	return max > 0 && env.txCount+n > max
+}
+
+// Reports whether the configured state predicate, if any, admits the
+// transaction against the current public state.
+func (env *work) satisfiesStatePredicate(tx *types.Transaction) bool {
+	return env.settings.TxStatePredicate == nil || env.settings.TxStatePredicate(tx, env.publicState)
+}
+
+// Reports whether including the transaction would take the total value
+// transferred by the block over the configured cap.
+func (env *work) exceedsValueCap(tx *types.Transaction) bool {
+	if env.settings.MaxBlockValue == nil || tx.Value().Sign() == 0 {
+		return false
+	}
+	total := new(big.Int).Add(env.transferred, tx.Value())
+	return total.Cmp(env.settings.MaxBlockValue) > 0
+}
+
+// Fetches the payloads of the given private transactions concurrently, rather
+// than one at a time as they're executed. The transaction manager caches them,
+// so execution then doesn't need to wait on it.
+func prefetchPrivatePayloads(ptm private.PrivateTransactionManager, addrTxes AddressTxes) {
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, maxPayloadPrefetches)
+	for _, txes := range addrTxes {
+		for _, tx := range txes {
+			if !tx.IsPrivate() {
+				continue
+			}
+			wg.Add(1)
+			slots <- struct{}{}
+			go func(data []byte) {
+				defer func() { <-slots; wg.Done() }()
+				ptm.Receive(data)
+			}(tx.Data())
+		}
+	}
+	wg.Wait()
+}
+
+// Reports whether the input data of the transaction is over the configured
+// limit.
+func (env *work) exceedsDataLimit(tx *types.Transaction) bool {
+	return env.settings.MaxTxDataSize > 0 && len(tx.Data()) > env.settings.MaxTxDataSize
+}
+
+// Reports whether the transaction is private, with a payload over the
+// configured limit. The transaction manager caches payloads, so fetching one
+// here doesn't cost its execution another round-trip.
+func (env *work) exceedsPayloadLimit(tx *types.Transaction) bool {
+	if env.settings.MaxPrivatePayloadSize <= 0 || !tx.IsPrivate() || private.P == nil {
+		return false
+	}
+	payload, err := private.P.Receive(tx.Data())
+	if err != nil {
+		// We're not a party to the transaction, so it won't be executed.
+		return false
+	}
+	return len(payload) > env.settings.MaxPrivatePayloadSize
+}
+
+// Returns an error if the transaction's sender holds code and the settings
+// don't let such transactions through.
+func (env *work) checkContractSender(tx *types.Transaction) error {
+	if !env.settings.DropContractSenders && env.settings.ContractSenderHandler == nil {
+		return nil
+	}
+	from, err := tx.From()
+	if err != nil || env.publicState.GetCodeSize(from) == 0 {
+		return nil
+	}
+	if env.settings.ContractSenderHandler != nil {
+		return env.settings.ContractSenderHandler(tx)
+	}
+	return errContractSender
+}
+
+// Reports whether the transaction creates a contract at an address which
+// already holds code.
+func (env *work) createsOverExistingCode(tx *types.Transaction) bool {
+	if tx.To() != nil {
+		return false
+	}
+	from, err := tx.From()
+	if err != nil {
+		return false
+	}
+	statedb := env.publicState
+	if tx.IsPrivate() {
+		statedb = env.privateState
+	}
+	return statedb.GetCodeSize(crypto.CreateAddress(from, tx.Nonce())) > 0
+}
+
 func (env *work) commitTransaction(tx *types.Transaction, bc *core.BlockChain, gp *core.GasPool) (*types.Receipt, *types.Receipt, error) {
+	if !env.settings.VerifyPrivateParticipation || !tx.IsPrivate() || private.P == nil {
+		return env.applyTransaction(tx, bc, gp)
+	}
+
+	privateRoot := env.privateState.IntermediateRoot()
+	publicReceipt, privateReceipt, err := env.applyTransaction(tx, bc, gp)
+	if err == nil {
+		if err := checkPrivateParticipation(tx, privateRoot, common.BytesToHash(privateReceipt.PostState)); err != nil {
+			glog.V(logger.Warn).Infof("TX (%x): %v\n", tx.Hash().Bytes()[:4], err)
+		}
+	}
+	return publicReceipt, privateReceipt, err
+}
+
+// Checks that a private transaction changed the private state root from
+// before to after if and only if this node is a party to it. The transaction
+// manager serves an empty payload to nodes which aren't.
+func checkPrivateParticipation(tx *types.Transaction, before, after common.Hash) error {
+	payload, err := private.P.Receive(tx.Data())
+	if err != nil {
+		return fmt.Errorf("failed to fetch the private payload: %v", err)
+	}
+	participant := len(payload) != 0
+
+	switch {
+	case participant && before == after:
+		return errors.New("private state unchanged although this node is a participant")
+	case !participant && before != after:
+		return errors.New("private state changed although this node isn't a participant")
+	}
+	return nil
+}
+
+func (env *work) applyTransaction(tx *types.Transaction, bc *core.BlockChain, gp *core.GasPool) (*types.Receipt, *types.Receipt, error) {
+	if env.settings.TxTimeout > 0 {
+		return env.commitTransactionWithTimeout(tx, bc, gp, env.settings.TxTimeout)
+	}
+
 	publicSnapshot := env.publicState.Snapshot()
 	privateSnapshot := env.privateState.Snapshot()
 
-	publicReceipt, privateReceipt, _, err := core.ApplyTransaction(env.config, bc, gp, env.publicState, env.privateState, env.header, tx, env.header.GasUsed, env.config.VmConfig)
+	vmConfig := env.config.VmConfig
+	vmConfig.Abort = env.round.nextTx()
+
+	publicReceipt, privateReceipt, _, err := core.ApplyTransaction(env.config, bc, gp, env.publicState, env.privateState, env.header, tx, env.header.GasUsed, vmConfig)
+	if err == nil && env.round.isCancelled() {
+		// The round's state is discarded, so there's nothing to revert.
+		return nil, nil, errRoundCancelled
+	}
 	if err != nil {
 		env.publicState.RevertToSnapshot(publicSnapshot)
 		env.privateState.RevertToSnapshot(privateSnapshot)
@@ -383,3 +2301,45 @@ func (env *work) commitTransaction(tx *types.Transaction, bc *core.BlockChain, g
 
 	return publicReceipt, privateReceipt, nil
 }
+
+// Like applyTransaction, but aborts the EVM once the timeout has elapsed. An
+// aborted call is an ordinary execution failure to the EVM, so the transaction
+// would still be committed, using up all of its gas; it's rolled back instead.
+//
+// State snapshots don't survive a completed transaction, so the checkpoint is
+// a copy of the state, which costs time linear in the accounts the block has
+// touched so far (see BenchmarkTxTimeoutCheckpoints). A public transaction
+// leaves the private state alone, so only the public one is copied for it.
+func (env *work) commitTransactionWithTimeout(tx *types.Transaction, bc *core.BlockChain, gp *core.GasPool, timeout time.Duration) (*types.Receipt, *types.Receipt, error) {
+	publicState := env.publicState.Copy()
+	privateState := env.privateState
+	if tx.IsPrivate() {
+		privateState = env.privateState.Copy()
+	}
+	gasAvailable := new(big.Int).Set((*big.Int)(gp))
+	gasUsed := new(big.Int).Set(env.header.GasUsed)
+
+	abort := env.round.nextTx()
+	vmConfig := env.config.VmConfig
+	vmConfig.Abort = abort
+	timer := time.AfterFunc(timeout, func() { atomic.StoreInt32(abort, 1) })
+	defer timer.Stop()
+
+	publicReceipt, privateReceipt, _, err := core.ApplyTransaction(env.config, bc, gp, env.publicState, env.privateState, env.header, tx, env.header.GasUsed, vmConfig)
+	if err == nil && atomic.LoadInt32(abort) != 0 {
+		err = errTxTimeout
+		if env.round.isCancelled() {
+			err = errRoundCancelled
+		}
+	}
+	if err != nil {
+		env.publicState = publicState
+		env.privateState = privateState
+		(*big.Int)(gp).Set(gasAvailable)
+		env.header.GasUsed.Set(gasUsed)
+
+		return nil, nil, err
+	}
+
+	return publicReceipt, privateReceipt, nil
+}
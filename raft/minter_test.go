@@ -0,0 +1,4831 @@
+package raft
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"math/rand"
+	"net"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/event"
+	"github.com/ethereum/go-ethereum/metrics"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/private"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/rpc"
+	gometrics "github.com/rcrowley/go-metrics"
+)
+
+var (
+	testKey, _  = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+	testKey2, _ = crypto.HexToECDSA("8a1f9a8f95be41cd7ccb6168179afb4504aefe388d1e14474d32c45c72ce7b7a")
+	testKey3, _ = crypto.HexToECDSA("49a7b37aa6f6645917e7b807e9d1c00d4fa71f18343b0d4122a4d2df64dd6fee")
+	testAddress = crypto.PubkeyToAddress(testKey.PublicKey)
+	testBalance = big.NewInt(1000000000000000000)
+	testRecvr   = common.HexToAddress("0x0000000000000000000000000000000000000100")
+)
+
+// testBackend is a minimal core.Backend backed by an in-memory database.
+type testBackend struct {
+	chain   *core.BlockChain
+	txPool  *core.TxPool
+	chainDb ethdb.Database
+	mux     *event.TypeMux
+}
+
+func newTestBackend(t testing.TB) *testBackend {
+	db, _ := ethdb.NewMemDatabase()
+	return newTestBackendOn(t, db)
+}
+
+func newTestBackendOn(t testing.TB, db ethdb.Database) *testBackend {
+	core.WriteGenesisBlockForTesting(db,
+		core.GenesisAccount{Address: testAddress, Balance: testBalance},
+		core.GenesisAccount{Address: crypto.PubkeyToAddress(testKey2.PublicKey), Balance: testBalance},
+		core.GenesisAccount{Address: crypto.PubkeyToAddress(testKey3.PublicKey), Balance: testBalance},
+	)
+
+	mux := new(event.TypeMux)
+	config := core.MakeChainConfig()
+	chain, err := core.NewBlockChain(db, config, core.FakePow{}, mux, false)
+	if err != nil {
+		t.Fatalf("failed to create blockchain: %v", err)
+	}
+	pool := core.NewTxPool(config, mux, chain.State, chain.GasLimit)
+
+	return &testBackend{chain: chain, txPool: pool, chainDb: db, mux: mux}
+}
+
+func (b *testBackend) AccountManager() *accounts.Manager { return nil }
+func (b *testBackend) BlockChain() *core.BlockChain      { return b.chain }
+func (b *testBackend) ChainDb() ethdb.Database           { return b.chainDb }
+func (b *testBackend) DappDb() ethdb.Database            { return nil }
+func (b *testBackend) EventMux() *event.TypeMux          { return b.mux }
+func (b *testBackend) TxPool() *core.TxPool              { return b.txPool }
+
+func newTestMinter(t *testing.T, settings *MinterConfig) (*minter, *testBackend) {
+	backend := newTestBackend(t)
+	minter, err := newMinter(backend.chain.Config(), backend, 50*time.Millisecond, settings)
+	if err != nil {
+		t.Fatalf("failed to create minter: %v", err)
+	}
+	return minter, backend
+}
+
+// Creates the work of a round on the speculative head. Assumes mu is held.
+func createTestWork(t testing.TB, minter *minter) *work {
+	work, err := minter.createWork()
+	if err != nil {
+		t.Fatalf("failed to create work: %v", err)
+	}
+	return work
+}
+
+func signedTransaction(t *testing.T, key *ecdsa.PrivateKey, nonce uint64, to common.Address, amount *big.Int) *types.Transaction {
+	tx, err := types.NewTransaction(nonce, to, amount, big.NewInt(21000), big.NewInt(0), nil).SignECDSA(key)
+	if err != nil {
+		t.Fatalf("failed to sign transaction: %v", err)
+	}
+	return tx
+}
+
+func contractCreation(t *testing.T, key *ecdsa.PrivateKey, nonce uint64, code []byte) *types.Transaction {
+	tx, err := types.NewContractCreation(nonce, big.NewInt(0), big.NewInt(100000), big.NewInt(0), code).SignECDSA(key)
+	if err != nil {
+		t.Fatalf("failed to sign contract creation: %v", err)
+	}
+	return tx
+}
+
+func addTransactions(t *testing.T, backend *testBackend, txes ...*types.Transaction) {
+	for _, tx := range txes {
+		if err := backend.txPool.Add(tx); err != nil {
+			t.Fatalf("failed to add transaction %x: %v", tx.Hash(), err)
+		}
+	}
+}
+
+// Returns the head of the minter's speculative chain.
+func speculativeHead(minter *minter) *types.Block {
+	minter.mu.Lock()
+	defer minter.mu.Unlock()
+
+	return minter.speculativeChain.head
+}
+
+// Waits until the speculative chain reaches the given block number.
+func waitForHead(t *testing.T, minter *minter, number uint64, timeout time.Duration) *types.Block {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if head := speculativeHead(minter); head.NumberU64() >= number {
+			return head
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for block #%d, head is #%d", number, speculativeHead(minter).NumberU64())
+	return nil
+}
+
+func TestMinterStampsMixDigestAndNonce(t *testing.T) {
+	mixDigest := common.HexToHash("0xdeadbeef")
+	nonce := types.EncodeNonce(42)
+	minter, backend := newTestMinter(t, &MinterConfig{MixDigest: mixDigest, Nonce: nonce})
+	defer minter.close()
+
+	addTransactions(t, backend, signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1)))
+	minter.mintNewBlock()
+
+	block := minter.speculativeChain.head
+	if block.NumberU64() != 1 {
+		t.Fatalf("expected block #1 to be minted, head is #%d", block.NumberU64())
+	}
+	if block.MixDigest() != mixDigest {
+		t.Errorf("mix digest mismatch: have %x, want %x", block.MixDigest(), mixDigest)
+	}
+	if block.Nonce() != nonce.Uint64() {
+		t.Errorf("nonce mismatch: have %d, want %d", block.Nonce(), nonce.Uint64())
+	}
+	if _, err := backend.chain.InsertChain(types.Blocks{block}); err != nil {
+		t.Fatalf("minted block failed validation: %v", err)
+	}
+}
+
+func TestMinterCountsCoalescedRequests(t *testing.T) {
+	minter, backend := newTestMinter(t, nil)
+	defer minter.close()
+
+	for i := 0; i < 5; i++ {
+		minter.requestMinting()
+	}
+	if pending := minter.status().PendingRequests; pending != 5 {
+		t.Fatalf("pending request count mismatch: have %d, want %d", pending, 5)
+	}
+
+	addTransactions(t, backend, signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1)))
+	minter.mintNewBlock()
+
+	status := minter.status()
+	if status.CoalescedRequests != 5 {
+		t.Errorf("coalesced request count mismatch: have %d, want %d", status.CoalescedRequests, 5)
+	}
+	if status.PendingRequests != 0 {
+		t.Errorf("pending requests not reset after round: have %d", status.PendingRequests)
+	}
+}
+
+func TestMinterEnforcesMinBlockTimeDelta(t *testing.T) {
+	delta := time.Second
+	minter, backend := newTestMinter(t, &MinterConfig{MinBlockTimeDelta: delta})
+	defer minter.close()
+
+	for nonce := uint64(0); nonce < 3; nonce++ {
+		parent := minter.speculativeChain.head
+		addTransactions(t, backend, signedTransaction(t, testKey, nonce, testRecvr, big.NewInt(1)))
+		minter.mintNewBlock()
+
+		block := minter.speculativeChain.head
+		if block.NumberU64() != parent.NumberU64()+1 {
+			t.Fatalf("expected block #%d to be minted, head is #%d", parent.NumberU64()+1, block.NumberU64())
+		}
+		if gap := new(big.Int).Sub(block.Time(), parent.Time()); gap.Int64() < int64(delta) {
+			t.Errorf("block #%d minted %v after its parent, want at least %v", block.NumberU64(), time.Duration(gap.Int64()), delta)
+		}
+	}
+}
+
+func TestMinterPausesWhileUnhealthy(t *testing.T) {
+	var unhealthy int32 = 1
+	healthCheck := func() error {
+		if atomic.LoadInt32(&unhealthy) == 1 {
+			return errors.New("dependency down")
+		}
+		return nil
+	}
+	minter, backend := newTestMinter(t, &MinterConfig{HealthCheck: healthCheck, HealthCheckInterval: 10 * time.Millisecond})
+	defer minter.close()
+	minter.start()
+
+	addTransactions(t, backend, signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1)))
+	time.Sleep(300 * time.Millisecond)
+	if head := speculativeHead(minter); head.NumberU64() != 0 {
+		t.Fatalf("minted block #%d while unhealthy", head.NumberU64())
+	}
+	if minter.status().Healthy {
+		t.Errorf("status reports healthy while the health check fails")
+	}
+
+	atomic.StoreInt32(&unhealthy, 0)
+	waitForHead(t, minter, 1, time.Second)
+
+	atomic.StoreInt32(&unhealthy, 1)
+	time.Sleep(100 * time.Millisecond)
+	addTransactions(t, backend, signedTransaction(t, testKey, 1, testRecvr, big.NewInt(1)))
+	time.Sleep(300 * time.Millisecond)
+	if head := speculativeHead(minter); head.NumberU64() != 1 {
+		t.Fatalf("minted block #%d after becoming unhealthy again", head.NumberU64())
+	}
+
+	atomic.StoreInt32(&unhealthy, 0)
+	waitForHead(t, minter, 2, time.Second)
+}
+
+func TestMinterEnforcesContractAllowlist(t *testing.T) {
+	allowed := common.HexToAddress("0x0000000000000000000000000000000000000aaa")
+	minter, backend := newTestMinter(t, &MinterConfig{AllowedContracts: []common.Address{allowed}})
+	defer minter.close()
+
+	allowedTx := signedTransaction(t, testKey, 0, allowed, big.NewInt(1))
+	deniedTx := signedTransaction(t, testKey2, 0, testRecvr, big.NewInt(1))
+	creationTx := contractCreation(t, testKey3, 0, nil)
+	addTransactions(t, backend, allowedTx, deniedTx, creationTx)
+
+	minter.mintNewBlock()
+	block := minter.speculativeChain.head
+	if txes := block.Transactions(); len(txes) != 1 || txes[0].Hash() != allowedTx.Hash() {
+		t.Fatalf("expected only the allowlisted transaction to be minted, got %d transactions", len(txes))
+	}
+
+	minter.reconfigure(func(settings *MinterConfig) {
+		settings.AllowContractCreation = true
+	})
+	minter.mintNewBlock()
+	block = minter.speculativeChain.head
+	if txes := block.Transactions(); len(txes) != 1 || txes[0].Hash() != creationTx.Hash() {
+		t.Fatalf("expected only the contract creation to be minted, got %d transactions", len(txes))
+	}
+}
+
+func TestMinterDetectsHeadDivergence(t *testing.T) {
+	minter, backend := newTestMinter(t, nil)
+	defer minter.close()
+	genesis := backend.chain.CurrentBlock()
+
+	if err := minter.checkCommittedHead(genesis.Hash()); err != nil {
+		t.Fatalf("unexpected divergence at genesis: %v", err)
+	}
+
+	// A minted block that never made it into the chain, as if the database
+	// lost writes that raft had already committed.
+	addTransactions(t, backend, signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1)))
+	minter.mintNewBlock()
+	lost := minter.speculativeChain.head
+
+	if err := minter.checkCommittedHead(lost.Hash()); err == nil {
+		t.Fatalf("expected divergence to be detected for missing block %x", lost.Hash())
+	}
+
+	if _, err := backend.chain.InsertChain(types.Blocks{lost}); err != nil {
+		t.Fatalf("failed to insert block: %v", err)
+	}
+	if err := minter.checkCommittedHead(lost.Hash()); err != nil {
+		t.Fatalf("unexpected divergence once the block is in the chain: %v", err)
+	}
+	if err := minter.checkCommittedHead(genesis.Hash()); err != nil {
+		t.Fatalf("unexpected divergence for an ancestor of the head: %v", err)
+	}
+}
+
+func TestLastAppliedBlockHashComesFromWAL(t *testing.T) {
+	minter, backend := newTestMinter(t, nil)
+	defer minter.close()
+	genesis := backend.chain.CurrentBlock()
+
+	addTransactions(t, backend, signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1)))
+	minter.mintNewBlock()
+	first := minter.speculativeChain.head
+	addTransactions(t, backend, signedTransaction(t, testKey, 1, testRecvr, big.NewInt(1)))
+	minter.mintNewBlock()
+	second := minter.speculativeChain.head
+
+	blockEntry := func(index uint64, block *types.Block) raftpb.Entry {
+		data, err := rlp.EncodeToBytes(block)
+		if err != nil {
+			t.Fatalf("failed to encode block: %v", err)
+		}
+		return raftpb.Entry{Index: index, Type: raftpb.EntryNormal, Data: data}
+	}
+	snapshot := &raftpb.Snapshot{Data: genesis.Hash().Bytes()}
+	entries := []raftpb.Entry{
+		blockEntry(251, first),
+		{Index: 252, Type: raftpb.EntryNormal},
+		{Index: 253, Type: raftpb.EntryConfChange},
+		blockEntry(254, second),
+	}
+
+	// The snapshot lags behind the blocks applied since it was taken.
+	if hash, ok := lastAppliedBlockHash(snapshot, entries, 253); !ok || hash != first.Hash() {
+		t.Errorf("expected the last applied block %x, got %x (%v)", first.Hash(), hash, ok)
+	}
+	// Committed but not yet applied entries aren't expected in the chain.
+	if hash, ok := lastAppliedBlockHash(snapshot, entries, 250); !ok || hash != genesis.Hash() {
+		t.Errorf("expected the snapshot head %x, got %x (%v)", genesis.Hash(), hash, ok)
+	}
+	if hash, ok := lastAppliedBlockHash(snapshot, entries, 254); !ok || hash != second.Hash() {
+		t.Errorf("expected the last applied block %x, got %x (%v)", second.Hash(), hash, ok)
+	}
+	if _, ok := lastAppliedBlockHash(nil, nil, 0); ok {
+		t.Errorf("expected nothing to check on a fresh node")
+	}
+}
+
+func TestMinterMintsSubmittedBatchInOrder(t *testing.T) {
+	minter, backend := newTestMinter(t, nil)
+	defer minter.close()
+	minter.start()
+
+	// Pool transactions are minted after the batch.
+	poolTx := signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1))
+	addTransactions(t, backend, poolTx)
+	waitForHead(t, minter, 1, time.Second)
+
+	batch := types.Transactions{
+		signedTransaction(t, testKey3, 0, testRecvr, big.NewInt(3)),
+		signedTransaction(t, testKey2, 0, testRecvr, big.NewInt(2)),
+		signedTransaction(t, testKey, 1, testRecvr, big.NewInt(1)),
+	}
+	if err := minter.submitBatch(batch); err != nil {
+		t.Fatalf("failed to submit batch: %v", err)
+	}
+
+	block := speculativeHead(minter)
+	if block.NumberU64() != 2 {
+		t.Fatalf("expected batch in block #2, head is #%d", block.NumberU64())
+	}
+	txes := block.Transactions()
+	if len(txes) != len(batch) {
+		t.Fatalf("transaction count mismatch: have %d, want %d", len(txes), len(batch))
+	}
+	for i, tx := range batch {
+		if txes[i].Hash() != tx.Hash() {
+			t.Errorf("transaction %d mismatch: have %x, want %x", i, txes[i].Hash(), tx.Hash())
+		}
+	}
+}
+
+func TestMinterRevertsFailingBatch(t *testing.T) {
+	minter, _ := newTestMinter(t, &MinterConfig{BatchFailureAbortsRound: true})
+	defer minter.close()
+	minter.start()
+
+	batch := types.Transactions{
+		signedTransaction(t, testKey2, 0, testRecvr, big.NewInt(1)),
+		signedTransaction(t, testKey3, 5, testRecvr, big.NewInt(1)), // nonce too high
+	}
+	if err := minter.submitBatch(batch); err == nil {
+		t.Fatalf("expected batch with an invalid transaction to fail")
+	}
+	if head := speculativeHead(minter); head.NumberU64() != 0 {
+		t.Fatalf("minted block #%d from a failing batch", head.NumberU64())
+	}
+}
+
+func TestBatchesGetPoolTransactionChecks(t *testing.T) {
+	minter, _ := newTestMinter(t, &MinterConfig{WatchedContracts: []common.Address{testRecvr}})
+	defer minter.close()
+	minter.mu.Lock()
+	defer minter.mu.Unlock()
+
+	commit := func(work *work, txes ...*types.Transaction) error {
+		batch := &txBatch{txes: txes, errC: make(chan error, 1)}
+		if _, _, _, _, _, _, err := work.commitBatches([]*txBatch{batch}, minter.chain); err != nil {
+			t.Fatalf("round aborted: %v", err)
+		}
+		select {
+		case err := <-batch.errC:
+			return err
+		default:
+			return nil
+		}
+	}
+	tx := signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1))
+
+	// Priced below the floor.
+	work := createTestWork(t, minter)
+	work.minGasPrice = big.NewInt(1)
+	if err := commit(work, tx); err == nil || !strings.Contains(err.Error(), errBelowPriceFloor.Error()) {
+		t.Errorf("expected the batch to be rejected for its price, got %v", err)
+	}
+	if nonce := work.publicState.GetNonce(testAddress); nonce != 0 {
+		t.Errorf("rejected batch left nonce %d", nonce)
+	}
+
+	// Eating into the reserved gas.
+	work = createTestWork(t, minter)
+	work.settings = &MinterConfig{ReserveFreeGas: work.header.GasLimit.Uint64() - 30000}
+	if err := commit(work, tx, signedTransaction(t, testKey, 1, testRecvr, big.NewInt(1))); err == nil {
+		t.Errorf("expected the batch not to fit outside the reserved gas")
+	}
+	if have := (*big.Int)(work.gasPool); have.Cmp(work.header.GasLimit) != 0 {
+		t.Errorf("gas pool left at %v after the batch, expected the full limit of %v", have, work.header.GasLimit)
+	}
+
+	// Calling a watched contract.
+	work = createTestWork(t, minter)
+	if err := commit(work, tx); err != nil {
+		t.Fatalf("failed to commit batch: %v", err)
+	}
+	if usage := work.contractUsage[testRecvr]; usage == nil || usage.txes != 1 || usage.gas != 21000 {
+		t.Errorf("unexpected usage of the watched contract: %+v", usage)
+	}
+}
+
+func TestGasPriceHistogramBuckets(t *testing.T) {
+	var h gasPriceHistogram
+	for _, price := range []int64{0, 0, 1, 1e9, 1e9 + 1, 5e10, 1e11, 1e11 + 1, 1e12} {
+		h.add(big.NewInt(price))
+	}
+	want := map[string]uint64{"zero": 2, "le1gwei": 2, "le10gwei": 1, "le100gwei": 2, "gt100gwei": 2}
+	for name, count := range h.toMap() {
+		if count != want[name] {
+			t.Errorf("bucket %s: have %d, want %d", name, count, want[name])
+		}
+	}
+}
+
+func TestMinterRecordsGasPricesOfIncludedTransactions(t *testing.T) {
+	minter, backend := newTestMinter(t, nil)
+	defer minter.close()
+
+	addTransactions(t, backend,
+		signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1)),
+		signedTransaction(t, testKey, 1, testRecvr, big.NewInt(1)),
+		signedTransaction(t, testKey2, 0, testRecvr, big.NewInt(1)),
+	)
+	minter.mintNewBlock()
+
+	prices := minter.status().LastBlockGasPrices
+	if prices["zero"] != 3 {
+		t.Errorf("zero gas price count mismatch: have %d, want %d", prices["zero"], 3)
+	}
+	for name, count := range prices {
+		if name != "zero" && count != 0 {
+			t.Errorf("unexpected count %d in bucket %s", count, name)
+		}
+	}
+}
+
+func TestMinterDropsCollidingContractCreation(t *testing.T) {
+	minter, backend := newTestMinter(t, &MinterConfig{DropCollidingCreations: true})
+	defer minter.close()
+	sub := backend.mux.Subscribe(TxDroppedEvent{})
+	defer sub.Unsubscribe()
+
+	colliding := contractCreation(t, testKey3, 0, nil)
+	fine := contractCreation(t, testKey2, 0, nil)
+	addTransactions(t, backend, colliding, fine)
+
+	minter.mu.Lock()
+	work := createTestWork(t, minter)
+	from, _ := colliding.From()
+	work.publicState.SetCode(crypto.CreateAddress(from, colliding.Nonce()), []byte{0x60, 0x00})
+	committed, _, _, _ := work.commitTransactions(minter.getTransactions(), minter.chain)
+	minter.dropTransactions(work.dropped)
+	minter.mu.Unlock()
+
+	if len(committed) != 1 || committed[0].Hash() != fine.Hash() {
+		t.Fatalf("expected only the non-colliding creation to be committed, got %d transactions", len(committed))
+	}
+	if len(work.dropped) != 1 || work.dropped[0].Tx.Hash() != colliding.Hash() || work.dropped[0].Reason != errCreationCollision {
+		t.Fatalf("expected the colliding creation to be dropped, got %v", work.dropped)
+	}
+	if backend.txPool.Get(colliding.Hash()) != nil {
+		t.Errorf("dropped transaction is still in the pool")
+	}
+
+	select {
+	case ev := <-sub.Chan():
+		if dropped := ev.Data.(TxDroppedEvent); dropped.Tx.Hash() != colliding.Hash() {
+			t.Errorf("dropped event for the wrong transaction: %x", dropped.Tx.Hash())
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no TxDroppedEvent posted")
+	}
+}
+
+func TestMinterOnDemandMode(t *testing.T) {
+	minter, backend := newTestMinter(t, &MinterConfig{OnDemand: true})
+	defer minter.close()
+	minter.start()
+
+	addTransactions(t, backend, signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1)))
+	time.Sleep(300 * time.Millisecond)
+	if head := speculativeHead(minter); head.NumberU64() != 0 {
+		t.Fatalf("minted block #%d without being asked to", head.NumberU64())
+	}
+
+	block, err := minter.forceMint()
+	if err != nil {
+		t.Fatalf("failed to force minting: %v", err)
+	}
+	if block.NumberU64() != 1 || len(block.Transactions()) != 1 {
+		t.Fatalf("unexpected forced block #%d with %d transactions", block.NumberU64(), len(block.Transactions()))
+	}
+	if _, err := minter.forceMint(); err != errNothingToMint {
+		t.Fatalf("expected %v with nothing pending, got %v", errNothingToMint, err)
+	}
+
+	addTransactions(t, backend,
+		signedTransaction(t, testKey, 1, testRecvr, big.NewInt(1)),
+		signedTransaction(t, testKey2, 0, testRecvr, big.NewInt(1)),
+	)
+	time.Sleep(300 * time.Millisecond)
+	if head := speculativeHead(minter); head.NumberU64() != 1 {
+		t.Fatalf("minted block #%d without being asked to", head.NumberU64())
+	}
+
+	blocks, err := minter.drainPending()
+	if err != nil {
+		t.Fatalf("failed to drain pending transactions: %v", err)
+	}
+	if len(blocks) != 1 || len(blocks[0].Transactions()) != 2 {
+		t.Fatalf("expected the pending transactions to be drained into one block, got %d blocks", len(blocks))
+	}
+}
+
+func TestMinterEnforcesBlockValueCap(t *testing.T) {
+	minter, backend := newTestMinter(t, &MinterConfig{MaxBlockValue: big.NewInt(5)})
+	defer minter.close()
+
+	addTransactions(t, backend,
+		signedTransaction(t, testKey, 0, testRecvr, big.NewInt(3)),
+		signedTransaction(t, testKey2, 0, testRecvr, big.NewInt(3)),
+		signedTransaction(t, testKey3, 0, testRecvr, big.NewInt(0)),
+	)
+
+	blockValue := func(block *types.Block) *big.Int {
+		total := new(big.Int)
+		for _, tx := range block.Transactions() {
+			total.Add(total, tx.Value())
+		}
+		return total
+	}
+
+	first := minter.mintNewBlock()
+	if first == nil || len(first.Transactions()) != 2 {
+		t.Fatalf("expected one value transfer and the zero-value transaction in the first block")
+	}
+	if value := blockValue(first); value.Cmp(big.NewInt(3)) != 0 {
+		t.Errorf("first block value mismatch: have %v, want %v", value, 3)
+	}
+
+	second := minter.mintNewBlock()
+	if second == nil || len(second.Transactions()) != 1 {
+		t.Fatalf("expected the deferred value transfer in the second block")
+	}
+	if value := blockValue(second); value.Cmp(big.NewInt(3)) != 0 {
+		t.Errorf("second block value mismatch: have %v, want %v", value, 3)
+	}
+}
+
+func TestMinterGasPriceFloorFollowsFullness(t *testing.T) {
+	// Any load at all counts as congestion here.
+	floor := func(fullness float64) *big.Int {
+		if fullness > 0 {
+			return big.NewInt(1)
+		}
+		return big.NewInt(0)
+	}
+	minter, backend := newTestMinter(t, &MinterConfig{GasPriceFloor: floor, FullnessWindow: 1})
+	defer minter.close()
+
+	if floor := minter.status().GasPriceFloor; floor.Sign() != 0 {
+		t.Fatalf("expected no floor while idle, have %v", floor)
+	}
+
+	addTransactions(t, backend, signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1)))
+	if minter.mintNewBlock() == nil {
+		t.Fatalf("expected a block to be minted while idle")
+	}
+	if floor := minter.status().GasPriceFloor; floor.Cmp(big.NewInt(1)) != 0 {
+		t.Fatalf("expected the floor to rise after a busy round, have %v", floor)
+	}
+
+	// Zero-priced transactions are now below the floor.
+	addTransactions(t, backend, signedTransaction(t, testKey, 1, testRecvr, big.NewInt(1)))
+	if block := minter.mintNewBlock(); block != nil {
+		t.Fatalf("minted block #%d with transactions below the floor", block.NumberU64())
+	}
+	if floor := minter.status().GasPriceFloor; floor.Sign() != 0 {
+		t.Fatalf("expected the floor to fall after an empty round, have %v", floor)
+	}
+
+	if minter.mintNewBlock() == nil {
+		t.Fatalf("expected the deferred transaction to be minted once the floor fell")
+	}
+}
+
+func TestNewMinterRejectsMissingEventMux(t *testing.T) {
+	backend := newTestBackend(t)
+	backend.mux = nil
+
+	if _, err := newMinter(backend.chain.Config(), backend, 50*time.Millisecond, nil); err != errNoEventMux {
+		t.Fatalf("expected %v, got %v", errNoEventMux, err)
+	}
+}
+
+func TestMinterCachesReceiptsOfMintedBlocks(t *testing.T) {
+	minter, backend := newTestMinter(t, &MinterConfig{ReceiptCacheSize: 1})
+	defer minter.close()
+
+	tx := signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1))
+	addTransactions(t, backend, tx)
+	first := minter.mintNewBlock()
+
+	// The block hasn't been inserted into the chain, so its receipts can
+	// only have come from memory.
+	receipts, ok := minter.cachedReceipts(first.Hash())
+	if !ok {
+		t.Fatalf("receipts of block %x not cached", first.Hash())
+	}
+	if len(receipts.Public) != 1 || receipts.Public[0].TxHash != tx.Hash() {
+		t.Fatalf("unexpected cached receipts: %v", receipts.Public)
+	}
+	if len(receipts.Private) != 0 {
+		t.Errorf("unexpected private receipts for a public transaction: %v", receipts.Private)
+	}
+
+	addTransactions(t, backend, signedTransaction(t, testKey, 1, testRecvr, big.NewInt(1)))
+	second := minter.mintNewBlock()
+
+	if _, ok := minter.cachedReceipts(second.Hash()); !ok {
+		t.Errorf("receipts of block %x not cached", second.Hash())
+	}
+	if _, ok := minter.cachedReceipts(first.Hash()); ok {
+		t.Errorf("receipts of block %x not evicted", first.Hash())
+	}
+}
+
+func TestMinterRoundsUseConsistentSettings(t *testing.T) {
+	minter, backend := newTestMinter(t, nil)
+	defer minter.close()
+
+	// Keep changing two related settings together while minting.
+	done := make(chan struct{})
+	reconfigured := make(chan struct{})
+	go func() {
+		defer close(reconfigured)
+		for i := uint64(1); ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			minter.reconfigure(func(settings *MinterConfig) {
+				settings.MixDigest = common.BigToHash(new(big.Int).SetUint64(i))
+				settings.Nonce = types.EncodeNonce(i)
+			})
+		}
+	}()
+
+	var blocks []*types.Block
+	for nonce := uint64(0); nonce < 10; nonce++ {
+		addTransactions(t, backend, signedTransaction(t, testKey, nonce, testRecvr, big.NewInt(1)))
+		blocks = append(blocks, minter.mintNewBlock())
+	}
+	close(done)
+	<-reconfigured
+
+	for _, block := range blocks {
+		digest := new(big.Int).SetBytes(block.MixDigest().Bytes()).Uint64()
+		if nonce := block.Nonce(); digest != nonce {
+			t.Errorf("block #%v minted with mix digest %d but nonce %d", block.Number(), digest, nonce)
+		}
+	}
+}
+
+func TestMinterPostsRoundSummary(t *testing.T) {
+	minter, backend := newTestMinter(t, &MinterConfig{
+		DropCollidingCreations: true,
+		MaxBlockValue:          big.NewInt(1),
+	})
+	defer minter.close()
+	sub := backend.mux.Subscribe(RoundSummaryEvent{})
+	defer sub.Unsubscribe()
+
+	committed := signedTransaction(t, testKey, 0, testRecvr, big.NewInt(0))
+	deferred := signedTransaction(t, testKey2, 0, testRecvr, big.NewInt(2))
+	addTransactions(t, backend, committed, deferred)
+
+	block := minter.mintNewBlock()
+
+	var summary RoundSummaryEvent
+	select {
+	case ev := <-sub.Chan():
+		summary = ev.Data.(RoundSummaryEvent)
+	case <-time.After(time.Second):
+		t.Fatalf("no RoundSummaryEvent posted")
+	}
+	if summary.BlockHash != block.Hash() {
+		t.Errorf("summary for block %x, expected %x", summary.BlockHash, block.Hash())
+	}
+	if len(summary.Committed) != 1 || summary.Committed[0].Hash() != committed.Hash() {
+		t.Errorf("unexpected committed transactions: %v", summary.Committed)
+	}
+	if len(summary.Skipped) != 1 {
+		t.Fatalf("expected 1 skipped transaction, got %d", len(summary.Skipped))
+	}
+	if skipped := summary.Skipped[0]; skipped.Tx.Hash() != deferred.Hash() || skipped.Reason != errExceedsValueCap || skipped.Dropped {
+		t.Errorf("unexpected skipped transaction: %+v", skipped)
+	}
+
+	// Colliding creations are dropped rather than deferred.
+	colliding := contractCreation(t, testKey3, 0, nil)
+	addTransactions(t, backend, colliding)
+
+	minter.mu.Lock()
+	work := createTestWork(t, minter)
+	from, _ := colliding.From()
+	work.publicState.SetCode(crypto.CreateAddress(from, colliding.Nonce()), []byte{0x60, 0x00})
+	work.commitTransactions(minter.getTransactions(), minter.chain)
+	minter.mu.Unlock()
+
+	var dropped *SkippedTx
+	for i := range work.skipped {
+		if work.skipped[i].Tx.Hash() == colliding.Hash() {
+			dropped = &work.skipped[i]
+		}
+	}
+	if dropped == nil || !dropped.Dropped || dropped.Reason != errCreationCollision {
+		t.Errorf("expected the colliding creation to be reported as dropped, got %+v", work.skipped)
+	}
+}
+
+func TestMinterDefersReplacementOfProposedTransaction(t *testing.T) {
+	minter, backend := newTestMinter(t, nil)
+	defer minter.close()
+	genesis := backend.chain.CurrentBlock()
+
+	original := signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1))
+	addTransactions(t, backend, original)
+	proposed := minter.mintNewBlock()
+
+	// Swap the original for a replacement in the pool while its block is
+	// still speculative.
+	replacement := signedTransaction(t, testKey, 0, testRecvr, big.NewInt(2))
+	backend.txPool.Remove(original.Hash())
+	addTransactions(t, backend, replacement)
+
+	minter.mu.Lock()
+	for _, txes := range minter.speculativeChain.withoutProposedTxes(backend.txPool.Pending()) {
+		if len(txes) > 0 {
+			t.Errorf("replacement of a proposed transaction not filtered out: %x", txes[0].Hash())
+		}
+	}
+	minter.mu.Unlock()
+	if block := minter.mintNewBlock(); block != nil {
+		t.Fatalf("minted block #%v on top of the proposed transaction", block.Number())
+	}
+
+	// Once the proposing block is unwound, the replacement is minted instead.
+	minter.mu.Lock()
+	minter.speculativeChain.unwindFrom(proposed.Hash(), genesis)
+	minter.mu.Unlock()
+
+	block := minter.mintNewBlock()
+	if block == nil {
+		t.Fatalf("replacement not minted")
+	}
+	if block.NumberU64() != 1 || len(block.Transactions()) != 1 || block.Transactions()[0].Hash() != replacement.Hash() {
+		t.Fatalf("expected block #1 with only the replacement, got block #%v with %d transactions", block.Number(), len(block.Transactions()))
+	}
+}
+
+func TestMinterFlushState(t *testing.T) {
+	minter, backend := newTestMinter(t, nil)
+	defer minter.close()
+
+	for nonce := uint64(0); nonce < 3; nonce++ {
+		addTransactions(t, backend, signedTransaction(t, testKey, nonce, testRecvr, big.NewInt(1)))
+		minter.mintNewBlock()
+	}
+	head := speculativeHead(minter)
+
+	root, err := minter.flushState()
+	if err != nil {
+		t.Fatalf("failed to flush state: %v", err)
+	}
+	if root != head.Root() {
+		t.Fatalf("flushed root %x, expected the head's %x", root, head.Root())
+	}
+	if flushed, _ := backend.chainDb.Get(flushedStateDbKey); common.BytesToHash(flushed) != root {
+		t.Errorf("flushed root not recorded, got %x", flushed)
+	}
+
+	// The state must be readable from the database alone, bypassing any caches.
+	statedb, err := state.New(root, backend.chainDb)
+	if err != nil {
+		t.Fatalf("flushed state not in the database: %v", err)
+	}
+	if balance := statedb.GetBalance(testRecvr); balance.Cmp(big.NewInt(3)) != 0 {
+		t.Errorf("unexpected balance in flushed state: %v", balance)
+	}
+}
+
+func TestMinterSkipsSlowTransaction(t *testing.T) {
+	minter, backend := newTestMinter(t, &MinterConfig{TxTimeout: 10 * time.Millisecond})
+	defer minter.close()
+	sub := backend.mux.Subscribe(RoundSummaryEvent{})
+	defer sub.Unsubscribe()
+
+	// Init code looping until it runs out of its (large) gas allowance.
+	loop := []byte{byte(vm.JUMPDEST), byte(vm.PUSH1), 0x00, byte(vm.JUMP)}
+	slow, err := types.NewContractCreation(0, big.NewInt(0), big.NewInt(4000000), big.NewInt(0), loop).SignECDSA(testKey)
+	if err != nil {
+		t.Fatalf("failed to sign contract creation: %v", err)
+	}
+	fast := signedTransaction(t, testKey2, 0, testRecvr, big.NewInt(1))
+	addTransactions(t, backend, slow, fast)
+
+	start := time.Now()
+	block := minter.mintNewBlock()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("round stalled for %v", elapsed)
+	}
+	if block == nil || len(block.Transactions()) != 1 || block.Transactions()[0].Hash() != fast.Hash() {
+		t.Fatalf("expected a block with only the fast transaction, got %v", block)
+	}
+	if block.GasUsed().Cmp(big.NewInt(21000)) != 0 {
+		t.Errorf("gas of the slow transaction not rolled back: %v used", block.GasUsed())
+	}
+
+	select {
+	case ev := <-sub.Chan():
+		summary := ev.Data.(RoundSummaryEvent)
+		if len(summary.Skipped) != 1 || summary.Skipped[0].Tx.Hash() != slow.Hash() || summary.Skipped[0].Reason != errTxTimeout {
+			t.Errorf("expected the slow transaction to be skipped, got %+v", summary.Skipped)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no RoundSummaryEvent posted")
+	}
+}
+
+func TestMinterRotatesCoinbase(t *testing.T) {
+	coinbases := []common.Address{
+		common.HexToAddress("0x0000000000000000000000000000000000000a01"),
+		common.HexToAddress("0x0000000000000000000000000000000000000a02"),
+		common.HexToAddress("0x0000000000000000000000000000000000000a03"),
+	}
+	minter, backend := newTestMinter(t, &MinterConfig{Coinbases: coinbases})
+	defer minter.close()
+
+	for nonce := uint64(0); nonce < 6; nonce++ {
+		addTransactions(t, backend, signedTransaction(t, testKey, nonce, testRecvr, big.NewInt(1)))
+		block := minter.mintNewBlock()
+
+		if want := coinbases[block.NumberU64()%3]; block.Coinbase() != want {
+			t.Errorf("block #%v: coinbase %x, expected %x", block.Number(), block.Coinbase(), want)
+		}
+	}
+}
+
+func TestMinterConfigDiff(t *testing.T) {
+	minter, _ := newTestMinter(t, &MinterConfig{
+		MinBlockTimeDelta: time.Second,
+		OnDemand:          true,
+		HealthCheck:       func() error { return nil },
+	})
+	defer minter.close()
+	minter.reconfigure(func(settings *MinterConfig) {
+		settings.MaxBlockValue = big.NewInt(100)
+	})
+
+	diff := minter.currentSettings().diff()
+	expected := map[string]interface{}{
+		"MinBlockTimeDelta": time.Second,
+		"OnDemand":          true,
+		"HealthCheck":       true,
+		"MaxBlockValue":     big.NewInt(100),
+	}
+	if !reflect.DeepEqual(diff, expected) {
+		t.Errorf("unexpected diff: %v, expected %v", diff, expected)
+	}
+
+	if diff := new(MinterConfig).diff(); len(diff) != 0 {
+		t.Errorf("default settings reported as changed: %v", diff)
+	}
+}
+
+// fakePrivateTransactionManager serves private payloads from memory. Like
+// Constellation, it serves an empty payload for transactions this node isn't a
+// party to.
+type fakePrivateTransactionManager struct {
+	payloads map[string][]byte
+}
+
+func (ptm *fakePrivateTransactionManager) Send(data []byte, from string, to []string) ([]byte, error) {
+	return nil, errors.New("not supported")
+}
+
+func (ptm *fakePrivateTransactionManager) Receive(data []byte) ([]byte, error) {
+	return ptm.payloads[string(data)], nil
+}
+
+func privateTransaction(t *testing.T, key *ecdsa.PrivateKey, nonce uint64, data []byte) *types.Transaction {
+	tx, err := types.NewTransaction(nonce, testRecvr, big.NewInt(0), big.NewInt(100000), big.NewInt(0), data).SignECDSA(key)
+	if err != nil {
+		t.Fatalf("failed to sign transaction: %v", err)
+	}
+	tx.SetPrivate()
+	return tx
+}
+
+func TestMinterSkipsOversizedPrivatePayloads(t *testing.T) {
+	defer func(ptm private.PrivateTransactionManager) { private.P = ptm }(private.P)
+	small, large := common.LeftPadBytes([]byte{1}, 64), common.LeftPadBytes([]byte{2}, 64)
+	private.P = &fakePrivateTransactionManager{payloads: map[string][]byte{
+		string(small): make([]byte, 100),
+		string(large): make([]byte, 1000),
+	}}
+
+	minter, backend := newTestMinter(t, &MinterConfig{MaxPrivatePayloadSize: 500})
+	defer minter.close()
+	fine := privateTransaction(t, testKey, 0, small)
+	oversized := privateTransaction(t, testKey2, 0, large)
+	addTransactions(t, backend, fine, oversized)
+
+	minter.mu.Lock()
+	work := createTestWork(t, minter)
+	committed, _, _, _ := work.commitTransactions(minter.getTransactions(), minter.chain)
+	minter.mu.Unlock()
+
+	if len(committed) != 1 || committed[0].Hash() != fine.Hash() {
+		t.Fatalf("expected only the transaction with the small payload to be committed, got %d transactions", len(committed))
+	}
+	if len(work.skipped) != 1 || work.skipped[0].Tx.Hash() != oversized.Hash() || work.skipped[0].Reason != errPayloadTooLarge || work.skipped[0].Dropped {
+		t.Fatalf("expected the oversized transaction to be deferred, got %+v", work.skipped)
+	}
+
+	minter.reconfigure(func(settings *MinterConfig) {
+		settings.DropOversizedPrivate = true
+	})
+	minter.mintNewBlock()
+
+	if backend.txPool.Get(oversized.Hash()) != nil {
+		t.Errorf("oversized transaction not dropped from the pool")
+	}
+}
+
+func TestMinterMetersWatchedContracts(t *testing.T) {
+	defer func(enabled bool) { metrics.Enabled = enabled }(metrics.Enabled)
+	metrics.Enabled = true
+
+	watched := common.HexToAddress("0x0000000000000000000000000000000000000c01")
+	unwatched := common.HexToAddress("0x0000000000000000000000000000000000000c02")
+	registry := gometrics.NewRegistry()
+	minter, backend := newTestMinter(t, &MinterConfig{
+		WatchedContracts: []common.Address{watched},
+		MetricsRegistry:  registry,
+	})
+	defer minter.close()
+
+	addTransactions(t, backend,
+		signedTransaction(t, testKey, 0, watched, big.NewInt(1)),
+		signedTransaction(t, testKey, 1, watched, big.NewInt(1)),
+		signedTransaction(t, testKey2, 0, unwatched, big.NewInt(1)),
+	)
+	if block := minter.mintNewBlock(); len(block.Transactions()) != 3 {
+		t.Fatalf("expected 3 transactions to be minted, got %d", len(block.Transactions()))
+	}
+
+	prefix := fmt.Sprintf("raft/minter/contract/%x/", watched)
+	if meter, ok := registry.Get(prefix + "txs").(gometrics.Meter); !ok || meter.Count() != 2 {
+		t.Errorf("unexpected transaction count meter for the watched contract: %v", meter)
+	}
+	if meter, ok := registry.Get(prefix + "gas").(gometrics.Meter); !ok || meter.Count() != 2*21000 {
+		t.Errorf("unexpected gas meter for the watched contract: %v", meter)
+	}
+	for _, name := range []string{"txs", "gas"} {
+		if meter := registry.Get(fmt.Sprintf("raft/minter/contract/%x/%s", unwatched, name)); meter != nil {
+			t.Errorf("meter registered for an unwatched contract: %s", name)
+		}
+	}
+
+	// The other minting metrics share the registry.
+	if meter, ok := registry.Get("raft/minter/gasprice/zero").(gometrics.Meter); !ok || meter.Count() != 3 {
+		t.Errorf("unexpected gas price meter: %v", meter)
+	}
+}
+
+// slowPrivateTransactionManager takes a while to serve each payload the first
+// time it's requested, like a remote transaction manager with a cache.
+type slowPrivateTransactionManager struct {
+	latency time.Duration
+
+	mu     sync.Mutex
+	cached map[string]bool
+}
+
+func (ptm *slowPrivateTransactionManager) Send(data []byte, from string, to []string) ([]byte, error) {
+	return nil, errors.New("not supported")
+}
+
+func (ptm *slowPrivateTransactionManager) Receive(data []byte) ([]byte, error) {
+	ptm.mu.Lock()
+	cached := ptm.cached[string(data)]
+	ptm.mu.Unlock()
+
+	if !cached {
+		time.Sleep(ptm.latency)
+
+		ptm.mu.Lock()
+		ptm.cached[string(data)] = true
+		ptm.mu.Unlock()
+	}
+	return data, nil
+}
+
+func benchmarkPrivatePayloadFetching(b *testing.B, prefetch bool) {
+	addrTxes := make(AddressTxes)
+	for i := 0; i < 100; i++ {
+		key, _ := crypto.GenerateKey()
+		data := common.LeftPadBytes(big.NewInt(int64(i)).Bytes(), 64)
+		tx, _ := types.NewTransaction(0, testRecvr, big.NewInt(0), big.NewInt(100000), big.NewInt(0), data).SignECDSA(key)
+		tx.SetPrivate()
+		addrTxes[crypto.PubkeyToAddress(key.PublicKey)] = types.Transactions{tx}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ptm := &slowPrivateTransactionManager{latency: time.Millisecond, cached: make(map[string]bool)}
+		if prefetch {
+			prefetchPrivatePayloads(ptm, addrTxes)
+		}
+		// Execution fetches each payload in turn.
+		for _, txes := range addrTxes {
+			for _, tx := range txes {
+				ptm.Receive(tx.Data())
+			}
+		}
+	}
+}
+
+func BenchmarkPrivatePayloadFetchingSequential(b *testing.B) {
+	benchmarkPrivatePayloadFetching(b, false)
+}
+
+func BenchmarkPrivatePayloadFetchingPrefetched(b *testing.B) {
+	benchmarkPrivatePayloadFetching(b, true)
+}
+
+func TestMinterFirstBlockAfterIdle(t *testing.T) {
+	minter, backend := newTestMinter(t, nil)
+	defer minter.close()
+	minter.start()
+	blockTime := minter.currentBlockTime()
+
+	addTransactions(t, backend, signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1)))
+	waitForHead(t, minter, 1, time.Second)
+
+	time.Sleep(10 * blockTime)
+
+	// The first block after being idle is minted right away...
+	requested := time.Now()
+	addTransactions(t, backend, signedTransaction(t, testKey, 1, testRecvr, big.NewInt(1)))
+	first := waitForHead(t, minter, 2, time.Second)
+	if elapsed := time.Since(requested); elapsed > blockTime {
+		t.Errorf("first block after idling took %v to mint", elapsed)
+	}
+
+	// ...and the next one still waits for the block time.
+	addTransactions(t, backend, signedTransaction(t, testKey, 2, testRecvr, big.NewInt(1)))
+	second := waitForHead(t, minter, 3, time.Second)
+	if gap := time.Duration(second.Time().Int64() - first.Time().Int64()); gap < blockTime*9/10 {
+		t.Errorf("block minted %v after the previous one, within the block time of %v", gap, blockTime)
+	}
+}
+
+func TestMinterCancelCurrentRound(t *testing.T) {
+	minter, backend := newTestMinter(t, nil)
+	defer minter.close()
+	if minter.cancelCurrentRound() {
+		t.Fatalf("cancelled a round while none was in progress")
+	}
+
+	// Init code looping until it runs out of its (large) gas allowance.
+	loop := []byte{byte(vm.JUMPDEST), byte(vm.PUSH1), 0x00, byte(vm.JUMP)}
+	slow, err := types.NewContractCreation(0, big.NewInt(0), big.NewInt(4000000), big.NewInt(0), loop).SignECDSA(testKey)
+	if err != nil {
+		t.Fatalf("failed to sign contract creation: %v", err)
+	}
+	addTransactions(t, backend, slow, signedTransaction(t, testKey2, 0, testRecvr, big.NewInt(1)))
+
+	minted := make(chan *types.Block)
+	go func() { minted <- minter.mintNewBlock() }()
+
+	deadline := time.Now().Add(time.Second)
+	for !minter.cancelCurrentRound() {
+		if time.Now().After(deadline) {
+			t.Fatalf("round never started")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	select {
+	case block := <-minted:
+		if block != nil {
+			t.Fatalf("cancelled round minted block #%v", block.Number())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("cancelled round didn't finish")
+	}
+
+	if head := speculativeHead(minter); head.NumberU64() != 0 {
+		t.Errorf("speculative chain extended to #%d by a cancelled round", head.NumberU64())
+	}
+	if backend.txPool.Get(slow.Hash()) == nil {
+		t.Errorf("transaction of the cancelled round removed from the pool")
+	}
+	if minter.cancelCurrentRound() {
+		t.Errorf("cancelled a round after it finished")
+	}
+
+	// The next round is unaffected.
+	if block := minter.mintNewBlock(); block == nil || block.NumberU64() != 1 {
+		t.Errorf("failed to mint after a cancelled round")
+	}
+}
+
+func TestTargetGasLimitConverges(t *testing.T) {
+	const target, window = 0.5, 10
+	gasUsed := new(big.Int).Mul(params.MinGasLimit, big.NewInt(3)) // steady load per block
+	limit := new(big.Int).Mul(params.MinGasLimit, big.NewInt(4))
+
+	var fullness []float64
+	for i := 0; i < 20000; i++ {
+		used := common.BigMin(gasUsed, limit)
+		f, _ := new(big.Rat).SetFrac(used, limit).Float64()
+		if fullness = append(fullness, f); len(fullness) > window {
+			fullness = fullness[1:]
+		}
+		var average float64
+		for _, f := range fullness {
+			average += f
+		}
+		average /= float64(len(fullness))
+
+		next := targetGasLimit(limit, average, target)
+		bound := new(big.Int).Div(limit, params.GasLimitBoundDivisor)
+		if change := new(big.Int).Sub(next, limit); new(big.Int).Abs(change).Cmp(bound) >= 0 {
+			t.Fatalf("block %d: gas limit changed by %v, beyond the bound of %v", i, change, bound)
+		}
+		limit = next
+	}
+
+	utilization, _ := new(big.Rat).SetFrac(gasUsed, limit).Float64()
+	if utilization < target-0.01 || utilization > target+0.01 {
+		t.Errorf("utilization converged to %.3f, expected %.2f (gas limit %v)", utilization, target, limit)
+	}
+
+	// The limit never drops below the minimum.
+	if limit := targetGasLimit(params.MinGasLimit, 0, target); limit.Cmp(params.MinGasLimit) != 0 {
+		t.Errorf("gas limit dropped to %v, below the minimum", limit)
+	}
+}
+
+func TestMinterTargetsUtilization(t *testing.T) {
+	minter, backend := newTestMinter(t, &MinterConfig{TargetUtilization: 0.5})
+	defer minter.close()
+
+	// Nearly empty blocks, so the limit should shrink as fast as allowed.
+	for nonce := uint64(0); nonce < 3; nonce++ {
+		parent := speculativeHead(minter)
+		addTransactions(t, backend, signedTransaction(t, testKey, nonce, testRecvr, big.NewInt(1)))
+		block := minter.mintNewBlock()
+
+		if nonce > 0 && block.GasLimit().Cmp(parent.GasLimit()) >= 0 {
+			t.Errorf("block #%v: gas limit %v didn't shrink from %v", block.Number(), block.GasLimit(), parent.GasLimit())
+		}
+	}
+}
+
+func TestMinterMintExplicitMatchesGolden(t *testing.T) {
+	minter, backend := newTestMinter(t, nil)
+	defer minter.close()
+	genesis := backend.chain.CurrentBlock()
+
+	// Signatures aren't deterministic, so the input transactions are fixed
+	// too: two transfers and a contract creation.
+	var txes types.Transactions
+	if err := rlp.DecodeBytes(readHexFile(t, "explicit_txes.hex"), &txes); err != nil {
+		t.Fatalf("failed to decode transactions: %v", err)
+	}
+	block, publicReceipts, privateReceipts, err := minter.mintExplicit(genesis, txes)
+	if err != nil {
+		t.Fatalf("failed to mint block: %v", err)
+	}
+	if len(publicReceipts) != len(txes) || len(privateReceipts) != 0 {
+		t.Fatalf("unexpected receipts: %d public, %d private", len(publicReceipts), len(privateReceipts))
+	}
+
+	// Nothing outside the returned block is affected.
+	if head := speculativeHead(minter); head.Hash() != genesis.Hash() {
+		t.Errorf("speculative chain moved to #%d", head.NumberU64())
+	}
+	if pending, _ := backend.txPool.Stats(); pending != 0 {
+		t.Errorf("pool gained %d pending transactions", pending)
+	}
+
+	encoded, err := rlp.EncodeToBytes(block)
+	if err != nil {
+		t.Fatalf("failed to encode block: %v", err)
+	}
+	if golden := readHexFile(t, "explicit_block.hex"); !bytes.Equal(encoded, golden) {
+		t.Errorf("block differs from the golden block\ngot:  %x\nwant: %x", encoded, golden)
+	}
+}
+
+func readHexFile(t *testing.T, name string) []byte {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", name, err)
+	}
+	return common.FromHex(strings.TrimSpace(string(data)))
+}
+
+func TestMinterDropsOversizedTxData(t *testing.T) {
+	minter, backend := newTestMinter(t, &MinterConfig{MaxTxDataSize: 100})
+	defer minter.close()
+	sub := backend.mux.Subscribe(RoundSummaryEvent{})
+	defer sub.Unsubscribe()
+
+	oversized, err := types.NewTransaction(0, testRecvr, big.NewInt(0), big.NewInt(100000), big.NewInt(0), make([]byte, 101)).SignECDSA(testKey)
+	if err != nil {
+		t.Fatalf("failed to sign transaction: %v", err)
+	}
+	normal := signedTransaction(t, testKey2, 0, testRecvr, big.NewInt(1))
+	addTransactions(t, backend, oversized, normal)
+
+	block := minter.mintNewBlock()
+	if block == nil || len(block.Transactions()) != 1 || block.Transactions()[0].Hash() != normal.Hash() {
+		t.Fatalf("expected a block with only the normal transaction, got %v", block)
+	}
+	if backend.txPool.Get(oversized.Hash()) != nil {
+		t.Errorf("oversized transaction not dropped from the pool")
+	}
+
+	select {
+	case ev := <-sub.Chan():
+		summary := ev.Data.(RoundSummaryEvent)
+		if len(summary.Skipped) != 1 || summary.Skipped[0].Tx.Hash() != oversized.Hash() || summary.Skipped[0].Reason != errTxDataTooLarge || !summary.Skipped[0].Dropped {
+			t.Errorf("expected the oversized transaction to be reported as dropped, got %+v", summary.Skipped)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no RoundSummaryEvent posted")
+	}
+}
+
+func TestMinterReportsFullBlock(t *testing.T) {
+	var calls, deferred int
+	minter, backend := newTestMinter(t, &MinterConfig{
+		OnBlockFull: func(count int) { calls++; deferred = count },
+	})
+	defer minter.close()
+	addTransactions(t, backend,
+		signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1)),
+		signedTransaction(t, testKey2, 0, testRecvr, big.NewInt(1)),
+		signedTransaction(t, testKey3, 0, testRecvr, big.NewInt(1)),
+	)
+
+	// Leave room for only two transfers.
+	minter.mu.Lock()
+	work := createTestWork(t, minter)
+	work.gasPool = new(core.GasPool).AddGas(big.NewInt(50000))
+	committed, _, _, _ := work.commitTransactions(minter.getTransactions(), minter.chain)
+	minter.mu.Unlock()
+
+	if len(committed) != 2 {
+		t.Fatalf("expected 2 transactions to fit, got %d", len(committed))
+	}
+	if calls != 1 || deferred != 1 {
+		t.Errorf("expected the hook to be called once with 1 deferred transaction, got %d calls with %d", calls, deferred)
+	}
+	for _, skipped := range work.skipped {
+		if skipped.Reason != errBlockFull || skipped.Dropped {
+			t.Errorf("unexpected skipped transaction: %+v", skipped)
+		}
+	}
+
+	// There's plenty of room in a regular block.
+	calls = 0
+	minter.mintNewBlock()
+	if calls != 0 {
+		t.Errorf("hook called for a block with room to spare")
+	}
+}
+
+func TestMinterLeavesReservedGasFree(t *testing.T) {
+	minter, backend := newTestMinter(t, nil)
+	defer minter.close()
+	addTransactions(t, backend,
+		signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1)),
+		signedTransaction(t, testKey2, 0, testRecvr, big.NewInt(1)),
+		signedTransaction(t, testKey3, 0, testRecvr, big.NewInt(1)),
+	)
+
+	minter.mu.Lock()
+	defer minter.mu.Unlock()
+	work := createTestWork(t, minter)
+
+	// Reserve all but enough gas for two transfers.
+	reserve := new(big.Int).Sub(work.header.GasLimit, big.NewInt(50000))
+	work.settings = &MinterConfig{ReserveFreeGas: reserve.Uint64()}
+	committed, _, _, _ := work.commitTransactions(minter.getTransactions(), minter.chain)
+
+	if len(committed) != 2 {
+		t.Fatalf("expected 2 transactions to fit, got %d", len(committed))
+	}
+	if len(work.skipped) != 1 {
+		t.Errorf("expected 1 deferred transaction, got %d", len(work.skipped))
+	}
+	free := new(big.Int).Add(reserve, big.NewInt(50000-2*21000))
+	if (*big.Int)(work.gasPool).Cmp(free) != 0 {
+		t.Errorf("expected %v gas to remain, got %v", free, work.gasPool)
+	}
+}
+
+func TestMinterRecordsInvalidOrderings(t *testing.T) {
+	minter, backend := newTestMinter(t, nil)
+	defer minter.close()
+	genesis := backend.chain.Genesis()
+
+	addTransactions(t, backend, signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1)))
+	minter.mintNewBlock()
+	minted := speculativeHead(minter)
+	if minted.NumberU64() != 1 {
+		t.Fatalf("expected a block to be minted")
+	}
+
+	// The minted block never reached the database.
+	minter.updateSpeculativeChainPerInvalidOrdering(genesis, minted)
+	minter.updateSpeculativeChainPerInvalidOrdering(genesis, genesis)
+
+	history := minter.recentInvalidOrderings()
+	if len(history) != 2 {
+		t.Fatalf("expected 2 invalid orderings, got %d", len(history))
+	}
+	if history[0].InvalidBlock != minted.Hash() || history[0].Head != genesis.Hash() || history[0].InLocalDb {
+		t.Errorf("unexpected first invalid ordering: %+v", history[0])
+	}
+	if history[1].InvalidBlock != genesis.Hash() || !history[1].InLocalDb {
+		t.Errorf("unexpected second invalid ordering: %+v", history[1])
+	}
+
+	for i := 0; i < invalidOrderingHistorySize; i++ {
+		minter.updateSpeculativeChainPerInvalidOrdering(genesis, minted)
+	}
+	history = minter.recentInvalidOrderings()
+	if len(history) != invalidOrderingHistorySize {
+		t.Errorf("expected history to be bounded to %d entries, got %d", invalidOrderingHistorySize, len(history))
+	}
+	for _, info := range history {
+		if info.InvalidBlock != minted.Hash() {
+			t.Fatalf("expected older entries to be evicted, found %+v", info)
+		}
+	}
+}
+
+func TestMinterSkipsKnownBlock(t *testing.T) {
+	// Far enough apart that timestamps don't depend on the wall clock.
+	minter, backend := newTestMinter(t, &MinterConfig{MinBlockTimeDelta: 100 * 365 * 24 * time.Hour})
+	defer minter.close()
+	sub := backend.mux.Subscribe(core.NewMinedBlockEvent{})
+	defer sub.Unsubscribe()
+
+	mined := make(chan *types.Block, 2)
+	go func() {
+		for ev := range sub.Chan() {
+			mined <- ev.Data.(core.NewMinedBlockEvent).Block
+		}
+	}()
+
+	addTransactions(t, backend, signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1)))
+	block := minter.mintNewBlock()
+	if block == nil {
+		t.Fatalf("expected a block to be minted")
+	}
+	select {
+	case <-mined:
+	case <-time.After(time.Second):
+		t.Fatalf("no NewMinedBlockEvent posted")
+	}
+
+	// Store the block, then mint again from the same parent and transactions.
+	if err := core.WriteBlock(backend.chainDb, block); err != nil {
+		t.Fatalf("failed to write block: %v", err)
+	}
+	minter.mu.Lock()
+	minter.speculativeChain = newSpeculativeChain()
+	minter.speculativeChain.setHead(backend.chain.Genesis())
+	minter.mu.Unlock()
+
+	if again := minter.mintNewBlock(); again != nil {
+		t.Errorf("expected known block %x not to be proposed again", again.Hash())
+	}
+	select {
+	case dup := <-mined:
+		t.Errorf("duplicate NewMinedBlockEvent posted for block %x", dup.Hash())
+	case <-time.After(100 * time.Millisecond):
+	}
+	if head := speculativeHead(minter); head.Hash() != backend.chain.Genesis().Hash() {
+		t.Errorf("speculative chain extended with known block %x", head.Hash())
+	}
+}
+
+func TestMinterCoalescesPendingStateEvents(t *testing.T) {
+	minter, backend := newTestMinter(t, &MinterConfig{PendingStateInterval: time.Second})
+	defer minter.close()
+	sub := backend.mux.Subscribe(core.PendingStateEvent{})
+	defer sub.Unsubscribe()
+
+	var posted int32
+	go func() {
+		for range sub.Chan() {
+			atomic.AddInt32(&posted, 1)
+		}
+	}()
+
+	for nonce := uint64(0); nonce < 10; nonce++ {
+		addTransactions(t, backend, signedTransaction(t, testKey, nonce, testRecvr, big.NewInt(1)))
+		if minter.mintNewBlock() == nil {
+			t.Fatalf("no block minted in round %d", nonce)
+		}
+	}
+
+	// The first round posts right away, and the rest are collapsed into one
+	// event once the interval has elapsed.
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt32(&posted); n != 1 {
+		t.Errorf("expected 1 PendingStateEvent before the interval elapsed, got %d", n)
+	}
+	time.Sleep(1200 * time.Millisecond)
+	if n := atomic.LoadInt32(&posted); n != 2 {
+		t.Errorf("expected 2 PendingStateEvents after the interval elapsed, got %d", n)
+	}
+}
+
+func TestMinterCloseCancelsCoalescedPendingState(t *testing.T) {
+	minter, backend := newTestMinter(t, &MinterConfig{PendingStateInterval: 200 * time.Millisecond})
+	defer minter.close()
+	sub := backend.mux.Subscribe(core.PendingStateEvent{})
+	defer sub.Unsubscribe()
+
+	for nonce := uint64(0); nonce < 2; nonce++ {
+		addTransactions(t, backend, signedTransaction(t, testKey, nonce, testRecvr, big.NewInt(1)))
+		if minter.mintNewBlock() == nil {
+			t.Fatalf("no block minted in round %d", nonce)
+		}
+	}
+	select {
+	case <-sub.Chan():
+	case <-time.After(time.Second):
+		t.Fatalf("no PendingStateEvent posted for the first round")
+	}
+
+	// The second round's event is due once the interval has elapsed, by which
+	// time the minter is closed.
+	minter.close()
+	select {
+	case <-sub.Chan():
+		t.Errorf("PendingStateEvent posted after closing")
+	case <-time.After(400 * time.Millisecond):
+	}
+}
+
+func TestMinterEstimatesNextBlock(t *testing.T) {
+	minter, backend := newTestMinter(t, nil)
+	defer minter.close()
+	addTransactions(t, backend,
+		signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1)),
+		signedTransaction(t, testKey, 1, testRecvr, big.NewInt(1)),
+		signedTransaction(t, testKey2, 0, testRecvr, big.NewInt(1)),
+	)
+
+	estimate, err := minter.estimateNextBlock()
+	if err != nil {
+		t.Fatalf("failed to estimate next block: %v", err)
+	}
+	if head := speculativeHead(minter); head.NumberU64() != 0 {
+		t.Fatalf("estimate extended the speculative chain to block %d", head.NumberU64())
+	}
+
+	block := minter.mintNewBlock()
+	if block == nil {
+		t.Fatalf("expected a block to be minted")
+	}
+	if estimate.Full {
+		t.Errorf("block estimated to be full")
+	}
+	if estimate.GasUsed.Cmp(block.GasUsed()) != 0 {
+		t.Errorf("estimated %v gas used, block used %v", estimate.GasUsed, block.GasUsed())
+	}
+	included := make(map[common.Hash]bool)
+	for _, hash := range estimate.Transactions {
+		included[hash] = true
+	}
+	if len(included) != len(block.Transactions()) {
+		t.Fatalf("estimated %d transactions, block has %d", len(included), len(block.Transactions()))
+	}
+	for _, tx := range block.Transactions() {
+		if !included[tx.Hash()] {
+			t.Errorf("transaction %x included but not estimated", tx.Hash())
+		}
+	}
+
+	// A block which can't fit all pending transactions is reported full.
+	addTransactions(t, backend, signedTransaction(t, testKey3, 0, testRecvr, big.NewInt(1)))
+	minter.reconfigure(func(settings *MinterConfig) {
+		settings.ReserveFreeGas = 2 * block.GasLimit().Uint64()
+	})
+	if estimate, err = minter.estimateNextBlock(); err != nil {
+		t.Fatalf("failed to estimate next block: %v", err)
+	}
+	if !estimate.Full || len(estimate.Transactions) != 0 {
+		t.Errorf("expected an empty, full block, got %+v", estimate)
+	}
+}
+
+func TestMinterStopDiscardsInFlightRound(t *testing.T) {
+	minter, backend := newTestMinter(t, &MinterConfig{OnDemand: true})
+	defer minter.close()
+	addTransactions(t, backend, signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1)))
+	minter.start()
+
+	// A round decided on before stopping doesn't mint afterwards.
+	epoch := atomic.LoadUint64(&minter.epoch)
+	minter.stop()
+	if block, err := minter.mintNewBlockIn(epoch); err != errNotMinting {
+		t.Fatalf("minting after stopping: have %v, %v, want %v", block, err, errNotMinting)
+	}
+
+	// However stop and in-flight rounds interleave, the speculative chain is
+	// left at the chain head.
+	for i := 0; i < 20; i++ {
+		minter.start()
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			minter.forceMint()
+		}()
+		go func() {
+			defer wg.Done()
+			minter.stop()
+		}()
+		wg.Wait()
+
+		if head := speculativeHead(minter); head.Hash() != backend.chain.CurrentBlock().Hash() {
+			t.Fatalf("speculative chain left at block %x after stopping", head.Hash())
+		}
+	}
+}
+
+// A block sink whose writes all fail.
+type failingWriter struct {
+	writes int32
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	atomic.AddInt32(&w.writes, 1)
+	return 0, errors.New("sink unavailable")
+}
+
+func TestMinterExportsBlocks(t *testing.T) {
+	var sink bytes.Buffer
+	minter, backend := newTestMinter(t, &MinterConfig{BlockSink: &sink, ExportSync: true})
+	defer minter.close()
+
+	addTransactions(t, backend, signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1)))
+	block := minter.mintNewBlock()
+	if block == nil {
+		t.Fatalf("expected a block to be minted")
+	}
+	var exported types.Block
+	if err := rlp.Decode(&sink, &exported); err != nil {
+		t.Fatalf("failed to decode exported block: %v", err)
+	}
+	if exported.Hash() != block.Hash() {
+		t.Errorf("exported block %x, minted %x", exported.Hash(), block.Hash())
+	}
+
+	// Minting carries on regardless of export failures, in either mode.
+	nonce := uint64(0)
+	for _, exportSync := range []bool{true, false} {
+		failing := new(failingWriter)
+		minter.reconfigure(func(settings *MinterConfig) {
+			settings.BlockSink = failing
+			settings.ExportSync = exportSync
+		})
+		before := atomic.LoadUint64(&minter.exportFailures)
+
+		for i := 0; i < 3; i++ {
+			addTransactions(t, backend, signedTransaction(t, testKey2, nonce, testRecvr, big.NewInt(1)))
+			nonce++
+			if minter.mintNewBlock() == nil {
+				t.Fatalf("no block minted with a failing sink (sync: %v)", exportSync)
+			}
+		}
+		deadline := time.Now().Add(time.Second)
+		for atomic.LoadUint64(&minter.exportFailures)-before < 3 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if failures := atomic.LoadUint64(&minter.exportFailures) - before; failures != 3 {
+			t.Errorf("expected 3 export failures (sync: %v), got %d", exportSync, failures)
+		}
+	}
+}
+
+func TestMinterVerifiesRewards(t *testing.T) {
+	minter, _ := newTestMinter(t, &MinterConfig{VerifyRewards: true})
+	defer minter.close()
+
+	minter.mu.Lock()
+	err := createTestWork(t, minter).accumulateRewards()
+	minter.mu.Unlock()
+	if err != nil {
+		t.Errorf("unexpected error with the regular rewards: %v", err)
+	}
+
+	minter.reconfigure(func(settings *MinterConfig) {
+		settings.accumulateRewards = func(config *core.ChainConfig, statedb *state.StateDB, header *types.Header, uncles []*types.Header) {
+			core.AccumulateChainRewards(config, statedb, header, uncles)
+			statedb.AddBalance(testRecvr, big.NewInt(1))
+		}
+	})
+
+	minter.mu.Lock()
+	defer minter.mu.Unlock()
+
+	work := createTestWork(t, minter)
+	if err := work.accumulateRewards(); err == nil {
+		t.Errorf("expected modifying an extra account to be detected")
+	}
+	if work.publicState.GetBalance(testRecvr).Sign() == 0 {
+		t.Errorf("rewards weren't applied")
+	}
+}
+
+func TestMinterStampsDeterministicSeed(t *testing.T) {
+	salt := []byte("simulation")
+	mintFirstBlock := func(settings *MinterConfig) *types.Block {
+		minter, backend := newTestMinter(t, settings)
+		defer minter.close()
+		addTransactions(t, backend, signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1)))
+		block := minter.mintNewBlock()
+		if block == nil {
+			t.Fatalf("expected a block to be minted")
+		}
+		return block
+	}
+
+	first := mintFirstBlock(&MinterConfig{SeedSalt: salt})
+	second := mintFirstBlock(&MinterConfig{SeedSalt: salt})
+	if first.MixDigest() != second.MixDigest() {
+		t.Errorf("seeds differ across mints: %x and %x", first.MixDigest(), second.MixDigest())
+	}
+	if expected := crypto.Keccak256Hash(salt, common.LeftPadBytes([]byte{1}, 32)); first.MixDigest() != expected {
+		t.Errorf("seed %x, expected %x", first.MixDigest(), expected)
+	}
+
+	other := mintFirstBlock(&MinterConfig{SeedSalt: []byte("other")})
+	if other.MixDigest() == first.MixDigest() {
+		t.Errorf("seed doesn't depend on the salt")
+	}
+	settings := &MinterConfig{SeedSalt: salt}
+	if settings.mixDigestAt(big.NewInt(2)) == first.MixDigest() {
+		t.Errorf("seed doesn't depend on the block number")
+	}
+}
+
+func TestMinterVerifiesPrivateParticipation(t *testing.T) {
+	defer func(ptm private.PrivateTransactionManager) { private.P = ptm }(private.P)
+	known, unknown := common.LeftPadBytes([]byte{1}, 64), common.LeftPadBytes([]byte{2}, 64)
+	private.P = &fakePrivateTransactionManager{payloads: map[string][]byte{
+		string(known): {0x01},
+	}}
+
+	minter, _ := newTestMinter(t, &MinterConfig{VerifyPrivateParticipation: true})
+	defer minter.close()
+	minter.mu.Lock()
+	defer minter.mu.Unlock()
+	work := createTestWork(t, minter)
+
+	commit := func(tx *types.Transaction) (before, after common.Hash) {
+		before = work.privateState.IntermediateRoot()
+		work.publicState.StartRecord(tx.Hash(), common.Hash{}, 0)
+		if _, _, err := work.commitTransaction(tx, minter.chain, work.gasPool); err != nil {
+			t.Fatalf("failed to commit transaction: %v", err)
+		}
+		return before, work.privateState.IntermediateRoot()
+	}
+
+	// As a participant, the transaction is executed on the private state.
+	participating := privateTransaction(t, testKey, 0, known)
+	before, after := commit(participating)
+	if before == after {
+		t.Errorf("private state unchanged by a transaction this node is party to")
+	}
+	if err := checkPrivateParticipation(participating, before, after); err != nil {
+		t.Errorf("unexpected mismatch: %v", err)
+	}
+	if err := checkPrivateParticipation(participating, before, before); err == nil {
+		t.Errorf("expected an unchanged private state to be reported")
+	}
+
+	// Otherwise, it's ignored.
+	other := privateTransaction(t, testKey2, 0, unknown)
+	before, after = commit(other)
+	if before != after {
+		t.Errorf("private state changed by a transaction this node isn't party to")
+	}
+	if err := checkPrivateParticipation(other, before, after); err != nil {
+		t.Errorf("unexpected mismatch: %v", err)
+	}
+	if err := checkPrivateParticipation(other, before, common.Hash{1}); err == nil {
+		t.Errorf("expected a changed private state to be reported")
+	}
+}
+
+func TestMinterJittersBlockTime(t *testing.T) {
+	minter, _ := newTestMinter(t, &MinterConfig{BlockTimeJitter: 0.2})
+	defer minter.close()
+	base := minter.currentBlockTime()
+
+	const samples = 1000
+	var total time.Duration
+	distinct := make(map[time.Duration]bool)
+	for i := 0; i < samples; i++ {
+		interval := minter.nextBlockTime()
+		if interval < base*8/10 || interval > base*12/10 {
+			t.Fatalf("block time %v outside of %v ± 20%%", interval, base)
+		}
+		total += interval
+		distinct[interval] = true
+	}
+	if len(distinct) < samples/2 {
+		t.Errorf("block time barely varies: %d distinct values in %d", len(distinct), samples)
+	}
+	if average := total / samples; average < base*97/100 || average > base*103/100 {
+		t.Errorf("average block time %v, expected about %v", average, base)
+	}
+
+	// Excessive jitter is capped, so the block time stays above the floor.
+	minter.reconfigure(func(settings *MinterConfig) { settings.BlockTimeJitter = 5 })
+	for i := 0; i < samples; i++ {
+		if interval := minter.nextBlockTime(); interval < base/2 || interval > base*3/2 {
+			t.Fatalf("block time %v outside of %v ± 50%%", interval, base)
+		}
+	}
+}
+
+func TestThrottleJittersIntervals(t *testing.T) {
+	const jitter = 0.2
+	minter, _ := newTestMinter(t, &MinterConfig{BlockTimeJitter: jitter})
+	defer minter.close()
+	base := minter.currentBlockTime()
+
+	calls := make(chan time.Time, 100)
+	call, stop := throttle(minter.nextBlockTime, nil, nil, func() { calls <- time.Now() })
+	defer stop()
+
+	// Keep requesting, so that every period ends with a call. Requests stop
+	// before the throttle does, since stopping it closes its request channel.
+	done := make(chan struct{})
+	var requesting sync.WaitGroup
+	defer requesting.Wait()
+	defer close(done)
+	requesting.Add(1)
+	go func() {
+		defer requesting.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				call()
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}()
+
+	// Timers never fire early, but calls may start a little late.
+	lower, upper := time.Duration(float64(base)*(1-jitter))-time.Millisecond, time.Duration(float64(base)*(1+jitter))+base/4
+	prev := <-calls
+	distinct := make(map[time.Duration]bool)
+	for i := 0; i < 15; i++ {
+		next := <-calls
+		interval := next.Sub(prev)
+		if interval < lower || interval > upper {
+			t.Errorf("interval %v outside of [%v, %v]", interval, lower, upper)
+		}
+		distinct[interval/time.Millisecond] = true
+		prev = next
+	}
+	if len(distinct) < 3 {
+		t.Errorf("intervals barely vary: %d distinct values", len(distinct))
+	}
+}
+
+func TestMinterPendingState(t *testing.T) {
+	minter, backend := newTestMinter(t, nil)
+	defer minter.close()
+
+	// Stores 42, and returns it when called.
+	code := common.FromHex("602a600055600b6011600039600b6000f3" + "60005460005260206000f3")
+	creation := contractCreation(t, testKey, 0, code)
+	addTransactions(t, backend, creation)
+	pending := minter.mintNewBlock()
+	if pending == nil {
+		t.Fatalf("expected a block to be minted")
+	}
+	contract := crypto.CreateAddress(crypto.PubkeyToAddress(testKey.PublicKey), 0)
+	if backend.chain.CurrentBlock().Hash() == pending.Hash() {
+		t.Fatalf("pending block unexpectedly in the chain")
+	}
+
+	block, publicState, privateState, err := minter.pendingState()
+	if err != nil {
+		t.Fatalf("failed to get pending state: %v", err)
+	}
+	if block.Hash() != pending.Hash() {
+		t.Fatalf("pending state of block %x, expected %x", block.Hash(), pending.Hash())
+	}
+
+	call, err := types.NewTransaction(1, contract, big.NewInt(0), big.NewInt(100000), big.NewInt(0), nil).SignECDSA(testKey)
+	if err != nil {
+		t.Fatalf("failed to sign call: %v", err)
+	}
+	env := core.NewEnv(publicState, privateState, backend.chain.Config(), backend.chain, call, block.Header(), vm.Config{})
+	ret, _, err := core.ApplyMessage(env, call, new(core.GasPool).AddGas(block.GasLimit()))
+	if err != nil {
+		t.Fatalf("call failed: %v", err)
+	}
+	if new(big.Int).SetBytes(ret).Int64() != 42 {
+		t.Errorf("call returned %x, expected 42", ret)
+	}
+
+	// The call's effects stay in the copy.
+	minter.mu.Lock()
+	work := createTestWork(t, minter)
+	minter.mu.Unlock()
+	if nonce := work.publicState.GetNonce(crypto.PubkeyToAddress(testKey.PublicKey)); nonce != 1 {
+		t.Errorf("call leaked into the minter's state: nonce %d", nonce)
+	}
+}
+
+func TestMinterDropsRepeatedlyFailingTransactions(t *testing.T) {
+	minter, backend := newTestMinter(t, &MinterConfig{MaxTxFailures: 3})
+	defer minter.close()
+	sub := backend.mux.Subscribe(TxDroppedEvent{}, RoundSummaryEvent{})
+	defer sub.Unsubscribe()
+
+	// Once the first transaction is minted, the sender can't afford the
+	// second, though the pool, going by the chain, still accepts it.
+	addTransactions(t, backend, signedTransaction(t, testKey3, 0, testRecvr, testBalance))
+	if minter.mintNewBlock() == nil {
+		t.Fatalf("expected a block to be minted")
+	}
+	failing := signedTransaction(t, testKey3, 1, testRecvr, big.NewInt(1))
+	addTransactions(t, backend, failing)
+
+	for round := 1; round < 3; round++ {
+		minter.mintNewBlock()
+		if backend.txPool.Get(failing.Hash()) == nil {
+			t.Fatalf("transaction dropped after %d failures", round)
+		}
+	}
+	minter.mintNewBlock()
+	if backend.txPool.Get(failing.Hash()) != nil {
+		t.Fatalf("transaction not dropped after 3 failures")
+	}
+
+	// The drop is posted in order with the summaries of the rounds, before
+	// that of the round which dropped the transaction.
+	var posted []interface{}
+	for len(posted) < 5 {
+		select {
+		case ev := <-sub.Chan():
+			posted = append(posted, ev.Data)
+		case <-time.After(time.Second):
+			t.Fatalf("only %d events posted: %+v", len(posted), posted)
+		}
+	}
+	for i, ev := range posted {
+		if i == 3 {
+			if dropped, ok := ev.(TxDroppedEvent); !ok || dropped.Tx.Hash() != failing.Hash() {
+				t.Errorf("event %d is %+v, expected %x to be dropped", i, ev, failing.Hash())
+			}
+		} else if _, ok := ev.(RoundSummaryEvent); !ok {
+			t.Errorf("event %d is %+v, expected a round summary", i, ev)
+		}
+	}
+}
+
+func TestMinterDoesNotStarveChainUpdates(t *testing.T) {
+	minter, backend := newTestMinter(t, &MinterConfig{OnDemand: true})
+	defer minter.close()
+	minter.start()
+	for nonce := uint64(0); nonce < 50; nonce++ {
+		addTransactions(t, backend, signedTransaction(t, testKey, nonce, testRecvr, big.NewInt(1)))
+	}
+
+	// Keep several rounds contending for the lock.
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					minter.mintNewBlock()
+				}
+			}
+		}()
+	}
+	defer func() {
+		close(done)
+		wg.Wait()
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	for i := 0; i < 10; i++ {
+		start := time.Now()
+		minter.updateSpeculativeChainPerNewHead(backend.chain.CurrentBlock())
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Fatalf("new head handled after %v", elapsed)
+		}
+	}
+}
+
+func TestMinterLifetimeCounters(t *testing.T) {
+	minter, backend := newTestMinter(t, nil)
+	defer minter.close()
+	minter.startTime = time.Now().Add(-time.Minute)
+
+	for nonce := uint64(0); nonce < 3; nonce++ {
+		addTransactions(t, backend,
+			signedTransaction(t, testKey, nonce, testRecvr, big.NewInt(1)),
+			signedTransaction(t, testKey2, nonce, testRecvr, big.NewInt(1)),
+		)
+		if minter.mintNewBlock() == nil {
+			t.Fatalf("expected a block to be minted")
+		}
+	}
+	// Rounds with nothing to mint don't count.
+	minter.mintNewBlock()
+
+	lifetime := minter.lifetime()
+	if lifetime.BlocksMinted != 3 || lifetime.TxesCommitted != 6 {
+		t.Errorf("expected 3 blocks with 6 transactions, got %d with %d", lifetime.BlocksMinted, lifetime.TxesCommitted)
+	}
+	if lifetime.Uptime < 60 || lifetime.Uptime > 120 {
+		t.Errorf("unexpected uptime of %ds", lifetime.Uptime)
+	}
+}
+
+func TestMinterAppliesTxTransform(t *testing.T) {
+	var order types.Transactions
+	minter, backend := newTestMinter(t, &MinterConfig{
+		// Reverses the default order.
+		TxTransform: func(txes types.Transactions) types.Transactions {
+			order = make(types.Transactions, len(txes))
+			for i, tx := range txes {
+				order[len(txes)-1-i] = tx
+			}
+			return order
+		},
+	})
+	defer minter.close()
+	addTransactions(t, backend,
+		signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1)),
+		signedTransaction(t, testKey2, 0, testRecvr, big.NewInt(1)),
+		signedTransaction(t, testKey3, 0, testRecvr, big.NewInt(1)),
+	)
+
+	block := minter.mintNewBlock()
+	if block == nil {
+		t.Fatalf("expected a block to be minted")
+	}
+	if len(block.Transactions()) != len(order) {
+		t.Fatalf("minted %d transactions, expected %d", len(block.Transactions()), len(order))
+	}
+	for i, tx := range block.Transactions() {
+		if tx.Hash() != order[i].Hash() {
+			t.Errorf("transaction %d is %x, expected %x", i, tx.Hash(), order[i].Hash())
+		}
+	}
+}
+
+func TestTxListSkipsPoppedSenders(t *testing.T) {
+	first := signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1))
+	other := signedTransaction(t, testKey2, 0, testRecvr, big.NewInt(1))
+	second := signedTransaction(t, testKey, 1, testRecvr, big.NewInt(1))
+
+	list := newTxList(types.Transactions{first, other, second})
+	list.Pop()
+	if tx := list.Peek(); tx != other {
+		t.Fatalf("expected the other sender's transaction next, got %v", tx)
+	}
+	list.Shift()
+	if tx := list.Peek(); tx != nil {
+		t.Errorf("expected the popped sender's transactions to be skipped, got %x", tx.Hash())
+	}
+}
+
+func TestMinterMintsNoUncles(t *testing.T) {
+	minter, backend := newTestMinter(t, nil)
+	defer minter.close()
+	addTransactions(t, backend, signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1)))
+
+	block := minter.mintNewBlock()
+	if block == nil {
+		t.Fatalf("expected a block to be minted")
+	}
+	if len(block.Uncles()) != 0 || block.UncleHash() != types.EmptyUncleHash {
+		t.Errorf("minted block has %d uncles", len(block.Uncles()))
+	}
+
+	withUncles := types.NewBlock(block.Header(), nil, []*types.Header{backend.chain.Genesis().Header()}, nil)
+	if err := ensureNoUncles(withUncles); err == nil {
+		t.Errorf("expected a block with uncles to be refused")
+	}
+}
+
+func TestMinterMintsExpectedDifficulty(t *testing.T) {
+	minter, backend := newTestMinter(t, nil)
+	defer minter.close()
+	addTransactions(t, backend, signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1)))
+
+	block := minter.mintNewBlock()
+	if block == nil {
+		t.Fatalf("expected a block to be minted")
+	}
+	genesis := backend.chain.Genesis()
+	expected := core.CalcDifficulty(minter.config, block.Time().Uint64(), genesis.Time().Uint64(), genesis.Number(), genesis.Difficulty())
+	if block.Difficulty().Cmp(expected) != 0 {
+		t.Errorf("minted block has difficulty %v, want %v", block.Difficulty(), expected)
+	}
+
+	header := block.Header()
+	header.Difficulty = new(big.Int).Add(expected, common.Big1)
+	if err := ensureDifficulty(minter.config, genesis.Header(), types.NewBlockWithHeader(header)); err == nil {
+		t.Errorf("expected a block with the wrong difficulty to be refused")
+	}
+}
+
+func TestMinterPausesOnInvalidBlock(t *testing.T) {
+	// Stands in for a bug setting the wrong difficulty.
+	minter, backend := newTestMinter(t, &MinterConfig{WorkDecorator: func(pw *PendingWork) {
+		pw.Header().Difficulty = new(big.Int).Add(pw.Header().Difficulty, common.Big1)
+	}})
+	defer minter.close()
+	addTransactions(t, backend, signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1)))
+
+	if block, err := minter.mintNewBlockSync(); err == nil {
+		t.Fatalf("minted block %x with the wrong difficulty", block.Hash())
+	}
+	if !minter.status().Diverged {
+		t.Fatalf("minting not paused after an invalid block")
+	}
+	if _, err := minter.mintNewBlockSync(); err != errDiverged {
+		t.Fatalf("minting while paused: have %v, want %v", err, errDiverged)
+	}
+
+	minter.reconfigure(func(settings *MinterConfig) { settings.WorkDecorator = nil })
+	if !minter.resumeAfterDivergence() {
+		t.Fatalf("minting wasn't reported as paused")
+	}
+	if block, err := minter.mintNewBlockSync(); err != nil || block.NumberU64() != 1 {
+		t.Fatalf("failed to mint block 1 after resuming: %v %v", block, err)
+	}
+}
+
+func TestMinterEmptyBlockFastPath(t *testing.T) {
+	minter, backend := newTestMinter(t, nil)
+	defer minter.close()
+	genesis := backend.chain.Genesis()
+
+	fast, _, _, err := minter.mintExplicit(genesis, nil)
+	if err != nil {
+		t.Fatalf("failed to mint empty block: %v", err)
+	}
+
+	minter.mu.Lock()
+	work, err := minter.createWorkAt(minter.currentSettings(), genesis, fast.Time().Int64())
+	if err != nil {
+		t.Fatalf("failed to create work: %v", err)
+	}
+	work.commitTransactions(newTxList(nil), minter.chain)
+	full, err := work.assembleBlock(nil, nil, nil, nil)
+	minter.mu.Unlock()
+	if err != nil {
+		t.Fatalf("failed to assemble block: %v", err)
+	}
+
+	fastRLP, _ := rlp.EncodeToBytes(fast)
+	fullRLP, _ := rlp.EncodeToBytes(full)
+	if !bytes.Equal(fastRLP, fullRLP) {
+		t.Errorf("empty blocks differ:\nfast path %x\nfull path %x", fastRLP, fullRLP)
+	}
+	if fast.Root() == genesis.Root() {
+		t.Errorf("block reward missing from the empty block's state")
+	}
+}
+
+func TestMinterHandlesContractSenders(t *testing.T) {
+	errRejected := errors.New("rejected by handler")
+	sender := crypto.PubkeyToAddress(testKey.PublicKey)
+
+	for _, test := range []struct {
+		settings *MinterConfig
+		reason   error // nil if minted
+	}{
+		{&MinterConfig{}, nil},
+		{&MinterConfig{DropContractSenders: true}, errContractSender},
+		{&MinterConfig{ContractSenderHandler: func(*types.Transaction) error { return nil }}, nil},
+		{&MinterConfig{DropContractSenders: true, ContractSenderHandler: func(*types.Transaction) error { return errRejected }}, errRejected},
+	} {
+		minter, backend := newTestMinter(t, test.settings)
+		defer minter.close()
+		tx := signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1))
+		addTransactions(t, backend, tx)
+
+		minter.mu.Lock()
+		work := createTestWork(t, minter)
+		work.publicState.SetCode(sender, []byte{0x60, 0x00})
+		committed, _, _, _ := work.commitTransactions(minter.getTransactions(), minter.chain)
+		minter.mu.Unlock()
+
+		if test.reason == nil {
+			if len(committed) != 1 {
+				t.Errorf("%+v: expected the transaction to be minted", test.settings)
+			}
+			continue
+		}
+		if len(committed) != 0 || len(work.skipped) != 1 {
+			t.Fatalf("%+v: expected the transaction to be skipped", test.settings)
+		}
+		if skipped := work.skipped[0]; skipped.Reason != test.reason || !skipped.Dropped {
+			t.Errorf("%+v: unexpected skipped transaction %+v", test.settings, skipped)
+		}
+	}
+}
+
+func TestMinterMintsOnTrigger(t *testing.T) {
+	trigger := make(chan struct{})
+	minter, backend := newTestMinter(t, &MinterConfig{Trigger: trigger})
+	defer minter.close()
+	minter.start()
+
+	for nonce := uint64(0); nonce < 3; nonce++ {
+		addTransactions(t, backend, signedTransaction(t, testKey, nonce, testRecvr, big.NewInt(1)))
+
+		// Pending transactions alone don't cause minting.
+		time.Sleep(2 * minter.currentBlockTime())
+		if head := speculativeHead(minter); head.NumberU64() != nonce {
+			t.Fatalf("block %d minted without a trigger", head.NumberU64())
+		}
+
+		trigger <- struct{}{}
+		waitForHead(t, minter, nonce+1, time.Second)
+	}
+
+	// Triggers with nothing to mint don't produce blocks.
+	trigger <- struct{}{}
+	trigger <- struct{}{}
+	if head := speculativeHead(minter); head.NumberU64() != 3 {
+		t.Errorf("expected 3 blocks, one per trigger, got %d", head.NumberU64())
+	}
+}
+
+func TestMinterRecordsBlockTimings(t *testing.T) {
+	minter, backend := newTestMinter(t, nil)
+	defer minter.close()
+	addTransactions(t, backend, signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1)))
+
+	start := time.Now()
+	block := minter.mintNewBlock()
+	elapsed := time.Since(start)
+	if block == nil {
+		t.Fatalf("expected a block to be minted")
+	}
+
+	timings, ok := minter.timingsOf(block.Hash())
+	if !ok {
+		t.Fatalf("no timings recorded for block %x", block.Hash())
+	}
+	phases := []time.Duration{timings.StateFetch, timings.Packing, timings.Reward, timings.Commit}
+	var sum time.Duration
+	for i, phase := range phases {
+		if phase <= 0 {
+			t.Errorf("phase %d not timed", i)
+		}
+		sum += phase
+	}
+	if sum > timings.Total || timings.Total > elapsed {
+		t.Errorf("phases took %v out of %v, in a round of %v", sum, timings.Total, elapsed)
+	}
+	if timings.Total-sum > timings.Total/2+time.Millisecond {
+		t.Errorf("phases only account for %v out of %v", sum, timings.Total)
+	}
+	if _, ok := minter.timingsOf(common.Hash{}); ok {
+		t.Errorf("timings reported for an unknown block")
+	}
+}
+
+func TestMinterMintsEmptyBlocksWhenIdle(t *testing.T) {
+	minter, backend := newTestMinter(t, &MinterConfig{EmptyBlockPeriod: 100 * time.Millisecond})
+	defer minter.close()
+	sub := backend.mux.Subscribe(core.NewMinedBlockEvent{})
+	defer sub.Unsubscribe()
+
+	mined := make(chan *types.Block, 10)
+	go func() {
+		for ev := range sub.Chan() {
+			mined <- ev.Data.(core.NewMinedBlockEvent).Block
+		}
+	}()
+
+	minter.start()
+	head := waitForHead(t, minter, 2, 2*time.Second)
+	if len(head.Transactions()) != 0 {
+		t.Errorf("expected an empty block, got %d transactions", len(head.Transactions()))
+	}
+	if parent := backend.chain.Genesis(); head.NumberU64() == 1 && head.ParentHash() != parent.Hash() {
+		t.Errorf("empty block doesn't extend the chain")
+	}
+	for number := uint64(1); number <= 2; number++ {
+		select {
+		case block := <-mined:
+			if block.NumberU64() != number {
+				t.Errorf("NewMinedBlockEvent for block %d, expected %d", block.NumberU64(), number)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no NewMinedBlockEvent for empty block %d", number)
+		}
+	}
+}
+
+func TestMinterSkipsEmptyBlocksByDefault(t *testing.T) {
+	minter, _ := newTestMinter(t, nil)
+	defer minter.close()
+	minter.start()
+	minter.requestMinting()
+
+	time.Sleep(4 * minter.currentBlockTime())
+	if head := speculativeHead(minter); head.NumberU64() != 0 {
+		t.Errorf("empty block %d minted", head.NumberU64())
+	}
+}
+
+// A subscription delivering events from a plain channel, bypassing the mux's
+// filtering by type.
+type chanSubscription chan *event.Event
+
+func (sub chanSubscription) Chan() <-chan *event.Event { return sub }
+func (sub chanSubscription) Unsubscribe()              {}
+
+func TestEventLoopIgnoresUnexpectedEvents(t *testing.T) {
+	minter, backend := newTestMinter(t, nil)
+	defer minter.close()
+	minter.start()
+
+	events := make(chanSubscription)
+	go minter.eventLoop(events)
+	events <- &event.Event{Data: core.NewMinedBlockEvent{}}
+	events <- &event.Event{Data: core.TxPreEvent{}}
+
+	addTransactions(t, backend, signedTransaction(t, testKey, 0, testAddress, big.NewInt(1)))
+	head := waitForHead(t, minter, 1, 2*time.Second)
+	if len(head.Transactions()) != 1 {
+		t.Errorf("expected 1 transaction, got %d", len(head.Transactions()))
+	}
+	if n := atomic.LoadUint64(&minter.unexpectedEvents); n != 1 {
+		t.Errorf("expected 1 unexpected event, got %d", n)
+	}
+}
+
+var errInjected = errors.New("injected database failure")
+
+// A database whose reads and batch writes fail while the respective flag is
+// set, and whose batch writes take at least writeDelay.
+type failingDatabase struct {
+	*ethdb.MemDatabase
+	failReads  int32 // Atomic
+	failWrites int32 // Atomic
+	writeDelay time.Duration
+}
+
+func (db *failingDatabase) Get(key []byte) ([]byte, error) {
+	if atomic.LoadInt32(&db.failReads) == 1 {
+		return nil, errInjected
+	}
+	return db.MemDatabase.Get(key)
+}
+
+func (db *failingDatabase) NewBatch() ethdb.Batch {
+	return &failingBatch{Batch: db.MemDatabase.NewBatch(), db: db}
+}
+
+type failingBatch struct {
+	ethdb.Batch
+	db *failingDatabase
+}
+
+func (b *failingBatch) Write() error {
+	time.Sleep(b.db.writeDelay)
+	if atomic.LoadInt32(&b.db.failWrites) == 1 {
+		return errInjected
+	}
+	return b.Batch.Write()
+}
+
+func newFailingTestMinter(t testing.TB, blockTime time.Duration, settings *MinterConfig) (*minter, *testBackend, *failingDatabase) {
+	mem, _ := ethdb.NewMemDatabase()
+	db := &failingDatabase{MemDatabase: mem}
+	backend := newTestBackendOn(t, db)
+	minter, err := newMinter(backend.chain.Config(), backend, blockTime, settings)
+	if err != nil {
+		t.Fatalf("failed to create minter: %v", err)
+	}
+	return minter, backend, db
+}
+
+func TestMinterSurvivesStateCommitFailure(t *testing.T) {
+	minter, backend, db := newFailingTestMinter(t, 50*time.Millisecond, nil)
+	addTransactions(t, backend, signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1)))
+
+	atomic.StoreInt32(&db.failWrites, 1)
+	if block := minter.mintNewBlock(); block != nil {
+		t.Fatalf("minted block %d although its state couldn't be committed", block.NumberU64())
+	}
+	if head := speculativeHead(minter); head.NumberU64() != 0 {
+		t.Fatalf("speculative head advanced to %d after a failed commit", head.NumberU64())
+	}
+
+	atomic.StoreInt32(&db.failWrites, 0)
+	block := minter.mintNewBlock()
+	if block == nil || block.NumberU64() != 1 || len(block.Transactions()) != 1 {
+		t.Fatalf("failed to mint block 1 once the database recovered: %v", block)
+	}
+}
+
+func TestMinterSurvivesStateReadFailure(t *testing.T) {
+	minter, backend, db := newFailingTestMinter(t, 50*time.Millisecond, nil)
+	addTransactions(t, backend, signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1)))
+
+	atomic.StoreInt32(&db.failReads, 1)
+	minter.mu.Lock()
+	_, err := minter.createWork()
+	minter.mu.Unlock()
+	if err == nil {
+		t.Fatalf("expected an error reading the parent state")
+	}
+	if block := minter.mintNewBlock(); block != nil {
+		t.Fatalf("minted block %d without the parent state", block.NumberU64())
+	}
+
+	atomic.StoreInt32(&db.failReads, 0)
+	if block := minter.mintNewBlock(); block == nil || block.NumberU64() != 1 {
+		t.Fatalf("failed to mint block 1 once the database recovered: %v", block)
+	}
+}
+
+func TestMinterCommitsBundlesAtomically(t *testing.T) {
+	trigger := make(chan struct{})
+	minter, backend := newTestMinter(t, &MinterConfig{Trigger: trigger})
+	defer minter.close()
+	minter.start()
+
+	// The second transaction has a nonce gap, so the bundle fails as a whole.
+	failing := types.Transactions{
+		signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1)),
+		signedTransaction(t, testKey2, 1, testRecvr, big.NewInt(1)),
+	}
+	if err := minter.submitBundle(failing); err != nil {
+		t.Fatalf("failed to submit bundle: %v", err)
+	}
+	addTransactions(t, backend, signedTransaction(t, testKey3, 0, testRecvr, big.NewInt(1)))
+	trigger <- struct{}{}
+
+	block := waitForHead(t, minter, 1, 2*time.Second)
+	if len(block.Transactions()) != 1 || block.Transactions()[0].Hash() == failing[0].Hash() {
+		t.Fatalf("expected only the pool transaction, got %d transactions", len(block.Transactions()))
+	}
+
+	bundle := types.Transactions{
+		signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1)),
+		signedTransaction(t, testKey2, 0, testRecvr, big.NewInt(1)),
+	}
+	addTransactions(t, backend, signedTransaction(t, testKey3, 1, testRecvr, big.NewInt(1)))
+	if err := minter.submitBundle(bundle); err != nil {
+		t.Fatalf("failed to submit bundle: %v", err)
+	}
+	trigger <- struct{}{}
+
+	txes := waitForHead(t, minter, 2, 2*time.Second).Transactions()
+	if len(txes) != 3 {
+		t.Fatalf("expected the bundle and the pool transaction, got %d transactions", len(txes))
+	}
+	if txes[0].Hash() != bundle[0].Hash() || txes[1].Hash() != bundle[1].Hash() {
+		t.Errorf("bundle not minted consecutively at the start of the block")
+	}
+}
+
+func TestBundlesGetPoolTransactionChecks(t *testing.T) {
+	minter, _ := newTestMinter(t, &MinterConfig{DropCollidingCreations: true})
+	defer minter.close()
+	minter.mu.Lock()
+	defer minter.mu.Unlock()
+
+	// Reasons the transactions of a round's bundles were skipped for.
+	commit := func(work *work, bundles ...types.Transactions) []string {
+		work.bundles = bundles
+		work.commitTransactions(minter.getTransactions(), minter.chain)
+		var reasons []string
+		for _, skipped := range work.skipped {
+			reasons = append(reasons, skipped.Reason.Error())
+		}
+		return reasons
+	}
+
+	// Priced below the floor.
+	work := createTestWork(t, minter)
+	work.minGasPrice = big.NewInt(1)
+	reasons := commit(work, types.Transactions{signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1))})
+	if len(reasons) != 1 || !strings.Contains(reasons[0], errBelowPriceFloor.Error()) {
+		t.Errorf("expected the bundle to be skipped for its price, got %v", reasons)
+	}
+
+	// Creating a contract over existing code.
+	work = createTestWork(t, minter)
+	colliding := contractCreation(t, testKey3, 0, nil)
+	work.publicState.SetCode(crypto.CreateAddress(crypto.PubkeyToAddress(testKey3.PublicKey), 0), []byte{0x60, 0x00})
+	reasons = commit(work, types.Transactions{colliding})
+	if len(reasons) != 1 || !strings.Contains(reasons[0], errCreationCollision.Error()) {
+		t.Errorf("expected the bundle to be skipped for the collision, got %v", reasons)
+	}
+
+	// Eating into the reserved gas.
+	work = createTestWork(t, minter)
+	work.settings = &MinterConfig{ReserveFreeGas: work.header.GasLimit.Uint64() - 30000}
+	reasons = commit(work, types.Transactions{
+		signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1)),
+		signedTransaction(t, testKey, 1, testRecvr, big.NewInt(1)),
+	})
+	if len(reasons) != 2 {
+		t.Errorf("expected the bundle not to fit outside the reserved gas, got %v", reasons)
+	}
+}
+
+func TestSubmitBundleRequiresMinting(t *testing.T) {
+	minter, _ := newTestMinter(t, nil)
+	defer minter.close()
+	bundle := types.Transactions{signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1))}
+	if err := minter.submitBundle(bundle); err != errNotMinting {
+		t.Errorf("expected %v, got %v", errNotMinting, err)
+	}
+	if err := minter.submitBundle(nil); err != errEmptyBatch {
+		t.Errorf("expected %v, got %v", errEmptyBatch, err)
+	}
+}
+
+func TestMinterCapsSpeculativeChain(t *testing.T) {
+	// Minting is only triggered explicitly, so that accepting a block
+	// doesn't mint on its own.
+	minter, backend := newTestMinter(t, &MinterConfig{MaxSpeculativeBlocks: 3, Trigger: make(chan struct{})})
+	defer minter.close()
+	minter.start()
+
+	var blocks []*types.Block
+	for nonce := uint64(0); nonce < 3; nonce++ {
+		addTransactions(t, backend, signedTransaction(t, testKey, nonce, testRecvr, big.NewInt(1)))
+		block := minter.mintNewBlock()
+		if block == nil {
+			t.Fatalf("failed to mint block %d", nonce+1)
+		}
+		blocks = append(blocks, block)
+	}
+
+	// None of the blocks has been accepted, so the chain is full.
+	addTransactions(t, backend, signedTransaction(t, testKey, 3, testRecvr, big.NewInt(1)))
+	for i := 0; i < 5; i++ {
+		if block := minter.mintNewBlock(); block != nil {
+			t.Fatalf("minted block %d beyond the speculative chain limit", block.NumberU64())
+		}
+	}
+	if head := speculativeHead(minter); head.NumberU64() != 3 {
+		t.Fatalf("speculative head is %d, expected 3", head.NumberU64())
+	}
+
+	// Once raft accepts a block, minting resumes.
+	if _, err := backend.chain.InsertChain(types.Blocks{blocks[0]}); err != nil {
+		t.Fatalf("failed to insert block 1: %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		minter.mu.Lock()
+		pending := minter.speculativeChain.unappliedBlocks.Size()
+		minter.mu.Unlock()
+		if pending < 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("block 1 was never accepted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if block := minter.mintNewBlock(); block == nil || block.NumberU64() != 4 {
+		t.Fatalf("failed to mint block 4 after acceptance: %v", block)
+	}
+}
+
+func TestMinterStatusReportsSpeculativeChain(t *testing.T) {
+	minter, backend := newTestMinter(t, &MinterConfig{Trigger: make(chan struct{})})
+	defer minter.close()
+
+	// Followers don't mint.
+	status := minter.status()
+	if status.Minting {
+		t.Errorf("follower reported as minting")
+	}
+	if status.BlockTime != 50 {
+		t.Errorf("block time mismatch: have %dms, want 50ms", status.BlockTime)
+	}
+	if genesis := backend.chain.Genesis(); status.HeadNumber != 0 || status.HeadHash != genesis.Hash() {
+		t.Errorf("head mismatch: have #%d (%x), want genesis", status.HeadNumber, status.HeadHash)
+	}
+
+	minter.start()
+	addTransactions(t, backend,
+		signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1)),
+		signedTransaction(t, testKey2, 0, testRecvr, big.NewInt(1)),
+	)
+	block := minter.mintNewBlock()
+	if block == nil {
+		t.Fatalf("failed to mint block")
+	}
+
+	status = minter.status()
+	if !status.Minting {
+		t.Errorf("leader not reported as minting")
+	}
+	if status.HeadNumber != 1 || status.HeadHash != block.Hash() {
+		t.Errorf("head mismatch: have #%d (%x), want #1 (%x)", status.HeadNumber, status.HeadHash, block.Hash())
+	}
+	if status.ProposedTxes != 2 {
+		t.Errorf("proposed transaction count mismatch: have %d, want 2", status.ProposedTxes)
+	}
+}
+
+func TestMinterReportsActivityChanges(t *testing.T) {
+	changes := make(chan bool, 10)
+	minter, backend := newTestMinter(t, &MinterConfig{
+		OnActivityChange: func(busy bool) { changes <- busy },
+		IdleThreshold:    100 * time.Millisecond,
+	})
+	defer minter.close()
+	expect := func(busy bool) {
+		select {
+		case change := <-changes:
+			if change != busy {
+				t.Fatalf("activity change mismatch: have busy=%v, want busy=%v", change, busy)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no activity change to busy=%v", busy)
+		}
+	}
+
+	for nonce := uint64(0); nonce < 2; nonce++ {
+		addTransactions(t, backend, signedTransaction(t, testKey, nonce, testRecvr, big.NewInt(1)))
+		if minter.mintNewBlock() == nil {
+			t.Fatalf("failed to mint block %d", nonce+1)
+		}
+	}
+	expect(true)
+	expect(false)
+
+	addTransactions(t, backend, signedTransaction(t, testKey, 2, testRecvr, big.NewInt(1)))
+	if minter.mintNewBlock() == nil {
+		t.Fatalf("failed to mint block 3")
+	}
+	expect(true)
+	expect(false)
+
+	select {
+	case change := <-changes:
+		t.Errorf("unexpected activity change to busy=%v", change)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestMinterCloseStopsIdleTimer(t *testing.T) {
+	changes := make(chan bool, 10)
+	minter, backend := newTestMinter(t, &MinterConfig{
+		OnActivityChange: func(busy bool) { changes <- busy },
+		IdleThreshold:    100 * time.Millisecond,
+	})
+	defer minter.close()
+
+	addTransactions(t, backend, signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1)))
+	if minter.mintNewBlock() == nil {
+		t.Fatalf("failed to mint block")
+	}
+	if busy := <-changes; !busy {
+		t.Fatalf("activity change mismatch: have busy=%v, want busy=true", busy)
+	}
+	minter.close()
+
+	select {
+	case change := <-changes:
+		t.Errorf("unexpected activity change to busy=%v after close", change)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+// Mints a block with a transfer, then unwinds it through an invalid ordering,
+// returning the unwound block.
+func mintAndUnwind(t *testing.T, minter *minter, backend *testBackend) *types.Block {
+	addTransactions(t, backend, signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1)))
+	block := minter.mintNewBlock()
+	if block == nil {
+		t.Fatalf("failed to mint block")
+	}
+	if err := core.WriteBlock(backend.chainDb, block); err != nil {
+		t.Fatalf("failed to write block: %v", err)
+	}
+	minter.updateSpeculativeChainPerInvalidOrdering(backend.chain.Genesis(), block)
+	if head := speculativeHead(minter); head.NumberU64() != 0 {
+		t.Fatalf("block not unwound, head is #%d", head.NumberU64())
+	}
+	return block
+}
+
+func TestMinterVerifiesRootsAfterUnwind(t *testing.T) {
+	minter, backend := newTestMinter(t, &MinterConfig{VerifyReorgRoots: true})
+	defer minter.close()
+	unwound := mintAndUnwind(t, minter, backend)
+
+	block := minter.mintNewBlock()
+	if block == nil || block.NumberU64() != 1 || block.Hash() == unwound.Hash() {
+		t.Fatalf("failed to re-mint block 1: %v", block)
+	}
+	if minter.status().Diverged || minter.reminting != 0 {
+		t.Errorf("consistent re-execution flagged as diverged")
+	}
+}
+
+func TestMinterPausesOnDivergentRootsAfterUnwind(t *testing.T) {
+	minter, backend := newTestMinter(t, &MinterConfig{VerifyReorgRoots: true})
+	defer minter.close()
+	mintAndUnwind(t, minter, backend)
+
+	// Credit one wei more whenever the rewards are accumulated a second time
+	// in a round, which is only the case when verifying.
+	var calls int
+	minter.reconfigure(func(settings *MinterConfig) {
+		settings.accumulateRewards = func(config *core.ChainConfig, statedb *state.StateDB, header *types.Header, uncles []*types.Header) {
+			core.AccumulateChainRewards(config, statedb, header, uncles)
+			if calls++; calls%2 == 0 {
+				statedb.AddBalance(header.Coinbase, big.NewInt(1))
+			}
+		}
+	})
+
+	if block := minter.mintNewBlock(); block != nil {
+		t.Fatalf("minted block %d with a divergent state root", block.NumberU64())
+	}
+	if !minter.status().Diverged {
+		t.Fatalf("minting not paused after a state root mismatch")
+	}
+	if block := minter.mintNewBlock(); block != nil {
+		t.Fatalf("minted block %d while paused", block.NumberU64())
+	}
+
+	minter.reconfigure(func(settings *MinterConfig) { settings.accumulateRewards = nil })
+	if !minter.resumeAfterDivergence() {
+		t.Fatalf("minting wasn't reported as paused")
+	}
+	if block := minter.mintNewBlock(); block == nil || block.NumberU64() != 1 {
+		t.Fatalf("failed to mint block 1 after resuming: %v", block)
+	}
+}
+
+func TestMinterBlockTimeAdjustableAtRuntime(t *testing.T) {
+	backend := newTestBackend(t)
+	minter, err := newMinter(backend.chain.Config(), backend, time.Hour, nil)
+	if err != nil {
+		t.Fatalf("failed to create minter: %v", err)
+	}
+	for _, blockTime := range []time.Duration{0, -time.Second} {
+		if err := minter.setBlockTime(blockTime); err != errInvalidBlockTime {
+			t.Errorf("block time %v: expected %v, got %v", blockTime, errInvalidBlockTime, err)
+		}
+	}
+
+	// Starting requests a round right away, which begins an hour-long period.
+	minter.start()
+	time.Sleep(100 * time.Millisecond)
+	addTransactions(t, backend, signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1)))
+	time.Sleep(200 * time.Millisecond)
+	if head := speculativeHead(minter); head.NumberU64() != 0 {
+		t.Fatalf("block %d minted within the hour-long block time", head.NumberU64())
+	}
+
+	// Shortening the block time cuts the current period short.
+	if err := minter.setBlockTime(50 * time.Millisecond); err != nil {
+		t.Fatalf("failed to set block time: %v", err)
+	}
+	waitForHead(t, minter, 1, time.Second)
+	if blockTime := minter.status().BlockTime; blockTime != 50 {
+		t.Errorf("block time mismatch: have %dms, want 50ms", blockTime)
+	}
+}
+
+func TestMinterMetersThroughput(t *testing.T) {
+	defer func(enabled bool) { metrics.Enabled = enabled }(metrics.Enabled)
+	metrics.Enabled = true
+
+	minter, backend := newTestMinter(t, &MinterConfig{MaxTxDataSize: 1})
+	defer minter.close()
+	m := minter.metrics
+	blocks, txes, dropped, emptySkips, elapsed := m.blocks.Count(), m.txes.Count(), m.dropped.Count(), m.emptySkips.Count(), m.elapsed.Count()
+
+	if block := minter.mintNewBlock(); block != nil {
+		t.Fatalf("minted block %d without transactions", block.NumberU64())
+	}
+
+	oversized, err := types.NewTransaction(0, testRecvr, big.NewInt(1), big.NewInt(100000), big.NewInt(0), []byte{1, 2}).SignECDSA(testKey3)
+	if err != nil {
+		t.Fatalf("failed to sign transaction: %v", err)
+	}
+	addTransactions(t, backend,
+		signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1)),
+		signedTransaction(t, testKey2, 0, testRecvr, big.NewInt(1)),
+		oversized,
+	)
+	if block := minter.mintNewBlock(); block == nil || len(block.Transactions()) != 2 {
+		t.Fatalf("expected a block with 2 transactions, got %v", block)
+	}
+
+	for _, check := range []struct {
+		name       string
+		have, want int64
+	}{
+		{"blocks", m.blocks.Count() - blocks, 1},
+		{"txs", m.txes.Count() - txes, 2},
+		{"dropped", m.dropped.Count() - dropped, 1},
+		{"emptyskips", m.emptySkips.Count() - emptySkips, 1},
+		{"elapsed", m.elapsed.Count() - elapsed, 1},
+	} {
+		if check.have != check.want {
+			t.Errorf("%s metric mismatch: have %d, want %d", check.name, check.have, check.want)
+		}
+	}
+}
+
+func TestMinterBoundsPendingEventPosting(t *testing.T) {
+	minter, backend := newTestMinter(t, &MinterConfig{MaxPendingEventPosts: 4})
+	defer minter.close()
+
+	// Nothing reads from this subscription, so posting to it blocks.
+	sub := backend.mux.Subscribe(core.PendingLogsEvent{})
+	defer sub.Unsubscribe()
+
+	before := runtime.NumGoroutine()
+	for nonce := uint64(0); nonce < 50; nonce++ {
+		addTransactions(t, backend, signedTransaction(t, testKey, nonce, testRecvr, big.NewInt(1)))
+		if minter.mintNewBlock() == nil {
+			t.Fatalf("failed to mint block %d", nonce+1)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	if grown := runtime.NumGoroutine() - before; grown > 10 {
+		t.Errorf("%d goroutines left behind by 50 rounds with a stuck subscriber", grown)
+	}
+	if queued := len(minter.pendingEvents); queued > 4 {
+		t.Errorf("%d rounds' pending events queued, expected at most 4", queued)
+	}
+}
+
+func TestMinterCoinbaseSettableAtRuntime(t *testing.T) {
+	minter, backend := newTestMinter(t, nil)
+	defer minter.close()
+	if coinbase := minter.getCoinbase(); coinbase != (common.Address{}) {
+		t.Fatalf("unexpected initial coinbase %x", coinbase)
+	}
+
+	addTransactions(t, backend, signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1)))
+	if block := minter.mintNewBlock(); block == nil || block.Coinbase() != (common.Address{}) {
+		t.Fatalf("expected a block crediting the initial coinbase, got %v", block)
+	}
+
+	coinbase := common.HexToAddress("0x0000000000000000000000000000000000000c0b")
+	minter.setCoinbase(coinbase)
+	if have := minter.getCoinbase(); have != coinbase {
+		t.Fatalf("coinbase mismatch: have %x, want %x", have, coinbase)
+	}
+	for nonce := uint64(1); nonce < 3; nonce++ {
+		addTransactions(t, backend, signedTransaction(t, testKey, nonce, testRecvr, big.NewInt(1)))
+		block := minter.mintNewBlock()
+		if block == nil || block.Coinbase() != coinbase {
+			t.Fatalf("expected block %d to credit %x, got %v", nonce+1, coinbase, block)
+		}
+	}
+}
+
+func TestMinterRecordsFailedTransactions(t *testing.T) {
+	minter, backend := newTestMinter(t, nil)
+	defer minter.close()
+
+	// Once the first transaction is minted, the sender can't afford the
+	// second, which holds back the third.
+	addTransactions(t, backend, signedTransaction(t, testKey3, 0, testRecvr, testBalance))
+	if minter.mintNewBlock() == nil {
+		t.Fatalf("expected a block to be minted")
+	}
+	failing := signedTransaction(t, testKey3, 1, testRecvr, big.NewInt(1))
+	heldBack := signedTransaction(t, testKey3, 2, testRecvr, big.NewInt(1))
+	addTransactions(t, backend, failing, heldBack, signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1)))
+
+	if block := minter.mintNewBlock(); block == nil || len(block.Transactions()) != 1 {
+		t.Fatalf("expected a block with only the unrelated transaction, got %v", block)
+	}
+
+	failures := minter.failedTransactions()
+	if len(failures) != 1 {
+		t.Fatalf("expected 1 recorded failure, got %d", len(failures))
+	}
+	failure := failures[0]
+	if failure.Tx != failing.Hash() || failure.From != crypto.PubkeyToAddress(testKey3.PublicKey) || failure.Nonce != 1 {
+		t.Errorf("wrong transaction recorded: %+v", failure)
+	}
+	if failure.Block != 2 || failure.Reason == "" {
+		t.Errorf("wrong failure details: %+v", failure)
+	}
+	if len(failure.HeldBack) != 1 || failure.HeldBack[0] != heldBack.Hash() {
+		t.Errorf("held back transactions mismatch: have %x, want [%x]", failure.HeldBack, heldBack.Hash())
+	}
+}
+
+func TestMinterDetectsCommitsSlowerThanBlockTime(t *testing.T) {
+	minter, backend, db := newFailingTestMinter(t, time.Millisecond, nil)
+	db.writeDelay = 10 * time.Millisecond
+
+	addTransactions(t, backend, signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1)))
+	if minter.mintNewBlock() == nil {
+		t.Fatalf("failed to mint block")
+	}
+	if !minter.commitTooSlow {
+		t.Errorf("slow commit not detected")
+	}
+	if blockTime := minter.currentBlockTime(); blockTime != time.Millisecond {
+		t.Errorf("block time changed to %v without auto-extension", blockTime)
+	}
+}
+
+func TestMinterExtendsBlockTimeBeyondCommitDuration(t *testing.T) {
+	minter, backend, db := newFailingTestMinter(t, time.Millisecond, &MinterConfig{AutoExtendBlockTime: true})
+	db.writeDelay = 10 * time.Millisecond
+
+	addTransactions(t, backend, signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1)))
+	block := minter.mintNewBlock()
+	if block == nil {
+		t.Fatalf("failed to mint block")
+	}
+	timings, _ := minter.timingsOf(block.Hash())
+	if blockTime := minter.currentBlockTime(); blockTime < 20*time.Millisecond || blockTime != 2*timings.Commit {
+		t.Errorf("block time %v not extended to twice the commit duration of %v", blockTime, timings.Commit)
+	}
+}
+
+func TestMinterCapsTransactionsPerBlock(t *testing.T) {
+	minter, backend := newTestMinter(t, &MinterConfig{MaxTxsPerBlock: 2})
+	defer minter.close()
+	addTransactions(t, backend,
+		signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1)),
+		signedTransaction(t, testKey, 1, testRecvr, big.NewInt(1)),
+		signedTransaction(t, testKey, 2, testRecvr, big.NewInt(1)),
+		signedTransaction(t, testKey2, 0, testRecvr, big.NewInt(1)),
+		signedTransaction(t, testKey3, 0, testRecvr, big.NewInt(1)),
+	)
+
+	for i, want := range []int{2, 2, 1} {
+		block := minter.mintNewBlock()
+		if block == nil || len(block.Transactions()) != want {
+			t.Fatalf("expected block %d with %d transactions, got %v", i+1, want, block)
+		}
+	}
+}
+
+func TestMinterCapsBatchesWithPoolTransactions(t *testing.T) {
+	minter, backend := newTestMinter(t, &MinterConfig{MaxTxsPerBlock: 3})
+	defer minter.close()
+	first := &txBatch{errC: make(chan error, 1), txes: types.Transactions{
+		signedTransaction(t, testKey2, 0, testRecvr, big.NewInt(1)),
+		signedTransaction(t, testKey2, 1, testRecvr, big.NewInt(1)),
+	}}
+	second := &txBatch{errC: make(chan error, 1), txes: types.Transactions{
+		signedTransaction(t, testKey3, 0, testRecvr, big.NewInt(1)),
+		signedTransaction(t, testKey3, 1, testRecvr, big.NewInt(1)),
+	}}
+	minter.mu.Lock()
+	minter.batches = []*txBatch{first, second}
+	minter.mu.Unlock()
+	addTransactions(t, backend,
+		signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1)),
+		signedTransaction(t, testKey, 1, testRecvr, big.NewInt(1)),
+	)
+
+	// The second batch would go over the cap, so it waits for the next block,
+	// while a pool transaction fills the first.
+	block := minter.mintNewBlock()
+	if block == nil || len(block.Transactions()) != 3 {
+		t.Fatalf("expected block 1 with 3 transactions, got %v", block)
+	}
+	if err := <-first.errC; err != nil {
+		t.Errorf("first batch failed: %v", err)
+	}
+	select {
+	case err := <-second.errC:
+		t.Fatalf("second batch resolved with the first block: %v", err)
+	default:
+	}
+
+	block = minter.mintNewBlock()
+	if block == nil || len(block.Transactions()) != 3 {
+		t.Fatalf("expected block 2 with 3 transactions, got %v", block)
+	}
+	if txes := block.Transactions(); txes[0].Hash() != second.txes[0].Hash() || txes[1].Hash() != second.txes[1].Hash() {
+		t.Errorf("second batch not minted ahead of the pool in block 2")
+	}
+	if err := <-second.errC; err != nil {
+		t.Errorf("second batch failed: %v", err)
+	}
+}
+
+func TestMinterMintsTransactionsBeyondCapRightAway(t *testing.T) {
+	minter, backend := newTestMinter(t, &MinterConfig{MaxTxsPerBlock: 2})
+	defer minter.close()
+	minter.start()
+	addTransactions(t, backend,
+		signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1)),
+		signedTransaction(t, testKey, 1, testRecvr, big.NewInt(1)),
+		signedTransaction(t, testKey, 2, testRecvr, big.NewInt(1)),
+		signedTransaction(t, testKey2, 0, testRecvr, big.NewInt(1)),
+		signedTransaction(t, testKey3, 0, testRecvr, big.NewInt(1)),
+	)
+
+	waitForHead(t, minter, 3, 2*time.Second)
+	if lifetime := minter.lifetime(); lifetime.BlocksMinted != 3 || lifetime.TxesCommitted != 5 {
+		t.Errorf("expected 5 transactions in 3 blocks, got %d in %d", lifetime.TxesCommitted, lifetime.BlocksMinted)
+	}
+}
+
+func TestMinterAppliesTxStatePredicate(t *testing.T) {
+	threshold := big.NewInt(1e18)
+	minter, backend := newTestMinter(t, &MinterConfig{
+		TxStatePredicate: func(tx *types.Transaction, publicState *state.StateDB) bool {
+			from, _ := tx.From()
+			return publicState.GetBalance(from).Cmp(threshold) >= 0
+		},
+	})
+	defer minter.close()
+
+	// Afterwards the sender has no balance left, though it could still send
+	// transfers of nothing.
+	addTransactions(t, backend, signedTransaction(t, testKey3, 0, testRecvr, testBalance))
+	if block := minter.mintNewBlock(); block == nil || len(block.Transactions()) != 1 {
+		t.Fatalf("expected a block with the transaction draining the balance, got %v", block)
+	}
+
+	qualifying := signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1))
+	addTransactions(t, backend, qualifying, signedTransaction(t, testKey3, 1, testRecvr, big.NewInt(0)))
+	block := minter.mintNewBlock()
+	if block == nil || len(block.Transactions()) != 1 || block.Transactions()[0].Hash() != qualifying.Hash() {
+		t.Fatalf("expected a block with only the qualifying transaction, got %v", block)
+	}
+}
+
+// stepClock advances by a fixed step each time it's read.
+type stepClock struct {
+	mu   sync.Mutex
+	now  time.Time
+	step time.Duration
+}
+
+func (clock *stepClock) Now() time.Time {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	clock.now = clock.now.Add(clock.step)
+	return clock.now
+}
+
+func TestMinterMintsReproduciblyWithFakeClock(t *testing.T) {
+	txes := types.Transactions{
+		signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1)),
+		signedTransaction(t, testKey, 1, testRecvr, big.NewInt(2)),
+	}
+	mintChain := func() []common.Hash {
+		minter, backend := newTestMinter(t, &MinterConfig{
+			Clock: &stepClock{now: time.Unix(1500000000, 0), step: time.Second},
+		})
+		defer minter.close()
+		var hashes []common.Hash
+		for _, tx := range txes {
+			addTransactions(t, backend, tx)
+			block := minter.mintNewBlock()
+			if block == nil {
+				t.Fatalf("expected a block to be minted")
+			}
+			hashes = append(hashes, block.Hash())
+		}
+		return hashes
+	}
+
+	first, second := mintChain(), mintChain()
+	if !reflect.DeepEqual(first, second) {
+		t.Errorf("chains differ across runs: %x and %x", first, second)
+	}
+}
+
+func TestMinterTimestampsIncreaseUnderStoppedClock(t *testing.T) {
+	minter, backend := newTestMinter(t, &MinterConfig{
+		Clock: &stepClock{now: time.Unix(0, 0)},
+	})
+	defer minter.close()
+	parentTime := minter.speculativeChain.head.Time().Int64()
+	for nonce := uint64(0); nonce < 3; nonce++ {
+		addTransactions(t, backend, signedTransaction(t, testKey, nonce, testRecvr, big.NewInt(1)))
+		block := minter.mintNewBlock()
+		if block == nil {
+			t.Fatalf("expected a block to be minted")
+		}
+		if block.Time().Int64() <= parentTime {
+			t.Fatalf("block #%v has timestamp %v, not after its parent's %v", block.Number(), block.Time(), parentTime)
+		}
+		parentTime = block.Time().Int64()
+	}
+}
+
+func TestMinterCoinbaseChangeSparesSpeculativeBlocks(t *testing.T) {
+	minter, backend := newTestMinter(t, &MinterConfig{Trigger: make(chan struct{})})
+	defer minter.close()
+	minter.start()
+
+	addTransactions(t, backend, signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1)))
+	before := minter.mintNewBlock()
+	if before == nil {
+		t.Fatalf("failed to mint block 1")
+	}
+
+	coinbase := common.HexToAddress("0x0000000000000000000000000000000000000c0b")
+	minter.setCoinbase(coinbase)
+	addTransactions(t, backend, signedTransaction(t, testKey2, 0, testRecvr, big.NewInt(1)))
+	after := minter.mintNewBlock()
+	if after == nil || after.ParentHash() != before.Hash() {
+		t.Fatalf("expected block 2 on top of block 1, got %v", after)
+	}
+
+	if before.Coinbase() != (common.Address{}) {
+		t.Errorf("in-flight block 1 credits %x after the coinbase change", before.Coinbase())
+	}
+	if after.Coinbase() != coinbase {
+		t.Errorf("block 2 credits %x, expected %x", after.Coinbase(), coinbase)
+	}
+	// Both blocks still validate, rewards included, once raft accepts them.
+	if _, err := backend.chain.InsertChain(types.Blocks{before, after}); err != nil {
+		t.Fatalf("failed to insert blocks across the coinbase change: %v", err)
+	}
+	if head := backend.chain.CurrentBlock(); head.Hash() != after.Hash() {
+		t.Errorf("chain head is #%d, expected block 2", head.NumberU64())
+	}
+}
+
+func TestMinterPostsCompactPendingBlocks(t *testing.T) {
+	minter, backend := newTestMinter(t, &MinterConfig{CompactPendingBlocks: true})
+	defer minter.close()
+	sub := backend.mux.Subscribe(CompactPendingBlockEvent{})
+	defer sub.Unsubscribe()
+
+	txes := types.Transactions{
+		signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1)),
+		signedTransaction(t, testKey2, 0, testRecvr, big.NewInt(1)),
+	}
+	addTransactions(t, backend, txes...)
+	block := minter.mintNewBlock()
+	if block == nil || len(block.Transactions()) != len(txes) {
+		t.Fatalf("expected a block with %d transactions, got %v", len(txes), block)
+	}
+
+	var compact CompactPendingBlockEvent
+	select {
+	case ev := <-sub.Chan():
+		compact = ev.Data.(CompactPendingBlockEvent)
+	case <-time.After(time.Second):
+		t.Fatalf("no CompactPendingBlockEvent posted")
+	}
+	if hash := compact.Header.Hash(); hash != block.Hash() {
+		t.Errorf("compact header hashes to %x, expected %x", hash, block.Hash())
+	}
+	if len(compact.TxHashes) != len(block.Transactions()) {
+		t.Fatalf("expected %d transaction hashes, got %d", len(block.Transactions()), len(compact.TxHashes))
+	}
+	for i, tx := range block.Transactions() {
+		if compact.TxHashes[i] != tx.Hash() {
+			t.Errorf("transaction hash %d is %x, expected %x", i, compact.TxHashes[i], tx.Hash())
+		}
+	}
+}
+
+func TestMinterCloseStopsGoroutines(t *testing.T) {
+	backend := newTestBackend(t)
+	settings := &MinterConfig{
+		EmptyBlockPeriod: 20 * time.Millisecond,
+		HealthCheck:      func() error { return nil },
+		BlockSink:        ioutil.Discard,
+	}
+	minter, err := newMinter(backend.chain.Config(), backend, 50*time.Millisecond, settings)
+	if err != nil {
+		t.Fatalf("failed to create minter: %v", err)
+	}
+	minter.start()
+	addTransactions(t, backend, signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1)))
+	waitForHead(t, minter, 1, 2*time.Second)
+
+	stopped := make(chan struct{})
+	go func() {
+		minter.loops.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		t.Fatalf("minter goroutines exited before closing")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		minter.close()
+		minter.close()
+		close(closed)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		buf := make([]byte, 1<<20)
+		t.Fatalf("minter goroutines left running after closing:\n%s", buf[:runtime.Stack(buf, true)])
+	}
+	<-closed
+
+	// Requests after closing are ignored rather than minting.
+	minter.requestMinting()
+	if head := speculativeHead(minter); head.Hash() != backend.chain.CurrentBlock().Hash() {
+		t.Errorf("speculative chain left at block %x after closing", head.Hash())
+	}
+}
+
+func TestMinterBackpressuresPool(t *testing.T) {
+	defer func(enabled bool) { metrics.Enabled = enabled }(metrics.Enabled)
+	metrics.Enabled = true
+
+	minter, backend := newTestMinter(t, &MinterConfig{BackpressureDepth: 2, Trigger: make(chan struct{})})
+	defer minter.close()
+	minter.start()
+	m := minter.metrics
+
+	var blocks []*types.Block
+	for nonce := uint64(0); nonce < 2; nonce++ {
+		addTransactions(t, backend, signedTransaction(t, testKey, nonce, testRecvr, big.NewInt(1)))
+		block := minter.mintNewBlock()
+		if block == nil {
+			t.Fatalf("failed to mint block %d", nonce+1)
+		}
+		blocks = append(blocks, block)
+	}
+
+	// Two blocks await acceptance, so the pool is left be.
+	reads, backoffs := m.poolReads.Count(), m.backoffs.Count()
+	addTransactions(t, backend, signedTransaction(t, testKey, 2, testRecvr, big.NewInt(1)))
+	if block := minter.mintNewBlock(); block != nil {
+		t.Fatalf("minted block %d from the pool under backpressure", block.NumberU64())
+	}
+	if have := m.poolReads.Count() - reads; have != 0 {
+		t.Errorf("pool read %d times under backpressure", have)
+	}
+	if have := m.backoffs.Count() - backoffs; have != 1 {
+		t.Errorf("backoffs metric mismatch: have %d, want 1", have)
+	}
+
+	// Once raft accepts a block, the pool is read again.
+	if _, err := backend.chain.InsertChain(types.Blocks{blocks[0]}); err != nil {
+		t.Fatalf("failed to insert block 1: %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		minter.mu.Lock()
+		pending := minter.speculativeChain.unappliedBlocks.Size()
+		minter.mu.Unlock()
+		if pending < 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("block 1 was never accepted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if block := minter.mintNewBlock(); block == nil || len(block.Transactions()) != 1 {
+		t.Fatalf("failed to mint the pending transaction after acceptance: %v", block)
+	}
+}
+
+// Mints rounds back to back over a large pool while raft accepts nothing,
+// reporting how often each round reads the pool.
+func benchmarkSustainedMinting(b *testing.B, depth int) {
+	defer func(enabled bool) { metrics.Enabled = enabled }(metrics.Enabled)
+	metrics.Enabled = true
+
+	backend := newTestBackend(b)
+	minter, err := newMinter(backend.chain.Config(), backend, 50*time.Millisecond, &MinterConfig{
+		BackpressureDepth: depth,
+		MaxTxsPerBlock:    10,
+		Trigger:           make(chan struct{}),
+	})
+	if err != nil {
+		b.Fatalf("failed to create minter: %v", err)
+	}
+	defer minter.close()
+	minter.start()
+
+	txes := make(types.Transactions, 1000)
+	for i := range txes {
+		tx, err := types.NewTransaction(uint64(i), testRecvr, big.NewInt(1), big.NewInt(21000), big.NewInt(0), nil).SignECDSA(testKey)
+		if err != nil {
+			b.Fatalf("failed to sign transaction: %v", err)
+		}
+		txes[i] = tx
+	}
+	backend.txPool.AddBatch(txes)
+
+	reads := minter.metrics.poolReads.Count()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		minter.mintNewBlock()
+	}
+	b.StopTimer()
+	b.Logf("%.2f pool reads per round", float64(minter.metrics.poolReads.Count()-reads)/float64(b.N))
+}
+
+func BenchmarkSustainedMintingUnbounded(b *testing.B) {
+	benchmarkSustainedMinting(b, 0)
+}
+
+func BenchmarkSustainedMintingBackpressured(b *testing.B) {
+	benchmarkSustainedMinting(b, 5)
+}
+
+// Mints blocks of value transfers to distinct accounts, so the state touched
+// by a block, and with it the cost of each transaction's checkpoint, grows as
+// the block fills up.
+func benchmarkTxTimeout(b *testing.B, timeout time.Duration) {
+	backend := newTestBackend(b)
+	minter, err := newMinter(backend.chain.Config(), backend, 50*time.Millisecond, &MinterConfig{
+		TxTimeout: timeout,
+	})
+	if err != nil {
+		b.Fatalf("failed to create minter: %v", err)
+	}
+	defer minter.close()
+
+	txes := make(types.Transactions, 200)
+	for i := range txes {
+		to := common.BigToAddress(big.NewInt(int64(0x1000 + i)))
+		tx, err := types.NewTransaction(uint64(i), to, big.NewInt(1), big.NewInt(21000), big.NewInt(0), nil).SignECDSA(testKey)
+		if err != nil {
+			b.Fatalf("failed to sign transaction: %v", err)
+		}
+		txes[i] = tx
+	}
+	backend.txPool.AddBatch(txes)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		minter.mu.Lock()
+		work := createTestWork(b, minter)
+		committed, _, _, _ := work.commitTransactions(minter.getTransactions(), minter.chain)
+		minter.mu.Unlock()
+		if len(committed) != len(txes) {
+			b.Fatalf("committed %d transactions, expected %d", len(committed), len(txes))
+		}
+	}
+}
+
+func BenchmarkTxTimeoutCheckpointsDisabled(b *testing.B) {
+	benchmarkTxTimeout(b, 0)
+}
+
+func BenchmarkTxTimeoutCheckpoints(b *testing.B) {
+	benchmarkTxTimeout(b, time.Second)
+}
+
+func TestInvalidOrderingSubscription(t *testing.T) {
+	minter, backend := newTestMinter(t, nil)
+	defer minter.close()
+	server := rpc.NewServer()
+	if err := server.RegisterName("raft", NewPublicRaftAPI(&RaftService{minter: minter})); err != nil {
+		t.Fatalf("failed to register raft API: %v", err)
+	}
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go server.ServeCodec(rpc.NewJSONCodec(serverConn), rpc.OptionMethodInvocation|rpc.OptionSubscriptions)
+
+	out, in := json.NewEncoder(clientConn), json.NewDecoder(clientConn)
+	request := map[string]interface{}{
+		"id":      1,
+		"jsonrpc": "2.0",
+		"method":  "raft_subscribe",
+		"params":  []interface{}{"invalidOrdering"},
+	}
+	if err := out.Encode(request); err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+	var response struct {
+		Result string
+		Error  interface{}
+	}
+	if err := in.Decode(&response); err != nil || response.Error != nil {
+		t.Fatalf("failed to subscribe: %v %v", err, response.Error)
+	}
+
+	addTransactions(t, backend, signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1)))
+	minted := minter.mintNewBlock()
+	if minted == nil {
+		t.Fatalf("failed to mint block")
+	}
+	genesis := backend.chain.Genesis()
+
+	// Notifications are dropped until the server has activated the
+	// subscription, shortly after replying, so keep posting until one arrives.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			backend.mux.Post(InvalidRaftOrdering{headBlock: genesis, invalidBlock: minted})
+			select {
+			case <-done:
+				return
+			case <-time.After(20 * time.Millisecond):
+			}
+		}
+	}()
+
+	var notification struct {
+		Params struct {
+			Subscription string
+			Result       InvalidOrderingInfo
+		}
+	}
+	if err := in.Decode(&notification); err != nil {
+		t.Fatalf("failed to read notification: %v", err)
+	}
+	if notification.Params.Subscription != response.Result {
+		t.Errorf("notification for subscription %s, expected %s", notification.Params.Subscription, response.Result)
+	}
+	// The minted block never reached the database.
+	if info := notification.Params.Result; info.InvalidBlock != minted.Hash() || info.Head != genesis.Hash() || info.InLocalDb {
+		t.Errorf("unexpected invalid ordering: %+v", info)
+	}
+}
+
+// Commits the states of blocks full of private transactions to a database
+// taking a millisecond per write, as a disk might.
+func benchmarkStateCommit(b *testing.B, commit func(*work) error) {
+	defer func(ptm private.PrivateTransactionManager) { private.P = ptm }(private.P)
+	payload := common.LeftPadBytes([]byte{1}, 64)
+	private.P = &fakePrivateTransactionManager{payloads: map[string][]byte{
+		string(payload): {0x01},
+	}}
+
+	minter, _, db := newFailingTestMinter(b, 50*time.Millisecond, nil)
+	db.writeDelay = time.Millisecond
+
+	txes := make(types.Transactions, 100)
+	for i := range txes {
+		tx, err := types.NewTransaction(uint64(i), testRecvr, big.NewInt(0), big.NewInt(100000), big.NewInt(0), payload).SignECDSA(testKey)
+		if err != nil {
+			b.Fatalf("failed to sign transaction: %v", err)
+		}
+		tx.SetPrivate()
+		txes[i] = tx
+	}
+
+	minter.mu.Lock()
+	defer minter.mu.Unlock()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		work, err := minter.createWork()
+		if err != nil {
+			b.Fatalf("failed to create work: %v", err)
+		}
+		for _, tx := range txes {
+			work.publicState.StartRecord(tx.Hash(), common.Hash{}, 0)
+			if _, _, err := work.commitTransaction(tx, minter.chain, work.gasPool); err != nil {
+				b.Fatalf("failed to commit transaction: %v", err)
+			}
+		}
+		b.StartTimer()
+
+		if err := commit(work); err != nil {
+			b.Fatalf("failed to commit state: %v", err)
+		}
+	}
+}
+
+func BenchmarkStateCommitSequential(b *testing.B) {
+	benchmarkStateCommit(b, func(env *work) error {
+		if _, err := env.publicState.Commit(); err != nil {
+			return err
+		}
+		_, err := env.privateState.Commit()
+		return err
+	})
+}
+
+func BenchmarkStateCommitConcurrent(b *testing.B) {
+	benchmarkStateCommit(b, (*work).commit)
+}
+
+func TestMinterSimulatesRejections(t *testing.T) {
+	minter, backend := newTestMinter(t, &MinterConfig{MaxTxDataSize: 1})
+	defer minter.close()
+	sub := backend.mux.Subscribe(TxDroppedEvent{}, RoundSummaryEvent{}, core.PendingLogsEvent{})
+	defer sub.Unsubscribe()
+
+	included := signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1))
+	oversized, err := types.NewTransaction(0, testRecvr, big.NewInt(1), big.NewInt(100000), big.NewInt(0), []byte{1, 2}).SignECDSA(testKey2)
+	if err != nil {
+		t.Fatalf("failed to sign transaction: %v", err)
+	}
+	addTransactions(t, backend, included, oversized)
+
+	estimate, err := minter.estimateNextBlock()
+	if err != nil {
+		t.Fatalf("failed to simulate next block: %v", err)
+	}
+	if len(estimate.Transactions) != 1 || estimate.Transactions[0] != included.Hash() {
+		t.Errorf("expected only %x to be included, got %x", included.Hash(), estimate.Transactions)
+	}
+	if len(estimate.Rejected) != 1 || estimate.Rejected[0].Hash != oversized.Hash() || estimate.Rejected[0].Reason == "" || !estimate.Rejected[0].Dropped {
+		t.Fatalf("expected %x to be rejected, got %+v", oversized.Hash(), estimate.Rejected)
+	}
+
+	// Nothing was minted, dropped or posted.
+	if head := speculativeHead(minter); head.NumberU64() != 0 {
+		t.Errorf("simulation extended the speculative chain to block %d", head.NumberU64())
+	}
+	if backend.txPool.Get(oversized.Hash()) == nil {
+		t.Errorf("simulation removed the rejected transaction from the pool")
+	}
+	select {
+	case ev := <-sub.Chan():
+		t.Errorf("simulation posted %T", ev.Data)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestMinterTakesTurnsBetweenSenders(t *testing.T) {
+	const perSender, perTurn, perBlock = 100, 5, 30
+	minter, backend := newTestMinter(t, &MinterConfig{TxsPerSenderTurn: perTurn, MaxTxsPerBlock: perBlock})
+	defer minter.close()
+
+	keys := []*ecdsa.PrivateKey{testKey, testKey2, testKey3}
+	for _, key := range keys {
+		txes := make(types.Transactions, perSender)
+		for nonce := range txes {
+			txes[nonce] = signedTransaction(t, key, uint64(nonce), testRecvr, big.NewInt(1))
+		}
+		addTransactions(t, backend, txes...)
+	}
+
+	for number := 1; number <= perSender*len(keys)/perBlock; number++ {
+		block := minter.mintNewBlock()
+		if block == nil || len(block.Transactions()) != perBlock {
+			t.Fatalf("expected block %d with %d transactions, got %v", number, perBlock, block)
+		}
+		// Each sender gets an equal share of every block, a turn at a time.
+		for i, tx := range block.Transactions() {
+			turn := i / perTurn
+			from, _ := tx.From()
+			first, _ := block.Transactions()[turn*perTurn].From()
+			if from != first {
+				t.Fatalf("block %d: transaction %d is from %x, in the turn of %x", number, i, from, first)
+			}
+			if turn >= len(keys) {
+				previous, _ := block.Transactions()[(turn-len(keys))*perTurn].From()
+				if from != previous {
+					t.Fatalf("block %d: turn %d is %x's, rather than %x's", number, turn, from, previous)
+				}
+			}
+		}
+	}
+	if pending := minter.pendingTransactions(); len(pending) != 0 {
+		t.Errorf("%d senders left with pending transactions", len(pending))
+	}
+}
+
+func TestTxTurnsSkipPoppedSenders(t *testing.T) {
+	// Senders take turns in order of address.
+	first, second := testKey, testKey2
+	if bytes.Compare(testAddress[:], crypto.PubkeyToAddress(testKey2.PublicKey).Bytes()) > 0 {
+		first, second = second, first
+	}
+	a := signedTransaction(t, first, 0, testRecvr, big.NewInt(1))
+	b := signedTransaction(t, second, 0, testRecvr, big.NewInt(1))
+	c := signedTransaction(t, second, 1, testRecvr, big.NewInt(1))
+	fromA, _ := a.From()
+	fromB, _ := b.From()
+
+	turns := newTxTurns(AddressTxes{fromA: {a}, fromB: {b, c}}, 1)
+	for i, expected := range []*types.Transaction{a, b} {
+		if tx := turns.Peek(); tx != expected {
+			t.Fatalf("transaction %d mismatch: have %v, want %x", i, tx, expected.Hash())
+		}
+		if i == 0 {
+			turns.Shift()
+		} else {
+			turns.Pop()
+		}
+	}
+	if tx := turns.Peek(); tx != nil {
+		t.Fatalf("transaction %x served after popping its sender", tx.Hash())
+	}
+}
+
+func TestMinterStartsOnCurrentBlock(t *testing.T) {
+	minter, backend := newTestMinter(t, &MinterConfig{OnDemand: true})
+	defer minter.close()
+	addTransactions(t, backend, signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1)))
+	block := minter.mintNewBlock()
+	if block == nil {
+		t.Fatalf("failed to mint block 1")
+	}
+	minter.stop()
+
+	// The chain advances while the minter is stopped, and it misses the event.
+	if _, err := backend.chain.InsertChain(types.Blocks{block}); err != nil {
+		t.Fatalf("failed to insert block 1: %v", err)
+	}
+	minter.mu.Lock()
+	minter.speculativeChain.setHead(backend.chain.Genesis())
+	minter.mu.Unlock()
+
+	minter.start()
+	addTransactions(t, backend, signedTransaction(t, testKey, 1, testRecvr, big.NewInt(1)))
+	next := minter.mintNewBlock()
+	if next == nil || next.ParentHash() != block.Hash() {
+		t.Fatalf("expected block 2 on top of the current block %x, got %v", block.Hash(), next)
+	}
+}
+
+func TestMinterFixedGasLimit(t *testing.T) {
+	mintGasLimit := func(settings *MinterConfig) (parent *types.Block, limit *big.Int) {
+		minter, backend := newTestMinter(t, settings)
+		defer minter.close()
+		addTransactions(t, backend, signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1)))
+		block := minter.mintNewBlock()
+		if block == nil {
+			t.Fatalf("failed to mint block")
+		}
+		return backend.chain.Genesis(), block.GasLimit()
+	}
+
+	// By default, the limit follows the protocol's rule.
+	if parent, limit := mintGasLimit(nil); limit.Cmp(core.CalcGasLimit(parent)) != 0 {
+		t.Errorf("default gas limit %v doesn't follow CalcGasLimit", limit)
+	}
+
+	// A fixed limit at the parent's is held.
+	if parent, limit := mintGasLimit(&MinterConfig{GasLimit: params.GenesisGasLimit.Uint64()}); limit.Cmp(parent.GasLimit()) != 0 {
+		t.Errorf("gas limit %v, expected the fixed %v", limit, parent.GasLimit())
+	}
+
+	// A fixed limit further away is approached as fast as consensus allows.
+	fixed := new(big.Int).Mul(params.GenesisGasLimit, big.NewInt(2))
+	parent, limit := mintGasLimit(&MinterConfig{GasLimit: fixed.Uint64()})
+	step := new(big.Int).Sub(new(big.Int).Div(parent.GasLimit(), params.GasLimitBoundDivisor), common.Big1)
+	if expected := new(big.Int).Add(parent.GasLimit(), step); limit.Cmp(expected) != 0 {
+		t.Errorf("gas limit %v, expected %v on the way to %v", limit, expected, fixed)
+	}
+
+	backend := newTestBackend(t)
+	low := new(big.Int).Sub(params.MinGasLimit, common.Big1).Uint64()
+	if _, err := newMinter(backend.chain.Config(), backend, time.Second, &MinterConfig{GasLimit: low}); err != errGasLimitTooLow {
+		t.Errorf("expected a gas limit below the minimum to be rejected, got %v", err)
+	}
+}
+
+func TestMinterDropsTransactionsOverGasLimit(t *testing.T) {
+	// The gas limit of the next block drops below the pool's.
+	minter, backend := newTestMinter(t, &MinterConfig{GasLimit: params.MinGasLimit.Uint64()})
+	defer minter.close()
+	oversized, err := types.NewTransaction(0, testRecvr, big.NewInt(1), params.GenesisGasLimit, big.NewInt(0), nil).SignECDSA(testKey)
+	if err != nil {
+		t.Fatalf("failed to sign transaction: %v", err)
+	}
+	fine := signedTransaction(t, testKey2, 0, testRecvr, big.NewInt(1))
+	addTransactions(t, backend, oversized, fine)
+
+	block := minter.mintNewBlock()
+	if block == nil || len(block.Transactions()) != 1 || block.Transactions()[0].Hash() != fine.Hash() {
+		t.Fatalf("expected a block with only the transaction which fits, got %v", block)
+	}
+	if block.GasLimit().Cmp(oversized.Gas()) >= 0 {
+		t.Fatalf("block gas limit %v fits the oversized transaction", block.GasLimit())
+	}
+	if backend.txPool.Get(oversized.Hash()) != nil {
+		t.Errorf("transaction over the gas limit not dropped from the pool")
+	}
+}
+
+func TestMinterPauseKeepsSpeculativeChain(t *testing.T) {
+	minter, backend := newTestMinter(t, &MinterConfig{OnDemand: true})
+	defer minter.close()
+	minter.start()
+	addTransactions(t, backend, signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1)))
+	block := minter.mintNewBlock()
+	if block == nil {
+		t.Fatalf("failed to mint block 1")
+	}
+
+	if !minter.pause() {
+		t.Fatalf("pausing a minting minter reported it wasn't minting")
+	}
+	if minter.pause() {
+		t.Errorf("pausing twice reported minting")
+	}
+	if status := minter.status(); status.Minting || !status.Paused {
+		t.Errorf("status while paused: minting %v, paused %v", status.Minting, status.Paused)
+	}
+	if _, err := minter.forceMint(); err != errNotMinting {
+		t.Errorf("forced minting while paused: got %v, expected %v", err, errNotMinting)
+	}
+	if head := speculativeHead(minter); head.Hash() != block.Hash() {
+		t.Fatalf("pausing reset the speculative head to #%d", head.NumberU64())
+	}
+
+	if !minter.resume() {
+		t.Fatalf("resuming a paused minter reported it wasn't paused")
+	}
+	if status := minter.status(); !status.Minting || status.Paused {
+		t.Errorf("status after resuming: minting %v, paused %v", status.Minting, status.Paused)
+	}
+	addTransactions(t, backend, signedTransaction(t, testKey, 1, testRecvr, big.NewInt(1)))
+	next := minter.mintNewBlock()
+	if next == nil || next.ParentHash() != block.Hash() {
+		t.Fatalf("expected block 2 on top of the speculative block %x, got %v", block.Hash(), next)
+	}
+}
+
+func TestResumeMintingLeavesDivergenceHalt(t *testing.T) {
+	minter, _ := newTestMinter(t, &MinterConfig{OnDemand: true})
+	defer minter.close()
+	api := NewPrivateRaftAPI(&RaftService{minter: minter})
+	minter.start()
+
+	api.PauseMinting()
+	atomic.StoreInt32(&minter.diverged, 1)
+	if !api.ResumeMinting() {
+		t.Fatalf("resuming a paused minter reported it wasn't paused")
+	}
+	if status := minter.status(); status.Paused || !status.Diverged {
+		t.Fatalf("status after resuming: paused %v, diverged %v", status.Paused, status.Diverged)
+	}
+
+	if !api.ResumeAfterDivergence() {
+		t.Fatalf("resuming after the divergence reported minting wasn't halted")
+	}
+	if minter.status().Diverged {
+		t.Errorf("minting still halted after resuming")
+	}
+	if api.ResumeAfterDivergence() {
+		t.Errorf("resuming twice reported minting was halted")
+	}
+}
+
+func TestMinterResumeDoesNotRestartStoppedMinting(t *testing.T) {
+	minter, backend := newTestMinter(t, &MinterConfig{OnDemand: true})
+	defer minter.close()
+	if minter.pause() {
+		t.Errorf("pausing a stopped minter reported minting")
+	}
+	minter.start()
+	addTransactions(t, backend, signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1)))
+	if minter.mintNewBlock() == nil {
+		t.Fatalf("failed to mint block 1")
+	}
+
+	// Stopping a paused minter discards the pause along with the speculative chain.
+	minter.pause()
+	minter.stop()
+	if head := speculativeHead(minter); head.Hash() != backend.chain.CurrentBlock().Hash() {
+		t.Errorf("stopping kept speculative block #%d", head.NumberU64())
+	}
+	if minter.resume() {
+		t.Errorf("resuming a stopped minter reported it was paused")
+	}
+	if status := minter.status(); status.Minting || status.Paused {
+		t.Errorf("status after resuming a stopped minter: minting %v, paused %v", status.Minting, status.Paused)
+	}
+}
+
+func TestThrottleServesFirstRequestImmediately(t *testing.T) {
+	const period = 300 * time.Millisecond
+	calls := make(chan time.Time, 2)
+	call, stop := throttle(func() time.Duration { return period }, nil, nil, func() {
+		calls <- time.Now()
+	})
+	defer stop()
+
+	requested := time.Now()
+	call()
+	first := <-calls
+	if delay := first.Sub(requested); delay > period/3 {
+		t.Errorf("first request served after %v, expected well under the period of %v", delay, period)
+	}
+
+	call()
+	if second := <-calls; second.Sub(first) < period {
+		t.Errorf("second request served %v after the first, within the period of %v", second.Sub(first), period)
+	}
+}
+
+func TestMinterMintsFirstBlockPromptly(t *testing.T) {
+	const blockTime = time.Second
+	backend := newTestBackend(t)
+	minter, err := newMinter(backend.chain.Config(), backend, blockTime, nil)
+	if err != nil {
+		t.Fatalf("failed to create minter: %v", err)
+	}
+	defer minter.close()
+
+	addTransactions(t, backend, signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1)))
+	requested := time.Now()
+	minter.start()
+	waitForHead(t, minter, 1, blockTime)
+	if delay := time.Since(requested); delay > blockTime/2 {
+		t.Errorf("first block minted after %v, expected well under the block time of %v", delay, blockTime)
+	}
+}
+
+func TestMinterPostsSpeculativeUnwindEvents(t *testing.T) {
+	minter, backend := newTestMinter(t, nil)
+	defer minter.close()
+	sub := backend.mux.Subscribe(RoundSummaryEvent{}, SpeculativeUnwindEvent{})
+	defer sub.Unsubscribe()
+
+	var blocks []*types.Block
+	for nonce := uint64(0); nonce < 3; nonce++ {
+		addTransactions(t, backend, signedTransaction(t, testKey, nonce, testRecvr, big.NewInt(1)))
+		block := minter.mintNewBlock()
+		if block == nil {
+			t.Fatalf("failed to mint block %d", nonce+1)
+		}
+		blocks = append(blocks, block)
+	}
+	for _, block := range blocks[1:] {
+		if err := core.WriteBlock(backend.chainDb, block); err != nil {
+			t.Fatalf("failed to write block: %v", err)
+		}
+	}
+
+	// Block 2 is invalid, so it goes along with its descendant. The unwind is
+	// posted after the events of the rounds which minted them.
+	genesis := backend.chain.Genesis()
+	minter.updateSpeculativeChainPerInvalidOrdering(genesis, blocks[1])
+	for i := range blocks {
+		select {
+		case ev := <-sub.Chan():
+			if summary, ok := ev.Data.(RoundSummaryEvent); !ok || summary.BlockHash != blocks[i].Hash() {
+				t.Fatalf("unexpected event %+v, expected the summary of block %d", ev.Data, i+1)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no summary posted for block %d", i+1)
+		}
+	}
+	select {
+	case ev := <-sub.Chan():
+		unwind, ok := ev.Data.(SpeculativeUnwindEvent)
+		if !ok {
+			t.Fatalf("unexpected event %+v, expected an unwind", ev.Data)
+		}
+		if unwind.From != blocks[2].Hash() || unwind.To != blocks[0].Hash() || unwind.Discarded != 2 {
+			t.Errorf("unexpected unwind %+v, expected from %x to %x discarding 2", unwind, blocks[2].Hash(), blocks[0].Hash())
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no SpeculativeUnwindEvent posted")
+	}
+
+	// The descendant, which is expected to be invalid too, unwinds nothing.
+	minter.updateSpeculativeChainPerInvalidOrdering(genesis, blocks[2])
+	select {
+	case ev := <-sub.Chan():
+		t.Errorf("unexpected unwind %+v", ev.Data)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestMinterChecksClockDrift(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	clock := &stepClock{now: now.Add(time.Hour)}
+	minter, backend := newTestMinter(t, &MinterConfig{Clock: clock, MaxClockDrift: time.Minute})
+	defer minter.close()
+	mint := func(nonce uint64) *types.Block {
+		addTransactions(t, backend, signedTransaction(t, testKey, nonce, testRecvr, big.NewInt(1)))
+		return minter.mintNewBlock()
+	}
+	parent := mint(0)
+	if parent == nil {
+		t.Fatalf("failed to mint block 1")
+	}
+
+	// The clock steps back an hour, leaving the parent far in the future.
+	clock.mu.Lock()
+	clock.now = now
+	clock.mu.Unlock()
+
+	// By default this is only a warning.
+	block := mint(1)
+	if block == nil {
+		t.Fatalf("failed to mint block 2 ahead of the clock")
+	}
+	if block.Time().Int64() != parent.Time().Int64()+1 {
+		t.Errorf("block 2 timestamp %v, expected right after its parent's %v", block.Time(), parent.Time())
+	}
+
+	minter.reconfigure(func(settings *MinterConfig) { settings.RefuseClockDrift = true })
+	if block := mint(2); block != nil {
+		t.Fatalf("block 3 minted an hour ahead of the clock")
+	}
+	minter.mu.Lock()
+	_, err := minter.createWork()
+	minter.mu.Unlock()
+	if err != errClockDrift {
+		t.Errorf("expected %v, got %v", errClockDrift, err)
+	}
+
+	// Minting resumes once the clock is within the allowed drift.
+	clock.mu.Lock()
+	clock.now = now.Add(time.Hour - time.Second)
+	clock.mu.Unlock()
+	if block := minter.mintNewBlock(); block == nil || block.NumberU64() != 3 {
+		t.Fatalf("failed to mint block 3 after the clock caught up: %v", block)
+	}
+}
+
+// Starts minting a block with a transaction that runs until it's out of gas,
+// returning once the round is in progress. The block, if any, is delivered on
+// the returned channel.
+func mintSlowly(t *testing.T, minter *minter, backend *testBackend, nonce uint64) <-chan *types.Block {
+	loop := []byte{byte(vm.JUMPDEST), byte(vm.PUSH1), 0x00, byte(vm.JUMP)}
+	slow, err := types.NewContractCreation(nonce, big.NewInt(0), big.NewInt(4000000), big.NewInt(0), loop).SignECDSA(testKey)
+	if err != nil {
+		t.Fatalf("failed to sign contract creation: %v", err)
+	}
+	addTransactions(t, backend, slow)
+
+	minted := make(chan *types.Block, 1)
+	go func() { minted <- minter.mintNewBlock() }()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		minter.roundMu.Lock()
+		started := minter.round != nil
+		minter.roundMu.Unlock()
+		if started {
+			return minted
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("round never started")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMinterStopCancelsCurrentRound(t *testing.T) {
+	minter, backend := newTestMinter(t, &MinterConfig{OnDemand: true})
+	defer minter.close()
+	minter.start()
+	minted := mintSlowly(t, minter, backend, 0)
+
+	minter.stop()
+	select {
+	case block := <-minted:
+		if block != nil {
+			t.Fatalf("round minted block #%v after stopping", block.Number())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("round didn't finish")
+	}
+	if head := speculativeHead(minter); head.NumberU64() != 0 {
+		t.Errorf("speculative chain extended to #%d after stopping", head.NumberU64())
+	}
+}
+
+func TestMinterCancelsStaleRound(t *testing.T) {
+	minter, backend := newTestMinter(t, nil)
+	defer minter.close()
+	addTransactions(t, backend, signedTransaction(t, testKey2, 0, testRecvr, big.NewInt(1)))
+	ours := minter.mintNewBlock()
+	if ours == nil {
+		t.Fatalf("failed to mint block 1")
+	}
+	minted := mintSlowly(t, minter, backend, 0)
+
+	// Our own block being accepted leaves the round be.
+	if minter.cancelStaleRound(ours) {
+		t.Errorf("round cancelled by the acceptance of its parent")
+	}
+
+	// A block minted elsewhere doesn't.
+	theirs := types.NewBlockWithHeader(&types.Header{Number: big.NewInt(1), Extra: []byte("elsewhere")})
+	if !minter.cancelStaleRound(theirs) {
+		t.Fatalf("round not cancelled by another node's block")
+	}
+	select {
+	case block := <-minted:
+		if block != nil {
+			t.Fatalf("stale round minted block #%v", block.Number())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("stale round didn't finish")
+	}
+	if minter.cancelStaleRound(theirs) {
+		t.Errorf("cancelled a round after it finished")
+	}
+}
+
+func TestMinterMetersPrivateTransactions(t *testing.T) {
+	defer func(enabled bool) { metrics.Enabled = enabled }(metrics.Enabled)
+	metrics.Enabled = true
+	defer func(ptm private.PrivateTransactionManager) { private.P = ptm }(private.P)
+	payload := common.LeftPadBytes([]byte{1}, 64)
+	private.P = &fakePrivateTransactionManager{payloads: map[string][]byte{
+		string(payload): {0x01},
+	}}
+
+	minter, backend := newTestMinter(t, nil)
+	defer minter.close()
+	m := minter.metrics
+	privateTxes, publicTxes := m.privateTxes.Count(), m.publicTxes.Count()
+
+	addTransactions(t, backend,
+		privateTransaction(t, testKey, 0, payload),
+		signedTransaction(t, testKey2, 0, testRecvr, big.NewInt(1)),
+		signedTransaction(t, testKey3, 0, testRecvr, big.NewInt(1)),
+	)
+	block := minter.mintNewBlock()
+	if block == nil || len(block.Transactions()) != 3 {
+		t.Fatalf("expected a block with all 3 transactions, got %v", block)
+	}
+	if n := m.privateTxes.Count() - privateTxes; n != 1 {
+		t.Errorf("private transaction meter marked %d, expected 1", n)
+	}
+	if n := m.publicTxes.Count() - publicTxes; n != 2 {
+		t.Errorf("public transaction meter marked %d, expected 2", n)
+	}
+}
+
+func TestFIFOSelectorOrdersByArrival(t *testing.T) {
+	// Ties are broken by address, so arrivals go against that.
+	first, second := testKey, testKey2
+	if bytes.Compare(testAddress[:], crypto.PubkeyToAddress(testKey2.PublicKey).Bytes()) > 0 {
+		first, second = second, first
+	}
+	early := signedTransaction(t, second, 0, testRecvr, big.NewInt(1))
+	late := signedTransaction(t, first, 0, testRecvr, big.NewInt(1))
+	earlyFrom, _ := early.From()
+	lateFrom, _ := late.From()
+
+	selector := NewFIFOSelector()
+	if txes := drainTxSource(selector.Select(AddressTxes{lateFrom: {late}, earlyFrom: {early}})); len(txes) != 2 || txes[0] != late {
+		t.Fatalf("transactions arriving together not ordered by sender: %v", txes)
+	}
+
+	selector = NewFIFOSelector()
+	selector.Select(AddressTxes{earlyFrom: {early}})
+	if txes := drainTxSource(selector.Select(AddressTxes{lateFrom: {late}, earlyFrom: {early}})); len(txes) != 2 || txes[0] != early || txes[1] != late {
+		t.Fatalf("FIFO order mismatch: %v", txes)
+	}
+
+	// A transaction seen before its sender's earlier one still follows it.
+	next := signedTransaction(t, first, 1, testRecvr, big.NewInt(1))
+	selector = NewFIFOSelector()
+	selector.Select(AddressTxes{lateFrom: {next}})
+	selector.Select(AddressTxes{earlyFrom: {early}})
+	txes := drainTxSource(selector.Select(AddressTxes{earlyFrom: {early}, lateFrom: {late, next}}))
+	if len(txes) != 3 || txes[0] != early || txes[1] != late || txes[2] != next {
+		t.Fatalf("FIFO order mismatch with an early later nonce: %v", txes)
+	}
+
+	// Transactions which left the pending set are forgotten.
+	selector.Select(AddressTxes{lateFrom: {late}})
+	txes = drainTxSource(selector.Select(AddressTxes{earlyFrom: {early}, lateFrom: {late}}))
+	if len(txes) != 2 || txes[0] != late {
+		t.Fatalf("FIFO order mismatch after a transaction left: %v", txes)
+	}
+}
+
+func TestMinterUsesTxSelector(t *testing.T) {
+	selector := NewFIFOSelector()
+	minter, backend := newTestMinter(t, &MinterConfig{TxSelector: selector})
+	defer minter.close()
+
+	// Each transaction arrives before the next round.
+	var arrivals types.Transactions
+	for _, key := range []*ecdsa.PrivateKey{testKey3, testKey2, testKey} {
+		tx := signedTransaction(t, key, 0, testRecvr, big.NewInt(1))
+		addTransactions(t, backend, tx)
+		arrivals = append(arrivals, tx)
+		if _, err := minter.estimateNextBlock(); err != nil {
+			t.Fatalf("failed to estimate the next block: %v", err)
+		}
+	}
+
+	block := minter.mintNewBlock()
+	if block == nil || len(block.Transactions()) != len(arrivals) {
+		t.Fatalf("expected a block with %d transactions, got %v", len(arrivals), block)
+	}
+	for i, tx := range block.Transactions() {
+		if tx.Hash() != arrivals[i].Hash() {
+			t.Errorf("transaction %d mismatch: have %x, want %x", i, tx.Hash(), arrivals[i].Hash())
+		}
+	}
+}
+
+func TestMinterPersistsMintRecord(t *testing.T) {
+	coinbase := common.Address{0x42}
+	minter, backend := newTestMinter(t, &MinterConfig{Coinbases: []common.Address{coinbase}})
+	defer minter.close()
+	if status := minter.status(); status.TotalBlocksMinted != 0 || !status.LastMintTime.IsZero() {
+		t.Fatalf("fresh node reports %d blocks minted, the last at %v", status.TotalBlocksMinted, status.LastMintTime)
+	}
+	var last *types.Block
+	for nonce := uint64(0); nonce < 2; nonce++ {
+		addTransactions(t, backend, signedTransaction(t, testKey, nonce, testRecvr, big.NewInt(1)))
+		if last = minter.mintNewBlock(); last == nil {
+			t.Fatalf("failed to mint block %d", nonce+1)
+		}
+	}
+
+	// The record survives a restart.
+	restarted := newTestBackendOn(t, backend.chainDb)
+	minter, err := newMinter(restarted.chain.Config(), restarted, 50*time.Millisecond, nil)
+	if err != nil {
+		t.Fatalf("failed to create minter: %v", err)
+	}
+	status := minter.status()
+	if status.TotalBlocksMinted != 2 {
+		t.Errorf("blocks minted mismatch: have %d, want 2", status.TotalBlocksMinted)
+	}
+	if status.LastMintTime.UnixNano() != last.Time().Int64() {
+		t.Errorf("last mint time mismatch: have %v, want %v", status.LastMintTime.UnixNano(), last.Time())
+	}
+	if status.LastCoinbase != coinbase {
+		t.Errorf("last coinbase mismatch: have %x, want %x", status.LastCoinbase, coinbase)
+	}
+
+	// An unreadable record is started afresh.
+	if err := backend.chainDb.Put(mintRecordDbKey, []byte{0xff}); err != nil {
+		t.Fatalf("failed to corrupt the mint record: %v", err)
+	}
+	if record := loadMintRecord(backend.chainDb); record != (mintRecord{}) {
+		t.Errorf("unreadable record loaded as %+v", record)
+	}
+}
+
+func TestMinterClassifiesTransactionErrors(t *testing.T) {
+	minter, backend := newTestMinter(t, nil)
+	defer minter.close()
+	minter.mu.Lock()
+	defer minter.mu.Unlock()
+
+	// Fails on its nonce against the round's state, which is ahead of the pool.
+	used := signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1))
+	addTransactions(t, backend, used)
+	ahead := signedTransaction(t, testKey2, 1, testRecvr, big.NewInt(1))
+	underpaid, err := types.NewTransaction(0, testRecvr, big.NewInt(1), big.NewInt(20000), big.NewInt(0), nil).SignECDSA(testKey3)
+	if err != nil {
+		t.Fatalf("failed to sign transaction: %v", err)
+	}
+
+	work := createTestWork(t, minter)
+	work.publicState.SetNonce(testAddress, 1)
+	committed, _, _, _ := work.commitTransactions(newTxList(types.Transactions{used, ahead, underpaid}), minter.chain)
+	minter.dropTransactions(work.dropped)
+	if len(committed) != 0 {
+		t.Fatalf("committed %d transactions which should all fail", len(committed))
+	}
+
+	skipped := make(map[common.Hash]SkippedTx)
+	for _, s := range work.skipped {
+		skipped[s.Tx.Hash()] = s
+	}
+	for _, tc := range []struct {
+		name    string
+		tx      *types.Transaction
+		dropped bool
+	}{
+		{"nonce too low", used, true},
+		{"nonce too high", ahead, false},
+		{"intrinsic gas too low", underpaid, true},
+	} {
+		s, ok := skipped[tc.tx.Hash()]
+		if !ok {
+			t.Errorf("%s: transaction not reported as skipped", tc.name)
+			continue
+		}
+		if s.Dropped != tc.dropped {
+			t.Errorf("%s: dropped %v, expected %v (%v)", tc.name, s.Dropped, tc.dropped, s.Reason)
+		}
+	}
+	// None of them count as execution failures, which are retried.
+	if len(work.failed) != 0 {
+		t.Errorf("expected no execution failures, got %v", work.failed)
+	}
+	if backend.txPool.Get(used.Hash()) != nil {
+		t.Errorf("transaction with a used nonce still in the pool")
+	}
+}
+
+func TestMinterDecoratesWork(t *testing.T) {
+	beacon := TimestampBeacon(testKey3, testRecvr, big.NewInt(100000))
+	var addErr error
+	minter, backend := newTestMinter(t, &MinterConfig{WorkDecorator: func(pw *PendingWork) {
+		pw.Header().Extra = []byte("decorated")
+		beacon(pw)
+
+		// A transaction which fails, here for its nonce, leaves the block be.
+		from := crypto.PubkeyToAddress(testKey3.PublicKey)
+		invalid, err := types.NewTransaction(pw.Nonce(from)+1, testRecvr, big.NewInt(1), big.NewInt(21000), big.NewInt(0), nil).SignECDSA(testKey3)
+		if err != nil {
+			t.Fatalf("failed to sign transaction: %v", err)
+		}
+		addErr = pw.AddTransaction(invalid)
+	}})
+	defer minter.close()
+	pooled := signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1))
+	addTransactions(t, backend, pooled)
+
+	// Estimates don't run the decorator.
+	if estimate, err := minter.estimateNextBlock(); err != nil || len(estimate.Transactions) != 1 {
+		t.Fatalf("unexpected estimate %+v (%v)", estimate, err)
+	}
+
+	block := minter.mintNewBlock()
+	if block == nil || len(block.Transactions()) != 2 {
+		t.Fatalf("expected a block with the beacon and the pool transaction, got %v", block)
+	}
+	if addErr == nil {
+		t.Errorf("invalid transaction added to the block")
+	}
+	if string(block.Extra()) != "decorated" {
+		t.Errorf("header extra mismatch: have %q, want %q", block.Extra(), "decorated")
+	}
+
+	injected := block.Transactions()[0]
+	if from, _ := injected.From(); from != crypto.PubkeyToAddress(testKey3.PublicKey) {
+		t.Errorf("first transaction sent by %x, expected the beacon", from)
+	}
+	if time := new(big.Int).SetBytes(injected.Data()); time.Cmp(block.Time()) != 0 {
+		t.Errorf("beacon recorded timestamp %v, block has %v", time, block.Time())
+	}
+	if block.Transactions()[1].Hash() != pooled.Hash() {
+		t.Errorf("pool transaction not minted after the beacon")
+	}
+
+	// The injected transaction was executed, and the next block carries on.
+	addTransactions(t, backend, signedTransaction(t, testKey, 1, testRecvr, big.NewInt(1)))
+	next := minter.mintNewBlock()
+	if next == nil || len(next.Transactions()) != 2 || next.Transactions()[0].Nonce() != 1 {
+		t.Fatalf("expected a block with the next beacon, got %v", next)
+	}
+}
+
+func TestLatencySamplerPercentiles(t *testing.T) {
+	sampler := newLatencySampler(100)
+	if latency := sampler.percentiles(); latency.Blocks != 0 || latency.P99 != 0 {
+		t.Fatalf("unexpected latency without samples: %+v", latency)
+	}
+
+	// Pushed out of the window by the later samples.
+	for i := 0; i < 50; i++ {
+		sampler.add(time.Hour)
+	}
+	for _, i := range rand.Perm(100) {
+		sampler.add(time.Duration(i+1) * time.Millisecond)
+	}
+	latency := sampler.percentiles()
+	if latency.Blocks != 100 || latency.P50 != 50*time.Millisecond || latency.P95 != 95*time.Millisecond || latency.P99 != 99*time.Millisecond {
+		t.Errorf("unexpected latency: %+v", latency)
+	}
+
+	// Under clock skew, latencies clamp to zero.
+	sampler = newLatencySampler(100)
+	sampler.add(-time.Second)
+	if latency := sampler.percentiles(); latency.Blocks != 1 || latency.P50 != 0 {
+		t.Errorf("negative latency not clamped: %+v", latency)
+	}
+}
+
+func TestMinterSamplesLatency(t *testing.T) {
+	// Timestamps an hour ahead of the clock.
+	minter, backend := newTestMinter(t, &MinterConfig{Clock: &stepClock{now: time.Now().Add(time.Hour)}})
+	defer minter.close()
+	addTransactions(t, backend, signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1)))
+	if minter.mintNewBlock() == nil {
+		t.Fatalf("failed to mint block")
+	}
+	if latency := minter.latencies.percentiles(); latency.Blocks != 1 || latency.P50 != 0 {
+		t.Errorf("unexpected latency of a block ahead of the clock: %+v", latency)
+	}
+}
+
+func TestMinterRequiresCoinbase(t *testing.T) {
+	minter, backend := newTestMinter(t, &MinterConfig{RequireCoinbase: true, OnDemand: true})
+	defer minter.close()
+	if err := minter.start(); err != errZeroCoinbase {
+		t.Fatalf("starting with the zero coinbase: got %v, expected %v", err, errZeroCoinbase)
+	}
+	if minter.status().Minting {
+		t.Fatalf("minting despite the zero coinbase")
+	}
+	addTransactions(t, backend, signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1)))
+	if _, err := minter.forceMint(); err != errNotMinting {
+		t.Errorf("forced minting: got %v, expected %v", err, errNotMinting)
+	}
+
+	// Rotating through coinbases, none may be zero.
+	minter.reconfigure(func(settings *MinterConfig) {
+		settings.Coinbases = []common.Address{{1}, {}}
+	})
+	if err := minter.start(); err != errZeroCoinbase {
+		t.Errorf("starting with a zero coinbase in rotation: got %v, expected %v", err, errZeroCoinbase)
+	}
+	minter.reconfigure(func(settings *MinterConfig) { settings.Coinbases = nil })
+
+	minter.setCoinbase(common.Address{0x42})
+	if err := minter.start(); err != nil {
+		t.Fatalf("failed to start with a coinbase: %v", err)
+	}
+	if block, err := minter.forceMint(); err != nil || block.Coinbase() != (common.Address{0x42}) {
+		t.Errorf("unexpected block %v (%v)", block, err)
+	}
+
+	// Without strict mode, the zero coinbase is only warned about.
+	permissive, _ := newTestMinter(t, nil)
+	if err := permissive.start(); err != nil || !permissive.status().Minting {
+		t.Errorf("permissive minter didn't start: %v", err)
+	}
+	permissive.close()
+}
+
+// recordingTracer records the spans it starts, with their attributes.
+type recordingTracer struct {
+	mu    sync.Mutex
+	spans []*recordedSpan
+}
+
+type recordedSpan struct {
+	name       string
+	attributes map[string]interface{}
+	finished   bool
+}
+
+func (tracer *recordingTracer) StartSpan(name string) Span {
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+
+	span := &recordedSpan{name: name, attributes: make(map[string]interface{})}
+	tracer.spans = append(tracer.spans, span)
+	return span
+}
+
+func (span *recordedSpan) SetAttribute(key string, value interface{}) { span.attributes[key] = value }
+func (span *recordedSpan) Finish()                                    { span.finished = true }
+
+func TestMinterTracesPhases(t *testing.T) {
+	tracer := new(recordingTracer)
+	minter, backend := newTestMinter(t, &MinterConfig{Tracer: tracer})
+	defer minter.close()
+	addTransactions(t, backend,
+		signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1)),
+		signedTransaction(t, testKey, 1, testRecvr, big.NewInt(1)),
+	)
+	if minter.mintNewBlock() == nil {
+		t.Fatalf("failed to mint block")
+	}
+
+	expected := []struct {
+		name string
+		txs  interface{}
+	}{
+		{"createWork", nil},
+		{"getTransactions", 2},
+		{"commitTransactions", 2},
+		{"commitState", 2},
+	}
+	if len(tracer.spans) != len(expected) {
+		t.Fatalf("recorded %d spans, expected %d", len(tracer.spans), len(expected))
+	}
+	for i, span := range tracer.spans {
+		if span.name != expected[i].name || !span.finished {
+			t.Errorf("span %d: have %q (finished %v), want finished %q", i, span.name, span.finished, expected[i].name)
+		}
+		if expected[i].txs != nil && span.attributes["txs"] != expected[i].txs {
+			t.Errorf("span %q: txs attribute %v, want %v", span.name, span.attributes["txs"], expected[i].txs)
+		}
+	}
+	if number := tracer.spans[0].attributes["number"]; number != uint64(1) {
+		t.Errorf("createWork span has block number %v, want 1", number)
+	}
+}
+
+func TestMinterCreditsConfiguredBlockReward(t *testing.T) {
+	coinbase := common.HexToAddress("0x0000000000000000000000000000000000000c0b")
+	for _, reward := range []*big.Int{nil, new(big.Int), big.NewInt(3e18)} {
+		minter, backend := newTestMinter(t, nil)
+		defer minter.close()
+		// The chain shares the configuration, so it verifies the block against
+		// the same reward.
+		minter.config.BlockReward = reward
+		minter.setCoinbase(coinbase)
+
+		addTransactions(t, backend, signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1)))
+		block := minter.mintNewBlock()
+		if block == nil {
+			t.Fatalf("reward %v: failed to mint block", reward)
+		}
+		if _, err := backend.chain.InsertChain(types.Blocks{block}); err != nil {
+			t.Fatalf("reward %v: minted block failed validation: %v", reward, err)
+		}
+
+		statedb, _, err := backend.chain.State()
+		if err != nil {
+			t.Fatalf("reward %v: failed to get state: %v", reward, err)
+		}
+		want := reward
+		if want == nil {
+			want = core.BlockReward
+		}
+		if balance := statedb.GetBalance(coinbase); balance.Cmp(want) != 0 {
+			t.Errorf("reward %v: coinbase balance %v, want %v", reward, balance, want)
+		}
+	}
+}
+
+// Starts a minter whose hour-long block time keeps any round after the first
+// from serving requests, waiting for that first round.
+func startIdleMinter(tb testing.TB) (*minter, *testBackend) {
+	backend := newTestBackend(tb)
+	minter, err := newMinter(backend.chain.Config(), backend, time.Hour, nil)
+	if err != nil {
+		tb.Fatalf("failed to create minter: %v", err)
+	}
+	minter.start()
+	for deadline := time.Now().Add(time.Second); atomic.LoadUint32(&minter.pendingRequests) != 0; {
+		if time.Now().After(deadline) {
+			tb.Fatalf("first round didn't run")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return minter, backend
+}
+
+// Posts a burst of transaction events, returning the number of minting requests
+// they made. Delivery is synchronous, so all but the last event were handled by
+// the time this returns, which suffices as only the first one requests minting.
+func postTxEventBurst(tb testing.TB, minter *minter, backend *testBackend, events int) uint32 {
+	tx, err := types.NewTransaction(0, testRecvr, big.NewInt(1), big.NewInt(21000), big.NewInt(0), nil).SignECDSA(testKey)
+	if err != nil {
+		tb.Fatalf("failed to sign transaction: %v", err)
+	}
+	before := atomic.LoadUint32(&minter.pendingRequests)
+	for i := 0; i < events; i++ {
+		backend.mux.Post(core.TxPreEvent{Tx: tx})
+	}
+	return atomic.LoadUint32(&minter.pendingRequests) - before
+}
+
+func TestMinterCoalescesTxEventRequests(t *testing.T) {
+	minter, backend := startIdleMinter(t)
+	defer minter.close()
+
+	if requests := postTxEventBurst(t, minter, backend, 1000); requests != 1 {
+		t.Fatalf("burst of 1000 transaction events made %d minting requests, want 1", requests)
+	}
+
+	// Once a round serves the request, the next event makes another.
+	if err := minter.setBlockTime(50 * time.Millisecond); err != nil {
+		t.Fatalf("failed to set block time: %v", err)
+	}
+	for deadline := time.Now().Add(time.Second); atomic.LoadInt32(&minter.eventRequested) != 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("request wasn't served")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	minter.setBlockTime(time.Hour)
+	if requests := postTxEventBurst(t, minter, backend, 2); requests != 1 {
+		t.Fatalf("transaction events after a round made %d minting requests, want 1", requests)
+	}
+}
+
+func BenchmarkTxEventBurst(b *testing.B) {
+	var requests uint32
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		minter, backend := startIdleMinter(b)
+		b.StartTimer()
+
+		requests += postTxEventBurst(b, minter, backend, 10000)
+
+		b.StopTimer()
+		minter.close()
+	}
+	b.Logf("%.2f minting requests per burst", float64(requests)/float64(b.N))
+}
+
+func TestMintNewBlockSyncIncludesPendingTransactions(t *testing.T) {
+	minter, backend := newTestMinter(t, nil)
+	defer minter.close()
+	sender2 := crypto.PubkeyToAddress(testKey2.PublicKey)
+	addTransactions(t, backend,
+		signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1)),
+		signedTransaction(t, testKey, 1, testRecvr, big.NewInt(2)),
+		signedTransaction(t, testKey2, 0, testRecvr, big.NewInt(3)),
+		signedTransaction(t, testKey, 2, testRecvr, big.NewInt(4)),
+	)
+
+	block, err := minter.mintNewBlockSync()
+	if err != nil {
+		t.Fatalf("failed to mint block: %v", err)
+	}
+	if block.NumberU64() != 1 || block.ParentHash() != minter.chain.Genesis().Hash() {
+		t.Fatalf("minted block #%d on %x, want #1 on the genesis block", block.NumberU64(), block.ParentHash())
+	}
+	if len(block.Transactions()) != 4 {
+		t.Fatalf("block has %d transactions, want 4", len(block.Transactions()))
+	}
+	nonces := make(map[common.Address]uint64)
+	for i, tx := range block.Transactions() {
+		from, _ := tx.From()
+		if tx.Nonce() != nonces[from] {
+			t.Errorf("transaction %d from %x has nonce %d, want %d", i, from, tx.Nonce(), nonces[from])
+		}
+		nonces[from]++
+	}
+	if nonces[testAddress] != 3 || nonces[sender2] != 1 {
+		t.Errorf("included transactions by sender: %v", nonces)
+	}
+	if head := speculativeHead(minter); head.Hash() != block.Hash() {
+		t.Errorf("speculative head %x, want the minted block %x", head.Hash(), block.Hash())
+	}
+}
+
+func TestMintNewBlockSyncCommitsState(t *testing.T) {
+	minter, backend := newTestMinter(t, nil)
+	defer minter.close()
+	addTransactions(t, backend,
+		signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1)),
+		signedTransaction(t, testKey, 1, testRecvr, big.NewInt(2)),
+	)
+
+	block, err := minter.mintNewBlockSync()
+	if err != nil {
+		t.Fatalf("failed to mint block: %v", err)
+	}
+	publicState, _, err := minter.chain.StateAt(block.Root())
+	if err != nil {
+		t.Fatalf("state of the minted block wasn't committed: %v", err)
+	}
+	if balance := publicState.GetBalance(testRecvr); balance.Cmp(big.NewInt(3)) != 0 {
+		t.Errorf("recipient balance %v, want 3", balance)
+	}
+	if nonce := publicState.GetNonce(testAddress); nonce != 2 {
+		t.Errorf("sender nonce %d, want 2", nonce)
+	}
+	if _, err := backend.chain.InsertChain(types.Blocks{block}); err != nil {
+		t.Fatalf("minted block failed validation: %v", err)
+	}
+}
+
+func TestMintNewBlockSyncBuildsOnSpeculativeHead(t *testing.T) {
+	minter, backend := newTestMinter(t, nil)
+	defer minter.close()
+	addTransactions(t, backend, signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1)))
+	first, err := minter.mintNewBlockSync()
+	if err != nil {
+		t.Fatalf("failed to mint block 1: %v", err)
+	}
+
+	// The transaction in the unaccepted first block isn't minted again.
+	addTransactions(t, backend, signedTransaction(t, testKey, 1, testRecvr, big.NewInt(1)))
+	second, err := minter.mintNewBlockSync()
+	if err != nil {
+		t.Fatalf("failed to mint block 2: %v", err)
+	}
+	if second.NumberU64() != 2 || second.ParentHash() != first.Hash() {
+		t.Fatalf("minted block #%d on %x, want #2 on %x", second.NumberU64(), second.ParentHash(), first.Hash())
+	}
+	if txes := second.Transactions(); len(txes) != 1 || txes[0].Nonce() != 1 {
+		t.Fatalf("block 2 has transactions %v, want only nonce 1", txes)
+	}
+}
+
+func TestMintNewBlockSyncReportsWhyNothingWasMinted(t *testing.T) {
+	minter, backend := newTestMinter(t, &MinterConfig{MaxSpeculativeBlocks: 1})
+	defer minter.close()
+	if _, err := minter.mintNewBlockSync(); err != errNothingToMint {
+		t.Fatalf("minting without transactions: have %v, want %v", err, errNothingToMint)
+	}
+
+	addTransactions(t, backend, signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1)))
+	atomic.StoreInt32(&minter.diverged, 1)
+	if _, err := minter.mintNewBlockSync(); err != errDiverged {
+		t.Fatalf("minting after a state root mismatch: have %v, want %v", err, errDiverged)
+	}
+	atomic.StoreInt32(&minter.diverged, 0)
+
+	if _, err := minter.mintNewBlockSync(); err != nil {
+		t.Fatalf("failed to mint block: %v", err)
+	}
+	addTransactions(t, backend, signedTransaction(t, testKey, 1, testRecvr, big.NewInt(1)))
+	if _, err := minter.mintNewBlockSync(); err != errSpeculativeChainFull {
+		t.Fatalf("minting beyond the speculative chain limit: have %v, want %v", err, errSpeculativeChainFull)
+	}
+}
+
+func TestMinterRecoversFromMissingSpeculativeState(t *testing.T) {
+	minter, backend := newTestMinter(t, nil)
+	defer minter.close()
+	genesis := minter.chain.CurrentBlock()
+
+	// A speculative head whose state isn't in the database, as if pruned.
+	pruned := types.NewBlock(&types.Header{
+		ParentHash: genesis.Hash(),
+		Number:     big.NewInt(1),
+		Time:       big.NewInt(time.Now().UnixNano()),
+		Difficulty: genesis.Difficulty(),
+		GasLimit:   genesis.GasLimit(),
+		GasUsed:    new(big.Int),
+		Root:       common.HexToHash("0x0bad"),
+	}, nil, nil, nil)
+	minter.mu.Lock()
+	minter.speculativeChain.extend(pruned)
+	minter.mu.Unlock()
+
+	addTransactions(t, backend, signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1)))
+	block, err := minter.mintNewBlockSync()
+	if err != nil {
+		t.Fatalf("failed to mint block after losing the speculative state: %v", err)
+	}
+	if block.NumberU64() != 1 || block.ParentHash() != genesis.Hash() {
+		t.Fatalf("minted block #%d on %x, want #1 on the chain head %x", block.NumberU64(), block.ParentHash(), genesis.Hash())
+	}
+	if _, err := backend.chain.InsertChain(types.Blocks{block}); err != nil {
+		t.Fatalf("minted block failed validation: %v", err)
+	}
+}
+
+func TestMinterPostsBlockAcceptedEvents(t *testing.T) {
+	minter, backend := newTestMinter(t, nil)
+	defer minter.close()
+	sub := backend.mux.Subscribe(BlockAcceptedEvent{})
+	defer sub.Unsubscribe()
+
+	var blocks []*types.Block
+	for nonce := uint64(0); nonce < 3; nonce++ {
+		addTransactions(t, backend, signedTransaction(t, testKey, nonce, testRecvr, big.NewInt(1)))
+		block := minter.mintNewBlock()
+		if block == nil {
+			t.Fatalf("failed to mint block %d", nonce+1)
+		}
+		blocks = append(blocks, block)
+	}
+	for _, block := range blocks {
+		minter.updateSpeculativeChainPerNewHead(block)
+	}
+	// The events arrive in the order the blocks were accepted.
+	for _, minted := range blocks {
+		select {
+		case ev := <-sub.Chan():
+			if accepted := ev.Data.(BlockAcceptedEvent).Block; accepted.Hash() != minted.Hash() {
+				t.Errorf("accepted block %x, expected %x", accepted.Hash(), minted.Hash())
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no BlockAcceptedEvent posted for block %d", minted.NumberU64())
+		}
+	}
+	minted := blocks[len(blocks)-1]
+
+	// Blocks minted elsewhere aren't ours to confirm.
+	foreign, _, _, err := minter.mintExplicit(minted, types.Transactions{signedTransaction(t, testKey2, 0, testRecvr, big.NewInt(1))})
+	if err != nil {
+		t.Fatalf("failed to build foreign block: %v", err)
+	}
+	minter.updateSpeculativeChainPerNewHead(foreign)
+	select {
+	case ev := <-sub.Chan():
+		t.Errorf("unexpected BlockAcceptedEvent for %x", ev.Data.(BlockAcceptedEvent).Block.Hash())
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestBlockAcceptedSubscription(t *testing.T) {
+	minter, backend := newTestMinter(t, nil)
+	defer minter.close()
+	server := rpc.NewServer()
+	if err := server.RegisterName("raft", NewPublicRaftAPI(&RaftService{minter: minter})); err != nil {
+		t.Fatalf("failed to register raft API: %v", err)
+	}
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go server.ServeCodec(rpc.NewJSONCodec(serverConn), rpc.OptionMethodInvocation|rpc.OptionSubscriptions)
+
+	out, in := json.NewEncoder(clientConn), json.NewDecoder(clientConn)
+	request := map[string]interface{}{
+		"id":      1,
+		"jsonrpc": "2.0",
+		"method":  "raft_subscribe",
+		"params":  []interface{}{"blockAccepted"},
+	}
+	if err := out.Encode(request); err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+	var response struct {
+		Result string
+		Error  interface{}
+	}
+	if err := in.Decode(&response); err != nil || response.Error != nil {
+		t.Fatalf("failed to subscribe: %v %v", err, response.Error)
+	}
+
+	addTransactions(t, backend, signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1)))
+	minted := minter.mintNewBlock()
+	if minted == nil {
+		t.Fatalf("failed to mint block")
+	}
+
+	// Notifications are dropped until the server has activated the
+	// subscription, shortly after replying, so keep posting until one arrives.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			backend.mux.Post(BlockAcceptedEvent{Block: minted})
+			select {
+			case <-done:
+				return
+			case <-time.After(20 * time.Millisecond):
+			}
+		}
+	}()
+
+	var notification struct {
+		Params struct {
+			Subscription string
+			Result       AcceptedBlockInfo
+		}
+	}
+	if err := in.Decode(&notification); err != nil {
+		t.Fatalf("failed to read notification: %v", err)
+	}
+	if notification.Params.Subscription != response.Result {
+		t.Errorf("notification for subscription %s, expected %s", notification.Params.Subscription, response.Result)
+	}
+	if info := notification.Params.Result; info.Hash != minted.Hash() || info.Number != 1 || info.TxCount != 1 {
+		t.Errorf("unexpected accepted block: %+v", info)
+	}
+}
+
+func TestMutatingRaftAPIsArePrivate(t *testing.T) {
+	service := &RaftService{}
+	for _, api := range service.APIs() {
+		if _, private := api.Service.(*PrivateRaftAPI); private && api.Public {
+			t.Errorf("private raft API is public in namespace %q", api.Namespace)
+		}
+	}
+
+	public, private := reflect.TypeOf(&PublicRaftAPI{}), reflect.TypeOf(&PrivateRaftAPI{})
+	for _, method := range []string{
+		"SetCoinbase",
+		"SetBlockTime",
+		"PauseMinting",
+		"ResumeMinting",
+		"ResumeAfterDivergence",
+		"ForceMint",
+		"DrainPending",
+		"CancelCurrentRound",
+		"SubmitBatch",
+		"SubmitBundle",
+		"FlushState",
+		"ReconfigureMinter",
+	} {
+		if _, ok := public.MethodByName(method); ok {
+			t.Errorf("%s is exposed by the public API", method)
+		}
+		if _, ok := private.MethodByName(method); !ok {
+			t.Errorf("%s is missing from the private API", method)
+		}
+	}
+}
+
+func TestReconfigureMinterOverRPC(t *testing.T) {
+	minter, backend := newTestMinter(t, &MinterConfig{OnDemand: true})
+	defer minter.close()
+	api := NewPrivateRaftAPI(&RaftService{minter: minter})
+
+	var update MinterConfigUpdate
+	if err := json.Unmarshal([]byte(`{"maxTxsPerBlock": 1, "allowContractCreation": true}`), &update); err != nil {
+		t.Fatalf("failed to decode update: %v", err)
+	}
+	diff, err := api.ReconfigureMinter(update)
+	if err != nil {
+		t.Fatalf("failed to reconfigure: %v", err)
+	}
+	if diff["MaxTxsPerBlock"] != 1 || diff["AllowContractCreation"] != true || diff["OnDemand"] != true {
+		t.Errorf("unexpected settings after reconfiguring: %v", diff)
+	}
+
+	addTransactions(t, backend,
+		signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1)),
+		signedTransaction(t, testKey, 1, testRecvr, big.NewInt(1)),
+	)
+	if block := minter.mintNewBlock(); block == nil || len(block.Transactions()) != 1 {
+		t.Fatalf("expected a block with the single transaction allowed, got %v", block)
+	}
+
+	low := uint64(1)
+	if _, err := api.ReconfigureMinter(MinterConfigUpdate{GasLimit: &low, MaxTxsPerBlock: new(int)}); err != errGasLimitTooLow {
+		t.Fatalf("reconfiguring with a gas limit below the minimum: have %v, want %v", err, errGasLimitTooLow)
+	}
+	if settings := minter.currentSettings(); settings.GasLimit != 0 || settings.MaxTxsPerBlock != 1 {
+		t.Errorf("rejected update was partly applied: gas limit %d, max txs %d", settings.GasLimit, settings.MaxTxsPerBlock)
+	}
+}
+
+func TestMinterPostsRoundSummaryAfterPendingEvents(t *testing.T) {
+	minter, backend := newTestMinter(t, nil)
+	defer minter.close()
+	sub := backend.mux.Subscribe(core.PendingLogsEvent{}, RoundSummaryEvent{})
+	defer sub.Unsubscribe()
+
+	addTransactions(t, backend, signedTransaction(t, testKey, 0, testRecvr, big.NewInt(1)))
+	block := minter.mintNewBlock()
+	if block == nil {
+		t.Fatalf("failed to mint block")
+	}
+	var posted []interface{}
+	for len(posted) < 2 {
+		select {
+		case ev := <-sub.Chan():
+			posted = append(posted, ev.Data)
+		case <-time.After(time.Second):
+			t.Fatalf("only %d of the round's events posted", len(posted))
+		}
+	}
+	if _, ok := posted[0].(core.PendingLogsEvent); !ok {
+		t.Errorf("first event is a %T, expected the pending logs", posted[0])
+	}
+	if summary, ok := posted[1].(RoundSummaryEvent); !ok || summary.BlockHash != block.Hash() {
+		t.Errorf("second event is %+v, expected the summary of block %x", posted[1], block.Hash())
+	}
+}
@@ -0,0 +1,111 @@
+package raft
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/logger"
+	"github.com/ethereum/go-ethereum/logger/glog"
+)
+
+var errRoundCancelled = errors.New("minting round cancelled")
+
+// Allows a minting round to be cancelled from another goroutine, interrupting
+// the transaction it's executing.
+type roundControl struct {
+	mu        sync.Mutex
+	cancelled bool
+	txAbort   *int32 // EVM abort flag of the transaction being executed
+
+	// The earliest of our speculative blocks the round builds on, if any. It's
+	// the only new chain head which doesn't leave the round's work stale:
+	// chain updates wait for the round, so at most one arrives meanwhile.
+	nextHead common.Hash
+}
+
+func newRoundControl() *roundControl {
+	return &roundControl{}
+}
+
+func (round *roundControl) cancel() {
+	round.mu.Lock()
+	defer round.mu.Unlock()
+
+	round.cancelled = true
+	if round.txAbort != nil {
+		atomic.StoreInt32(round.txAbort, 1)
+	}
+}
+
+func (round *roundControl) isCancelled() bool {
+	round.mu.Lock()
+	defer round.mu.Unlock()
+
+	return round.cancelled
+}
+
+func (round *roundControl) expectHead(hash common.Hash) {
+	round.mu.Lock()
+	defer round.mu.Unlock()
+
+	round.nextHead = hash
+}
+
+// Returns the EVM abort flag for the next transaction. It's already set if the
+// round has been cancelled.
+func (round *roundControl) nextTx() *int32 {
+	round.mu.Lock()
+	defer round.mu.Unlock()
+
+	round.txAbort = new(int32)
+	if round.cancelled {
+		*round.txAbort = 1
+	}
+	return round.txAbort
+}
+
+// Cancels the in-progress minting round, if any, so that it doesn't produce a
+// block. Reports whether there was a round to cancel.
+func (minter *minter) cancelCurrentRound() bool {
+	minter.roundMu.Lock()
+	defer minter.roundMu.Unlock()
+
+	if minter.round == nil {
+		return false
+	}
+	minter.round.cancel()
+	return true
+}
+
+// Cancels the in-progress minting round, if any, if the given new chain head
+// leaves its work stale, i.e. the head isn't the next of our speculative
+// blocks. The speculative chain is about to be reset, so the block the round
+// would mint could never be accepted. Reports whether a round was cancelled.
+func (minter *minter) cancelStaleRound(head *types.Block) bool {
+	minter.roundMu.Lock()
+	defer minter.roundMu.Unlock()
+
+	round := minter.round
+	if round == nil {
+		return false
+	}
+	round.mu.Lock()
+	stale := round.nextHead != head.Hash()
+	round.mu.Unlock()
+	if !stale {
+		return false
+	}
+	glog.V(logger.Info).Infof("Cancelling the minting round, which new head %x left stale\n", head.Hash())
+	round.cancel()
+	return true
+}
+
+func (minter *minter) setCurrentRound(round *roundControl) {
+	minter.roundMu.Lock()
+	defer minter.roundMu.Unlock()
+
+	minter.round = round
+}
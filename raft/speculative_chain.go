@@ -24,6 +24,22 @@ type speculativeChain struct {
 	unappliedBlocks            *lane.Deque
 	expectedInvalidBlockHashes *set.Set // This is thread-safe. This set is referred to as our "guard" below.
 	proposedTxes               *set.Set // This is thread-safe.
+	proposedSlots              *set.Set // txSlots of proposedTxes. This is thread-safe.
+}
+
+// The sender and nonce of a transaction. Two transactions with the same slot
+// replace one another, so at most one of them can ever be minted.
+type txSlot struct {
+	from  common.Address
+	nonce uint64
+}
+
+func slotOf(tx *types.Transaction) (txSlot, bool) {
+	from, err := tx.From()
+	if err != nil {
+		return txSlot{}, false
+	}
+	return txSlot{from, tx.Nonce()}, true
 }
 
 func newSpeculativeChain() *speculativeChain {
@@ -32,6 +48,7 @@ func newSpeculativeChain() *speculativeChain {
 		unappliedBlocks:            lane.NewDeque(),
 		expectedInvalidBlockHashes: set.New(),
 		proposedTxes:               set.New(),
+		proposedSlots:              set.New(),
 	}
 }
 
@@ -40,6 +57,7 @@ func (chain *speculativeChain) clear(block *types.Block) {
 	chain.unappliedBlocks = lane.NewDeque()
 	chain.expectedInvalidBlockHashes.Clear()
 	chain.proposedTxes.Clear()
+	chain.proposedSlots.Clear()
 }
 
 // Append a new speculative block
@@ -56,8 +74,9 @@ func (chain *speculativeChain) setHead(block *types.Block) {
 	chain.head = block
 }
 
-// Accept this block, removing it from the head of the speculative chain
-func (chain *speculativeChain) accept(acceptedBlock *types.Block) {
+// Accept this block, removing it from the head of the speculative chain.
+// Returns whether it is the earliest block we minted.
+func (chain *speculativeChain) accept(acceptedBlock *types.Block) bool {
 	earliestProposedI := chain.unappliedBlocks.Shift()
 	var earliestProposed *types.Block
 	if nil != earliestProposedI {
@@ -72,6 +91,7 @@ func (chain *speculativeChain) accept(acceptedBlock *types.Block) {
 
 		chain.clear(acceptedBlock)
 	}
+	return earliestProposed != nil && earliestProposed.Hash() == acceptedBlock.Hash()
 }
 
 // Remove all blocks in the chain from the specified one until the end
@@ -129,10 +149,15 @@ func (chain *speculativeChain) unwindFrom(invalidHash common.Hash, headBlock *ty
 // flown through raft).
 func (chain *speculativeChain) recordProposedTransactions(txes types.Transactions) {
 	txHashIs := make([]interface{}, len(txes))
+	txSlotIs := make([]interface{}, 0, len(txes))
 	for i, tx := range txes {
 		txHashIs[i] = tx.Hash()
+		if slot, ok := slotOf(tx); ok {
+			txSlotIs = append(txSlotIs, slot)
+		}
 	}
 	chain.proposedTxes.Add(txHashIs...)
+	chain.proposedSlots.Add(txSlotIs...)
 }
 
 // Removes txes in block from our "blacklist" of "proposed tx" hashes. When we
@@ -145,8 +170,12 @@ func (chain *speculativeChain) recordProposedTransactions(txes types.Transaction
 func (chain *speculativeChain) removeProposedTxes(block *types.Block) {
 	minedTxes := block.Transactions()
 	minedTxInterfaces := make([]interface{}, len(minedTxes))
+	minedSlotInterfaces := make([]interface{}, 0, len(minedTxes))
 	for i, tx := range minedTxes {
 		minedTxInterfaces[i] = tx.Hash()
+		if slot, ok := slotOf(tx); ok {
+			minedSlotInterfaces = append(minedSlotInterfaces, slot)
+		}
 	}
 
 	// NOTE: we are using a thread-safe Set here, so it's fine if we access this
@@ -154,17 +183,31 @@ func (chain *speculativeChain) removeProposedTxes(block *types.Block) {
 	// lock here is preferable, because mintNewBlock holds its locks for a
 	// nontrivial amount of time.
 	chain.proposedTxes.Remove(minedTxInterfaces...)
+	chain.proposedSlots.Remove(minedSlotInterfaces...)
 }
 
+// Filters out the txes we've already proposed, along with any replacements of
+// them (txes from the same sender with the same nonce). A replacement can't be
+// minted on top of the speculative chain, since the proposed tx has used up its
+// nonce; if the block proposing it is unwound the replacement becomes eligible
+// again, and since the pool no longer holds the tx it replaced, it's the one to
+// be minted.
 func (chain *speculativeChain) withoutProposedTxes(addrTxes AddressTxes) AddressTxes {
 	newMap := make(AddressTxes)
 
 	for addr, txes := range addrTxes {
 		filteredTxes := make(types.Transactions, 0)
 		for _, tx := range txes {
-			if !chain.proposedTxes.Has(tx.Hash()) {
-				filteredTxes = append(filteredTxes, tx)
+			if chain.proposedTxes.Has(tx.Hash()) {
+				continue
+			}
+			if slot, ok := slotOf(tx); ok && chain.proposedSlots.Has(slot) {
+				if glog.V(logger.Detail) {
+					glog.Infof("TX (%x) replaces a proposed TX, deferring\n", tx.Hash().Bytes()[:4])
+				}
+				continue
 			}
+			filteredTxes = append(filteredTxes, tx)
 		}
 		if len(filteredTxes) > 0 {
 			newMap[addr] = filteredTxes
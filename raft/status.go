@@ -0,0 +1,203 @@
+package raft
+
+import (
+	"math/big"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/logger"
+	"github.com/ethereum/go-ethereum/logger/glog"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// MinterStatus is a point-in-time snapshot of the minter's internal state.
+type MinterStatus struct {
+	Minting   bool   `json:"minting"`
+	Healthy   bool   `json:"healthy"`
+	Diverged  bool   `json:"diverged"`  // paused over a state root mismatch or an invalid block
+	Paused    bool   `json:"paused"`    // by admin_pauseMinting
+	BlockTime uint64 `json:"blockTime"` // in milliseconds
+
+	// Head of the speculative chain, which is the chain head unless blocks
+	// minted by this node await acceptance
+	HeadNumber uint64      `json:"headNumber"`
+	HeadHash   common.Hash `json:"headHash"`
+
+	// Transactions in minted blocks which raft hasn't accepted yet
+	ProposedTxes int `json:"proposedTxes"`
+
+	// Blocks minted by this node, across restarts, and the timestamp and
+	// coinbase of the last one
+	TotalBlocksMinted uint64         `json:"totalBlocksMinted"`
+	LastMintTime      time.Time      `json:"lastMintTime"`
+	LastCoinbase      common.Address `json:"lastCoinbase"`
+
+	// Minting requests are coalesced by the shouldMine RingChannel, so a
+	// single round serves every request made since the previous one.
+	PendingRequests   uint32 `json:"pendingRequests"`
+	CoalescedRequests uint32 `json:"coalescedRequests"` // served by the last round
+
+	// Gas prices of the transactions in the last minted block, by bucket
+	LastBlockGasPrices map[string]uint64 `json:"lastBlockGasPrices"`
+
+	// Minimum gas price the next round will include
+	GasPriceFloor *big.Int `json:"gasPriceFloor"`
+}
+
+// MintingLatency holds percentiles of the time from the timestamp of each of
+// the last minted blocks until it was minted.
+type MintingLatency struct {
+	Blocks int           `json:"blocks"` // sampled
+	P50    time.Duration `json:"p50"`
+	P95    time.Duration `json:"p95"`
+	P99    time.Duration `json:"p99"`
+}
+
+// Keeps the minting latencies of the last blocks, oldest first.
+type latencySampler struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	size    int
+}
+
+func newLatencySampler(size int) *latencySampler {
+	return &latencySampler{size: size}
+}
+
+// Adds the latency of a block, counting negative ones as zero.
+func (sampler *latencySampler) add(latency time.Duration) {
+	if latency < 0 {
+		latency = 0
+	}
+	sampler.mu.Lock()
+	defer sampler.mu.Unlock()
+
+	sampler.samples = append(sampler.samples, latency)
+	if len(sampler.samples) > sampler.size {
+		sampler.samples = sampler.samples[len(sampler.samples)-sampler.size:]
+	}
+}
+
+func (sampler *latencySampler) percentiles() *MintingLatency {
+	sampler.mu.Lock()
+	sorted := make([]time.Duration, len(sampler.samples))
+	copy(sorted, sampler.samples)
+	sampler.mu.Unlock()
+
+	latency := &MintingLatency{Blocks: len(sorted)}
+	if len(sorted) == 0 {
+		return latency
+	}
+	sort.Sort(durations(sorted))
+
+	// Nearest rank: the smallest sample at least p percent of them don't exceed.
+	percentile := func(p int) time.Duration {
+		rank := (p*len(sorted) + 99) / 100
+		if rank < 1 {
+			rank = 1
+		}
+		return sorted[rank-1]
+	}
+	latency.P50, latency.P95, latency.P99 = percentile(50), percentile(95), percentile(99)
+	return latency
+}
+
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+// The minting contribution of this node, as persisted in the chain database.
+type mintRecord struct {
+	BlocksMinted uint64
+	LastMinted   uint64 // timestamp of the last block, in nanoseconds
+	LastCoinbase common.Address
+}
+
+func (record mintRecord) lastMintTime() time.Time {
+	if record.BlocksMinted == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(record.LastMinted))
+}
+
+// Loads the persisted mint record, starting afresh if there's none or it's
+// unreadable.
+func loadMintRecord(db ethdb.Database) mintRecord {
+	var record mintRecord
+	data, err := db.Get(mintRecordDbKey)
+	if err != nil || len(data) == 0 {
+		return record
+	}
+	if err := rlp.DecodeBytes(data, &record); err != nil {
+		glog.V(logger.Warn).Infof("Ignoring unreadable mint record: %v\n", err)
+		return mintRecord{}
+	}
+	return record
+}
+
+// Records a minted block, persisting the updated record. Failing to persist
+// it doesn't affect minting. Assumes mu is held.
+func (minter *minter) recordMint(block *types.Block) {
+	minter.record.BlocksMinted++
+	minter.record.LastMinted = block.Time().Uint64()
+	minter.record.LastCoinbase = block.Coinbase()
+
+	data, err := rlp.EncodeToBytes(&minter.record)
+	if err == nil {
+		err = minter.chainDb.Put(mintRecordDbKey, data)
+	}
+	if err != nil {
+		glog.V(logger.Warn).Infof("Failed to persist the mint record: %v\n", err)
+	}
+}
+
+// MinterLifetime holds the minter's cumulative production since startup.
+type MinterLifetime struct {
+	StartTime     time.Time `json:"startTime"`
+	Uptime        uint64    `json:"uptime"` // in seconds
+	BlocksMinted  uint64    `json:"blocksMinted"`
+	TxesCommitted uint64    `json:"txesCommitted"`
+}
+
+func (minter *minter) lifetime() *MinterLifetime {
+	return &MinterLifetime{
+		StartTime:     minter.startTime,
+		Uptime:        uint64(time.Since(minter.startTime) / time.Second),
+		BlocksMinted:  atomic.LoadUint64(&minter.blocksMinted),
+		TxesCommitted: atomic.LoadUint64(&minter.txesCommitted),
+	}
+}
+
+func (minter *minter) status() *MinterStatus {
+	minter.mu.Lock()
+	defer minter.mu.Unlock()
+
+	return &MinterStatus{
+		Minting:   atomic.LoadInt32(&minter.minting) == 1,
+		Healthy:   atomic.LoadInt32(&minter.unhealthy) == 0,
+		Diverged:  atomic.LoadInt32(&minter.diverged) == 1,
+		Paused:    atomic.LoadInt32(&minter.paused) == 1,
+		BlockTime: uint64(minter.currentBlockTime() / time.Millisecond),
+
+		HeadNumber:   minter.speculativeChain.head.NumberU64(),
+		HeadHash:     minter.speculativeChain.head.Hash(),
+		ProposedTxes: minter.speculativeChain.proposedTxes.Size(),
+
+		TotalBlocksMinted: minter.record.BlocksMinted,
+		LastMintTime:      minter.record.lastMintTime(),
+		LastCoinbase:      minter.record.LastCoinbase,
+
+		PendingRequests:   atomic.LoadUint32(&minter.pendingRequests),
+		CoalescedRequests: atomic.LoadUint32(&minter.coalesced),
+
+		LastBlockGasPrices: minter.lastGasPrices.toMap(),
+		GasPriceFloor:      minter.gasPriceFloor(minter.currentSettings()),
+	}
+}
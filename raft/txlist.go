@@ -0,0 +1,214 @@
+package raft
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// TxSource serves the pending transactions of a round, in the order they're
+// packed. Pop skips the rest of the transactions from the sender of the next
+// one.
+type TxSource interface {
+	Peek() *types.Transaction
+	Shift()
+	Pop()
+}
+
+// A TxSource serving transactions in a fixed order.
+type txList struct {
+	txes    types.Transactions
+	skipped map[common.Address]bool // senders whose remaining transactions are skipped
+}
+
+func newTxList(txes types.Transactions) *txList {
+	return &txList{txes: txes, skipped: make(map[common.Address]bool)}
+}
+
+func (list *txList) Peek() *types.Transaction {
+	for len(list.txes) > 0 {
+		tx := list.txes[0]
+		if from, err := tx.From(); err == nil && !list.skipped[from] {
+			return tx
+		}
+		list.txes = list.txes[1:]
+	}
+	return nil
+}
+
+func (list *txList) Shift() {
+	if list.Peek() != nil {
+		list.txes = list.txes[1:]
+	}
+}
+
+func (list *txList) Pop() {
+	if tx := list.Peek(); tx != nil {
+		from, _ := tx.From()
+		list.skipped[from] = true
+		list.txes = list.txes[1:]
+	}
+}
+
+// Drains the transactions of a source, in order.
+func drainTxSource(source TxSource) types.Transactions {
+	var txes types.Transactions
+	for tx := source.Peek(); tx != nil; tx = source.Peek() {
+		txes = append(txes, tx)
+		source.Shift()
+	}
+	return txes
+}
+
+// A TxSource taking turns between senders, in order of address. Each turn
+// serves up to perTurn transactions of a sender, in nonce order.
+type txTurns struct {
+	senders []common.Address // with transactions left, the current one first
+	txes    map[common.Address]types.Transactions
+	perTurn int
+	served  int // by the current sender this turn
+}
+
+func newTxTurns(addrTxes AddressTxes, perTurn int) *txTurns {
+	turns := &txTurns{txes: make(map[common.Address]types.Transactions), perTurn: perTurn}
+	for from, txes := range addrTxes {
+		if len(txes) > 0 {
+			turns.senders = append(turns.senders, from)
+			turns.txes[from] = txes
+		}
+	}
+	sort.Sort(addressesByValue(turns.senders))
+	return turns
+}
+
+func (turns *txTurns) Peek() *types.Transaction {
+	if len(turns.senders) == 0 {
+		return nil
+	}
+	return turns.txes[turns.senders[0]][0]
+}
+
+func (turns *txTurns) Shift() {
+	if len(turns.senders) == 0 {
+		return
+	}
+	from := turns.senders[0]
+	turns.txes[from] = turns.txes[from][1:]
+	turns.served++
+
+	switch {
+	case len(turns.txes[from]) == 0:
+		turns.Pop()
+	case turns.served >= turns.perTurn:
+		turns.senders = append(turns.senders[1:], from)
+		turns.served = 0
+	}
+}
+
+func (turns *txTurns) Pop() {
+	if len(turns.senders) == 0 {
+		return
+	}
+	delete(turns.txes, turns.senders[0])
+	turns.senders = turns.senders[1:]
+	turns.served = 0
+}
+
+// TxSelector is a policy ordering the pending transactions of each round. It's
+// passed the transactions of each sender in nonce order, and the source it
+// returns must keep them in that order. The map mustn't be retained.
+type TxSelector interface {
+	Select(pending AddressTxes) TxSource
+}
+
+// PriceAndNonceSelector orders transactions by price, highest first, and nonce.
+// This is the default policy.
+type PriceAndNonceSelector struct{}
+
+func (PriceAndNonceSelector) Select(pending AddressTxes) TxSource {
+	return types.NewTransactionsByPriceAndNonce(pending)
+}
+
+// Takes turns between senders, serving up to this many transactions of each.
+type senderTurnsSelector int
+
+func (perTurn senderTurnsSelector) Select(pending AddressTxes) TxSource {
+	return newTxTurns(pending, int(perTurn))
+}
+
+// FIFOSelector orders transactions by the round in which it first saw them,
+// earliest first, regardless of price. Transactions first seen in the same
+// round are ordered by sender address, and a sender's transactions always
+// remain in nonce order. A transaction which leaves the pending set, e.g. by
+// being minted in a block which is later unwound, loses its place.
+type FIFOSelector struct {
+	mu    sync.Mutex
+	round uint64
+	seen  map[common.Hash]uint64 // round in which each pending transaction was first seen
+}
+
+func NewFIFOSelector() *FIFOSelector {
+	return &FIFOSelector{seen: make(map[common.Hash]uint64)}
+}
+
+func (selector *FIFOSelector) Select(pending AddressTxes) TxSource {
+	selector.mu.Lock()
+	defer selector.mu.Unlock()
+
+	selector.round++
+	seen := make(map[common.Hash]uint64)
+	var arrivals []txArrival
+	for from, txes := range pending {
+		var prev uint64
+		for _, tx := range txes {
+			round, ok := selector.seen[tx.Hash()]
+			if !ok {
+				round = selector.round
+			}
+			seen[tx.Hash()] = round
+
+			// A transaction can't go ahead of its sender's earlier ones.
+			if round < prev {
+				round = prev
+			}
+			prev = round
+			arrivals = append(arrivals, txArrival{tx: tx, from: from, round: round})
+		}
+	}
+	selector.seen = seen
+
+	sort.Stable(txArrivals(arrivals))
+	txes := make(types.Transactions, len(arrivals))
+	for i, arrival := range arrivals {
+		txes[i] = arrival.tx
+	}
+	return newTxList(txes)
+}
+
+type txArrival struct {
+	tx    *types.Transaction
+	from  common.Address
+	round uint64
+}
+
+// Sorts by round, then by sender, keeping the order of each sender's
+// transactions.
+type txArrivals []txArrival
+
+func (a txArrivals) Len() int      { return len(a) }
+func (a txArrivals) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a txArrivals) Less(i, j int) bool {
+	if a[i].round != a[j].round {
+		return a[i].round < a[j].round
+	}
+	return bytes.Compare(a[i].from[:], a[j].from[:]) < 0
+}
+
+type addressesByValue []common.Address
+
+func (a addressesByValue) Len() int           { return len(a) }
+func (a addressesByValue) Less(i, j int) bool { return bytes.Compare(a[i][:], a[j][:]) < 0 }
+func (a addressesByValue) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
@@ -6,8 +6,11 @@ import (
 	"github.com/coreos/etcd/raft/raftpb"
 	"github.com/coreos/etcd/wal"
 	"github.com/coreos/etcd/wal/walpb"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/logger"
 	"github.com/ethereum/go-ethereum/logger/glog"
+	"github.com/ethereum/go-ethereum/rlp"
 )
 
 func (pm *ProtocolManager) openWAL(maybeSnapshot *raftpb.Snapshot) *wal.WAL {
@@ -49,12 +52,47 @@ func (pm *ProtocolManager) replayWAL() *wal.WAL {
 		glog.Fatalf("failed to read WAL (%v)", err)
 	}
 
+	// Applying the snapshot overwrites the persisted applied index, so read it
+	// beforehand.
+	appliedIndex := pm.loadAppliedIndex()
+
 	if maybeSnapshot != nil {
 		pm.applySnapshot(*maybeSnapshot)
 	}
 
+	if committedHash, ok := lastAppliedBlockHash(maybeSnapshot, entries, appliedIndex); ok {
+		if err := pm.minter.checkCommittedHead(committedHash); err != nil {
+			if pm.minter.currentSettings().FatalHeadDivergence {
+				glog.Fatalf("chain has diverged from the raft log (%v)", err)
+			}
+			glog.V(logger.Error).Infof("chain has diverged from the raft log: %v", err)
+		}
+	}
+
 	pm.raftStorage.SetHardState(hardState)
 	pm.raftStorage.Append(entries)
 
 	return wal
 }
+
+// Returns the hash of the last block that was applied to the chain, taken from
+// the last block entry of the WAL at or below appliedIndex. Falls back on the
+// head recorded by the snapshot if the WAL holds no such entry.
+func lastAppliedBlockHash(snapshot *raftpb.Snapshot, entries []raftpb.Entry, appliedIndex uint64) (common.Hash, bool) {
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		if entry.Index > appliedIndex || entry.Type != raftpb.EntryNormal || len(entry.Data) == 0 {
+			continue
+		}
+		var block types.Block
+		if err := rlp.DecodeBytes(entry.Data, &block); err != nil {
+			glog.V(logger.Error).Infof("error decoding block at index %d: %v", entry.Index, err)
+			continue
+		}
+		return block.Hash(), true
+	}
+	if snapshot != nil {
+		return common.BytesToHash(snapshot.Data), true
+	}
+	return common.Hash{}, false
+}
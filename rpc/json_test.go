@@ -176,3 +176,22 @@ func TestJSONRequestParamsParsing(t *testing.T) {
 		}
 	}
 }
+
+func TestJSONSubscribeRequestParsing(t *testing.T) {
+	req := bytes.NewBufferString(`{"id": 1, "jsonrpc": "2.0", "method": "raft_subscribe", "params": ["invalidOrdering"]}`)
+	rw := &RWC{bufio.NewReadWriter(bufio.NewReader(req), bufio.NewWriter(new(bytes.Buffer)))}
+
+	requests, _, err := NewJSONCodec(rw).ReadRequestHeaders()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(requests) != 1 {
+		t.Fatalf("Expected 1 request but got %d requests - %v", len(requests), requests)
+	}
+	if !requests[0].isPubSub {
+		t.Fatalf("Expected a subscription request")
+	}
+	if requests[0].service != "raft" || requests[0].method != "invalidOrdering" {
+		t.Fatalf("Expected raft.invalidOrdering but got %s.%s", requests[0].service, requests[0].method)
+	}
+}
@@ -163,6 +163,18 @@ func (t *SecureTrie) NodeIterator() *NodeIterator {
 	return NewNodeIterator(&t.trie)
 }
 
+// Copy returns a copy of the trie. Nodes are never modified in place, so the
+// copy and the original can be updated independently.
+func (t *SecureTrie) Copy() *SecureTrie {
+	cpy := *t
+	cpy.secKeyCache = make(map[string][]byte, len(t.getSecKeyCache()))
+	for hk, key := range t.secKeyCache {
+		cpy.secKeyCache[hk] = key
+	}
+	cpy.secKeyCacheOwner = &cpy
+	return &cpy
+}
+
 // CommitTo writes all nodes and the secure hash pre-images to the given database.
 // Nodes are stored with their sha3 hash as the key.
 //
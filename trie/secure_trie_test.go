@@ -143,3 +143,23 @@ func TestSecureTrieConcurrency(t *testing.T) {
 	// Wait for all threads to finish
 	pend.Wait()
 }
+
+func TestSecureTrieCopy(t *testing.T) {
+	trie := newEmptySecure()
+	trie.Update([]byte("foo"), []byte("bar"))
+	root := trie.Hash()
+
+	cpy := trie.Copy()
+	trie.Update([]byte("foo"), []byte("baz"))
+	trie.Update([]byte("qux"), []byte("quux"))
+
+	if value := cpy.Get([]byte("foo")); !bytes.Equal(value, []byte("bar")) {
+		t.Errorf("copy sees update: have %q, want %q", value, "bar")
+	}
+	if cpy.Hash() != root {
+		t.Errorf("copy root changed: have %x, want %x", cpy.Hash(), root)
+	}
+	if key := cpy.GetKey(crypto.Keccak256([]byte("foo"))); !bytes.Equal(key, []byte("foo")) {
+		t.Errorf("copy lost preimage: have %q", key)
+	}
+}